@@ -1,7 +1,9 @@
 package bfutils
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"os"
 	"regexp"
@@ -35,12 +37,75 @@ type FileOrMemWriter interface {
 	Flusher
 }
 
+// BufferPolicy decides when output is written to stdout
+type BufferPolicy int
+
+const (
+	// Output is written when the buffer is full, before reading input and when done
+	FullyBuffered BufferPolicy = iota
+	// Output is also written after every newline
+	LineBuffered
+	// Output is written immediately, and input is read one byte at a time, for interactive programs
+	Unbuffered
+)
+
+var bufferPolicies = []string{
+	FullyBuffered: "full",
+	LineBuffered:  "line",
+	Unbuffered:    "none",
+}
+
+func (policy BufferPolicy) String() string {
+	return bufferPolicies[policy]
+}
+
+// ParseBufferPolicy parses the name of a buffer policy: full, line or none
+func ParseBufferPolicy(name string) (BufferPolicy, error) {
+	for policy, policyName := range bufferPolicies {
+		if name == policyName {
+			return BufferPolicy(policy), nil
+		}
+	}
+	return FullyBuffered, fmt.Errorf("unknown buffer policy %s", name)
+}
+
+// DefaultBufferPolicy is line buffered for terminals, and fully buffered otherwise, like C stdio
+func DefaultBufferPolicy(out *os.File) BufferPolicy {
+	info, err := out.Stat()
+	if err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return LineBuffered
+	}
+	return FullyBuffered
+}
+
 type StdoutWrapper struct {
-	*os.File
+	*bufio.Writer
+	policy BufferPolicy
+}
+
+func (out *StdoutWrapper) Write(p []byte) (int, error) {
+	n, err := out.Writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if out.policy == Unbuffered || (out.policy == LineBuffered && bytes.IndexByte(p, '\n') != -1) {
+		err = out.Writer.Flush()
+	}
+	return n, err
 }
 
-func (out StdoutWrapper) Flush() error {
-	return out.Sync()
+// flushingReader flushes the output before every read from the underlying reader,
+// so that a prompt is shown before the program waits for input
+type flushingReader struct {
+	in  io.Reader
+	out Flusher
+}
+
+func (r flushingReader) Read(p []byte) (int, error) {
+	if err := r.out.Flush(); err != nil {
+		return 0, err
+	}
+	return r.in.Read(p)
 }
 
 type BufferWrapper struct {
@@ -55,8 +120,18 @@ func (out BufferWrapper) Bytes() *bytes.Buffer {
 	return out.Bytes()
 }
 
-func WrapStdout(out *os.File) StdoutWrapper {
-	return StdoutWrapper{out}
+func WrapStdout(out *os.File, policy BufferPolicy) *StdoutWrapper {
+	return &StdoutWrapper{bufio.NewWriter(out), policy}
+}
+
+// WrapStdin returns a reader that flushes out before it has to wait for input.
+// Unless the policy is Unbuffered, the input is also read in blocks instead of byte by byte.
+func WrapStdin(in io.Reader, out Flusher, policy BufferPolicy) FileOrMemReader {
+	r := flushingReader{in, out}
+	if policy == Unbuffered {
+		return r
+	}
+	return bufio.NewReader(r)
 }
 
 func WrapBuffer(buf *bytes.Buffer) FileOrMemWriter {
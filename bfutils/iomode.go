@@ -0,0 +1,224 @@
+package bfutils
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Encoding decides how the value of a cell is written to the output and read from the input
+type Encoding int
+
+const (
+	// Every cell is written and read as a single byte
+	EncodingBytes Encoding = iota
+	// Every cell is a unicode code point, written and read as UTF-8
+	EncodingUTF8
+)
+
+var encodings = []string{
+	EncodingBytes: "bytes",
+	EncodingUTF8:  "utf8",
+}
+
+func (encoding Encoding) String() string {
+	return encodings[encoding]
+}
+
+// Newlines decides how line endings in the input are translated before the program reads them.
+// The output is never translated.
+type Newlines int
+
+const (
+	// The input is read as is
+	NewlinesBinary Newlines = iota
+	// CR LF and a lone CR are read as LF, so Enter is always 10
+	NewlinesLF
+	// LF, CR and CR LF are all read as CR LF, for programs that expect Enter to be 13 followed by 10
+	NewlinesCRLFIn
+)
+
+var newlineModes = []string{
+	NewlinesBinary: "binary",
+	NewlinesLF:     "text-lf",
+	NewlinesCRLFIn: "text-crlf-in",
+}
+
+func (newlines Newlines) String() string {
+	return newlineModes[newlines]
+}
+
+// IOMode holds how a program reads its input and writes its output,
+// which the interpreter and the generated code should agree on
+type IOMode struct {
+	Encoding Encoding
+	Newlines Newlines
+}
+
+// ParseIOMode parses a comma separated list of I/O options, like "utf8,text-lf"
+func ParseIOMode(s string) (IOMode, error) {
+	var mode IOMode
+	for _, name := range strings.Split(s, ",") {
+		found := false
+		for encoding, encodingName := range encodings {
+			if name == encodingName {
+				mode.Encoding = Encoding(encoding)
+				found = true
+			}
+		}
+		for newlines, newlinesName := range newlineModes {
+			if name == newlinesName {
+				mode.Newlines = Newlines(newlines)
+				found = true
+			}
+		}
+		if !found {
+			return IOMode{}, fmt.Errorf("unknown I/O mode %s", name)
+		}
+	}
+	return mode, nil
+}
+
+// EncodeUTF8 encodes the value of a cell as UTF-8. Values that are not valid
+// code points, like surrogates or values above U+10FFFF, are written as U+FFFD.
+func EncodeUTF8(value uint64) []byte {
+	if value > utf8.MaxRune {
+		value = utf8.RuneError
+	}
+	return utf8.AppendRune(nil, rune(value))
+}
+
+// ReadOneByte reads one byte from in into buf[0]. A byte that comes together with an error
+// is still read, and no byte without an error is the end of the input.
+func ReadOneByte(in io.Reader, buf []byte) error {
+	n, err := in.Read(buf[:1])
+	if n > 0 {
+		return nil
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	return err
+}
+
+// ReadUTF8 reads one UTF-8 encoded code point, and returns it together with the bytes that were read.
+// An invalid lead byte, an unexpected byte in the middle of a sequence, overlong sequences,
+// surrogates and values above U+10FFFF are read as U+FFFD. The generated code does the same.
+// The error is only set if there was no input at all.
+func ReadUTF8(in io.Reader) (rune, []byte, error) {
+	read := make([]byte, 0, utf8.UTFMax)
+	b := make([]byte, 1)
+
+	if err := ReadOneByte(in, b); err != nil {
+		return 0, read, err
+	}
+	read = append(read, b[0])
+
+	lead := b[0]
+	var cp rune
+	var n int
+	switch {
+	case lead < 0x80:
+		return rune(lead), read, nil
+	case lead >= 0xc2 && lead <= 0xdf:
+		cp, n = rune(lead&0x1f), 1
+	case lead >= 0xe0 && lead <= 0xef:
+		cp, n = rune(lead&0x0f), 2
+	case lead >= 0xf0 && lead <= 0xf4:
+		cp, n = rune(lead&0x07), 3
+	default:
+		return utf8.RuneError, read, nil
+	}
+
+	for ; n > 0; n-- {
+		if ReadOneByte(in, b) != nil {
+			return utf8.RuneError, read, nil
+		}
+		read = append(read, b[0])
+		if b[0]&0xc0 != 0x80 {
+			return utf8.RuneError, read, nil
+		}
+		cp = cp<<6 | rune(b[0]&0x3f)
+	}
+
+	overlong := (lead >= 0xe0 && cp < 0x800) || (lead >= 0xf0 && cp < 0x10000)
+	if overlong || (cp >= 0xd800 && cp <= 0xdfff) || cp > utf8.MaxRune {
+		return utf8.RuneError, read, nil
+	}
+	return cp, read, nil
+}
+
+// NewlineReader translates the line endings of the input one byte at a time, so it never
+// waits for more input than the program asks for, which matters for interactive programs.
+// The generated code translates the input in the same way.
+type NewlineReader struct {
+	in        io.Reader
+	newlines  Newlines
+	afterCR   bool
+	pendingLF bool
+	buf       []byte
+}
+
+// NewNewlineReader returns a reader that translates the line endings read from in,
+// or in itself when nothing has to be translated
+func NewNewlineReader(in io.Reader, newlines Newlines) io.Reader {
+	if newlines == NewlinesBinary {
+		return in
+	}
+	return &NewlineReader{in: in, newlines: newlines, buf: make([]byte, 1)}
+}
+
+// NewlineState is a line ending the NewlineReader is in the middle of, which has to be
+// kept when the reading stops and continues later with another reader
+type NewlineState struct {
+	// The last byte read was a CR, so an LF that follows belongs to it
+	AfterCR bool
+	// The LF of a translated line ending was not returned yet
+	PendingLF bool
+}
+
+// State returns the line ending the reader is in the middle of
+func (r *NewlineReader) State() NewlineState {
+	return NewlineState{AfterCR: r.afterCR, PendingLF: r.pendingLF}
+}
+
+// SetState continues a line ending returned by State
+func (r *NewlineReader) SetState(state NewlineState) {
+	r.afterCR, r.pendingLF = state.AfterCR, state.PendingLF
+}
+
+func (r *NewlineReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if r.pendingLF {
+		r.pendingLF = false
+		p[0] = '\n'
+		return 1, nil
+	}
+
+	for {
+		if err := ReadOneByte(r.in, r.buf); err != nil {
+			return 0, err
+		}
+		c := r.buf[0]
+		afterCR := r.afterCR
+		r.afterCR = c == '\r'
+
+		if c == '\n' && afterCR {
+			// The LF of a CR LF, which was already translated together with the CR
+			continue
+		}
+		if c == '\r' || c == '\n' {
+			if r.newlines == NewlinesCRLFIn {
+				c = '\r'
+				r.pendingLF = true
+			} else {
+				c = '\n'
+			}
+		}
+		p[0] = c
+		return 1, nil
+	}
+}
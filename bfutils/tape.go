@@ -0,0 +1,85 @@
+package bfutils
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TapeInit holds bytes that are loaded into the tape before the program starts,
+// one byte in each cell, starting at Offset
+type TapeInit struct {
+	Offset int
+	Data   []byte
+}
+
+// ParseTapeInit parses a tape initialization like data.bin@100 or 0x48690a@100. The data
+// is read from a file, or given as hex after 0x. Without @ it is loaded at the start of the tape.
+func ParseTapeInit(spec string) (TapeInit, error) {
+	init := TapeInit{}
+	source := spec
+	if at := strings.LastIndex(spec, "@"); at >= 0 {
+		offset, err := strconv.Atoi(spec[at+1:])
+		if err != nil || offset < 0 {
+			return TapeInit{}, fmt.Errorf("invalid tape offset in %s", spec)
+		}
+		init.Offset = offset
+		source = spec[:at]
+	}
+
+	var err error
+	if strings.HasPrefix(source, "0x") {
+		if init.Data, err = hex.DecodeString(source[2:]); err != nil {
+			return TapeInit{}, fmt.Errorf("invalid hex data in %s: %v", spec, err)
+		}
+	} else if init.Data, err = os.ReadFile(source); err != nil {
+		return TapeInit{}, err
+	}
+	return init, nil
+}
+
+// TapeSegment is a run of consecutive cells with initial values
+type TapeSegment struct {
+	Offset int
+	Data   []byte
+}
+
+// TapeSegments merges the tape initializations into sorted runs of consecutive cells,
+// where later initializations overwrite earlier ones
+func TapeSegments(inits []TapeInit) []TapeSegment {
+	cells := make(map[int]byte)
+	for _, init := range inits {
+		for i, b := range init.Data {
+			cells[init.Offset+i] = b
+		}
+	}
+	addrs := make([]int, 0, len(cells))
+	for addr := range cells {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+
+	segments := make([]TapeSegment, 0)
+	for _, addr := range addrs {
+		last := len(segments) - 1
+		if last >= 0 && segments[last].Offset+len(segments[last].Data) == addr {
+			segments[last].Data = append(segments[last].Data, cells[addr])
+		} else {
+			segments = append(segments, TapeSegment{Offset: addr, Data: []byte{cells[addr]}})
+		}
+	}
+	return segments
+}
+
+// CheckTapeInit returns an error if a tape initialization does not fit in the memory
+func CheckTapeInit(inits []TapeInit, memorySize int) error {
+	for _, init := range inits {
+		if init.Offset+len(init.Data) > memorySize {
+			return fmt.Errorf("tape initialization of %d bytes at %d does not fit in %d cells", len(init.Data), init.Offset, memorySize)
+		}
+	}
+	return nil
+}
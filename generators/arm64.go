@@ -0,0 +1,243 @@
+package generators
+
+import (
+	"log"
+)
+
+// arm64Target writes AArch64 assembly for the native generators, with the load and store
+// instructions for a cell size, where the unscaled variants are used for negative offsets.
+// x9 is the scratch register for the values that do not fit in an immediate.
+type arm64Target struct {
+	bytes     int
+	ldr       string
+	ldrU      string
+	str       string
+	strU      string
+	directive string
+}
+
+func newARM64Target(wordSize int) arm64Target {
+	switch wordSize {
+	case 8:
+		if SignedCells {
+			return arm64Target{1, "ldrsb", "ldursb", "strb", "sturb", ".byte"}
+		}
+		return arm64Target{1, "ldrb", "ldurb", "strb", "sturb", ".byte"}
+	case 16:
+		if SignedCells {
+			return arm64Target{2, "ldrsh", "ldursh", "strh", "sturh", ".hword"}
+		}
+		return arm64Target{2, "ldrh", "ldurh", "strh", "sturh", ".hword"}
+	case 32:
+		return arm64Target{4, "ldr", "ldur", "str", "stur", ".word"}
+	}
+	log.Fatalf("Error: Unknown word size %d\n", wordSize)
+	return arm64Target{}
+}
+
+// arm64Mov moves a value into a register, with movk for the upper half if needed.
+// A 64 bit register is sign extended from 32 bits.
+func arm64Mov(f *GeneratorOutput, reg string, value int) {
+	w := "w" + reg[1:]
+	v := uint32(value)
+	switch {
+	case v <= 0xffff:
+		f.Printf("	mov %s, #%d\n", w, v)
+	case ^v <= 0xffff:
+		f.Printf("	mov %s, #%d\n", w, int32(v))
+	default:
+		f.Printf("	mov %s, #%d\n", w, v&0xffff)
+		f.Printf("	movk %s, #%d, lsl #16\n", w, v>>16)
+	}
+	if reg[0] == 'x' && int32(v) < 0 {
+		f.Printf("	sxtw %s, %s\n", reg, w)
+	}
+}
+
+// arm64AddImm adds a value to a 64 bit register, through x9 if it does not fit in an immediate
+func arm64AddImm(f *GeneratorOutput, reg string, value int) {
+	op := "add"
+	if value < 0 {
+		op = "sub"
+		value = -value
+	}
+	if value <= 4095 {
+		f.Printf("	%s %s, %s, #%d\n", op, reg, reg, value)
+	} else {
+		arm64Mov(f, "x9", value)
+		f.Printf("	%s %s, %s, x9\n", op, reg, reg)
+	}
+}
+
+// access loads or stores the cell at offset from the pointer in x19
+func (c arm64Target) access(f *GeneratorOutput, scaled string, unscaled string, reg string, offset int) {
+	bytes := offset * c.bytes
+	switch {
+	case bytes == 0:
+		f.Printf("	%s %s, [x19]\n", scaled, reg)
+	case bytes > 0 && bytes <= 4095*c.bytes:
+		f.Printf("	%s %s, [x19, #%d]\n", scaled, reg, bytes)
+	case bytes >= -256 && bytes < 0:
+		f.Printf("	%s %s, [x19, #%d]\n", unscaled, reg, bytes)
+	default:
+		arm64Mov(f, "x9", bytes)
+		f.Printf("	add x9, x19, x9\n")
+		f.Printf("	%s %s, [x9]\n", scaled, reg)
+	}
+}
+
+func (c arm64Target) syntax() nativeSyntax {
+	return nativeSyntax{"//", c.directive, "%progbits"}
+}
+
+func (c arm64Target) start(f *GeneratorOutput) {}
+
+func (c arm64Target) registers() nativeRegisters {
+	return nativeRegisters{"x19", []string{"w0", "w1", "w2"}}
+}
+
+func (c arm64Target) address(f *GeneratorOutput, reg string, symbol string) {
+	f.Printf("	adrp %s, %s\n", reg, symbol)
+	f.Printf("	add %s, %s, :lo12:%s\n", reg, reg, symbol)
+}
+
+func (c arm64Target) load(f *GeneratorOutput, reg string, offset int) {
+	c.access(f, c.ldr, c.ldrU, reg, offset)
+}
+
+func (c arm64Target) store(f *GeneratorOutput, reg string, offset int) {
+	c.access(f, c.str, c.strU, reg, offset)
+}
+
+func (c arm64Target) constant(f *GeneratorOutput, reg string, value int) {
+	arm64Mov(f, reg, value)
+}
+
+func (c arm64Target) arith(f *GeneratorOutput, op string, reg string, value int) {
+	if value >= 0 && value <= 4095 {
+		f.Printf("	%s %s, %s, #%d\n", op, reg, reg, value)
+	} else {
+		arm64Mov(f, "w9", value)
+		f.Printf("	%s %s, %s, w9\n", op, reg, reg)
+	}
+}
+
+func (c arm64Target) mulAdd(f *GeneratorOutput, dst string, src string, factor int) {
+	if factor == 1 {
+		f.Printf("	add %s, %s, %s\n", dst, dst, src)
+		return
+	}
+	arm64Mov(f, "w9", factor)
+	f.Printf("	madd %s, %s, w9, %s\n", dst, src, dst)
+}
+
+func (c arm64Target) div(f *GeneratorOutput, reg string, divisor int) {
+	arm64Mov(f, "w9", divisor)
+	if SignedCells {
+		f.Printf("	sdiv %s, %s, w9\n", reg, reg)
+	} else {
+		f.Printf("	udiv %s, %s, w9\n", reg, reg)
+	}
+}
+
+func (c arm64Target) movePointer(f *GeneratorOutput, bytes int) {
+	arm64AddImm(f, "x19", bytes)
+}
+
+func (c arm64Target) branch(f *GeneratorOutput, reg string, zero bool, label string) {
+	if zero {
+		f.Printf("	cbz %s, %s\n", reg, label)
+	} else {
+		f.Printf("	cbnz %s, %s\n", reg, label)
+	}
+}
+
+func (c arm64Target) jump(f *GeneratorOutput, label string) {
+	f.Printf("	b %s\n", label)
+}
+
+func (c arm64Target) call(f *GeneratorOutput, name string) {
+	f.Printf("	bl %s\n", name)
+}
+
+func (c arm64Target) exit(f *GeneratorOutput) {
+	f.Println("	mov x0, #0")
+	f.Println("	mov x8, #93")
+	f.Println("	svc #0")
+}
+
+func (c arm64Target) runtime(f *GeneratorOutput) {
+	// bf_putc adds the byte in w0 to the output buffer, and writes it when it is full
+	f.Print(`bf_putc:
+	adrp x1, bf_outlen
+	add x1, x1, :lo12:bf_outlen
+	ldr x2, [x1]
+	adrp x3, bf_outbuf
+	add x3, x3, :lo12:bf_outbuf
+	strb w0, [x3, x2]
+	add x2, x2, #1
+	str x2, [x1]
+	cmp x2, #4096
+	b.eq bf_flush
+	ret
+
+bf_flush:
+	adrp x3, bf_outlen
+	add x3, x3, :lo12:bf_outlen
+	ldr x2, [x3]
+	cbz x2, 1f
+	mov x0, #1
+	adrp x1, bf_outbuf
+	add x1, x1, :lo12:bf_outbuf
+	mov x8, #64
+	svc #0
+	adrp x3, bf_outlen
+	add x3, x3, :lo12:bf_outlen
+	str xzr, [x3]
+1:
+	ret
+
+`)
+
+	// bf_getc reads a byte into the cell, and leaves it unchanged at the end of the input
+	if EmbeddedInput != nil {
+		f.Println("bf_getc:")
+		c.address(f, "x1", "bf_inpos")
+		f.Println("	ldr x2, [x1]")
+		arm64Mov(f, "x3", len(EmbeddedInput))
+		f.Println("	cmp x2, x3")
+		f.Println("	b.hs 1f")
+		c.address(f, "x4", "bf_input")
+		f.Println("	ldrb w0, [x4, x2]")
+		c.store(f, "w0", 0)
+		f.Println("	add x2, x2, #1")
+		f.Println("	str x2, [x1]")
+		f.Println("1:")
+		f.Println("	ret")
+	} else {
+		// The output is written first, so a prompt is shown before waiting for input
+		f.Println("bf_getc:")
+		f.Println("	stp x29, x30, [sp, #-16]!")
+		f.Println("	bl bf_flush")
+		f.Println("	mov x0, #0")
+		c.address(f, "x1", "bf_inbuf")
+		f.Println("	mov x2, #1")
+		f.Println("	mov x8, #63")
+		f.Println("	svc #0")
+		f.Println("	cmp x0, #1")
+		f.Println("	b.ne 1f")
+		c.address(f, "x1", "bf_inbuf")
+		f.Println("	ldrb w0, [x1]")
+		c.store(f, "w0", 0)
+		f.Println("1:")
+		f.Println("	ldp x29, x30, [sp], #16")
+		f.Println("	ret")
+	}
+}
+
+// PrintARM64 prints the tokens as AArch64 assembly for Linux in GNU as syntax. The pointer
+// is kept in x19, the output is buffered and written with the write syscall, and the input
+// is read one byte at a time with the read syscall.
+func PrintARM64(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memorySize int, wordSize int) {
+	printNative(f, newARM64Target(wordSize), tokens, includeComments, memorySize, wordSize)
+}
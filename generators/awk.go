@@ -0,0 +1,254 @@
+package generators
+
+import (
+	u "bcomp/bfutils"
+	l "bcomp/lexer"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// awkCell returns the cell at offset from the pointer
+func awkCell(offset int) string {
+	switch {
+	case offset == 0:
+		return "m[p]"
+	case offset > 0:
+		return fmt.Sprintf("m[p + %d]", offset)
+	}
+	return fmt.Sprintf("m[p - %d]", -offset)
+}
+
+// awkString escapes the bytes for an awk string, with octal escapes for the bytes that are
+// not printable, as POSIX awk has no hexadecimal escapes
+func awkString(data []byte) string {
+	var b strings.Builder
+	for _, c := range data {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c >= 0x20 && c < 0x7f:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\%03o", c)
+		}
+	}
+	return b.String()
+}
+
+// readbyte gets the bytes of the input from getline, which removes the newline from every line,
+// so it is added back. A last line without a newline can not be told apart from one with it.
+const awkReadByte = `# readbyte returns the next byte of the input, or -1 at the end of it
+function readbyte(    c) {
+	if (inbuf == "") {
+		# The output is written first, so a prompt is shown before waiting for input
+		fflush()
+		if ((getline inbuf) <= 0) {
+			inbuf = ""
+			return -1
+		}
+		inbuf = inbuf "\n"
+	}
+	c = ord[substr(inbuf, 1, 1)]
+	inbuf = substr(inbuf, 2)
+	return c
+}
+`
+
+// With embedded input inbuf has the whole input from the start
+const awkReadEmbeddedByte = `# readbyte returns the next byte of the input, or -1 at the end of it
+function readbyte(    c) {
+	if (inbuf == "") {
+		return -1
+	}
+	c = ord[substr(inbuf, 1, 1)]
+	inbuf = substr(inbuf, 2)
+	return c
+}
+`
+
+// PrintAwk prints the tokens as a POSIX awk program, which runs in BEGIN and so does not read
+// any input files by itself. POSIX awk has no integer types, so every change of a cell is taken
+// modulo the number of cell values. The bytes of the input are looked up in a table made with
+// printf "%c", which needs the C locale in awks that know about UTF-8.
+func PrintAwk(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memorySize int, wordSize int) {
+	switch wordSize {
+	case 8, 16, 32:
+	default:
+		log.Fatalf("Error: Unknown word size %d\n", wordSize)
+	}
+	cells := uint64(1) << wordSize
+
+	hasInput := false
+	for _, t := range tokens {
+		if t.Tok.Tok == l.IN {
+			hasInput = true
+		}
+	}
+
+	f.Println("#!/usr/bin/awk -f")
+	f.Println("# Code generated by bfcompile. DO NOT EDIT.")
+	f.Println("# Run it in the C locale, so every character is a byte: LC_ALL=C awk -f program.awk")
+	f.Println("")
+
+	output := `printf "%c", m[p]`
+	if utf8Mode() {
+		f.Print(utf8OutputAwk)
+		f.Println("")
+		output = "pututf8(m[p])"
+	} else if wordSize > 8 {
+		output = `printf "%c", m[p] % 256`
+	}
+	if hasInput {
+		// Every runtime reads its bytes from the one before it
+		readByte := "readbyte()"
+		if EmbeddedInput != nil {
+			f.Print(awkReadEmbeddedByte)
+		} else {
+			f.Print(awkReadByte)
+		}
+		f.Println("")
+		if textMode() {
+			f.Print(newlineRuntimeAwk())
+			f.Println("")
+			readByte = "getbyte()"
+		}
+		if utf8Mode() {
+			f.Print(withInput(utf8InputAwk, "readbyte()", readByte))
+			f.Println("")
+			readByte = "getutf8()"
+		}
+		f.Printf(`# input reads into the current cell, and leaves it unchanged at the end of the input
+function input(    c) {
+	c = %s
+	if (c >= 0) {
+		m[p] = c %% M
+	}
+}
+
+`, readByte)
+	}
+	if SignedCells {
+		f.Print(`# sdiv divides the unsigned value of a cell as a signed value, truncating toward zero
+function sdiv(a, b) {
+	if (a >= M / 2) {
+		a -= M
+	}
+	a = int(a / b)
+	return a < 0 ? a + M : a
+}
+
+`)
+	}
+
+	f.Println("BEGIN {")
+	f.Printf("	M = %d\n", cells)
+	if hasInput {
+		f.Println("	for (i = 0; i < 256; i++) {")
+		f.Println(`		ord[sprintf("%c", i)] = i`)
+		f.Println("	}")
+		if EmbeddedInput != nil {
+			f.Printf("	inbuf = \"%s\"\n", awkString(EmbeddedInput))
+		}
+	}
+	f.Printf("	for (p = 0; p < %d; p++) {\n", memorySize)
+	f.Println("		m[p] = 0")
+	f.Println("	}")
+	f.Println("	p = 0")
+	for _, segment := range u.TapeSegments(TapeInit) {
+		values := make([]string, len(segment.Data))
+		for i, b := range segment.Data {
+			values[i] = fmt.Sprint(b)
+		}
+		f.Printf("	n = split(\"%s\", init, \" \")\n", strings.Join(values, " "))
+		f.Println("	for (i = 1; i <= n; i++) {")
+		f.Printf("		m[%d + i] = init[i] + 0\n", segment.Offset-1)
+		f.Println("	}")
+	}
+
+	indentLevel := 1
+	for _, t := range tokens {
+		if includeComments {
+			f.Printf("%s# Line %d, Pos %d: %v\n", indent(indentLevel), t.Pos.Line, t.Pos.Column, t.Tok)
+		}
+
+		switch t.Tok.Tok {
+		case l.ADD:
+			f.Printf("%sm[p] = (m[p] + %d) %% M\n", indent(indentLevel), cellValue(t.Extra, wordSize))
+		case l.SUB:
+			// Adding the difference to M keeps the cell from going below zero
+			f.Printf("%sm[p] = (m[p] + %d) %% M\n", indent(indentLevel), cellValue(-t.Extra, wordSize))
+		case l.INCP:
+			f.Printf("%sp += %d\n", indent(indentLevel), t.Extra)
+		case l.DECP:
+			f.Printf("%sp -= %d\n", indent(indentLevel), t.Extra)
+		case l.OUT:
+			if t.Extra == 1 {
+				f.Printf("%s%s\n", indent(indentLevel), output)
+			} else {
+				f.Printf("%sfor (i = 0; i < %d; i++) {\n%s	%s\n%s}\n", indent(indentLevel), t.Extra, indent(indentLevel), output, indent(indentLevel))
+			}
+		case l.IN:
+			if t.Extra == 1 {
+				f.Printf("%sinput()\n", indent(indentLevel))
+			} else {
+				f.Printf("%sfor (i = 0; i < %d; i++) {\n%s	input()\n%s}\n", indent(indentLevel), t.Extra, indent(indentLevel), indent(indentLevel))
+			}
+		case l.JMPF:
+			f.Printf("%swhile (m[p]) {\n", indent(indentLevel))
+			indentLevel++
+		case l.JMPB:
+			indentLevel--
+			f.Printf("%s}\n", indent(indentLevel))
+		case l.MUL:
+			// The product stays exact in a double as long as the factor is small, which it is
+			// for the loops the optimizer replaces
+			cell := awkCell(t.Extra2)
+			switch {
+			case t.Extra == 1:
+				f.Printf("%s%s = (%s + m[p]) %% M\n", indent(indentLevel), cell, cell)
+			case t.Extra == -1:
+				f.Printf("%s%s = (%s + M - m[p]) %% M\n", indent(indentLevel), cell, cell)
+			case t.Extra < 0:
+				f.Printf("%s%s = (%s + M - m[p] * %d %% M) %% M\n", indent(indentLevel), cell, cell, -t.Extra)
+			default:
+				f.Printf("%s%s = (%s + m[p] * %d) %% M\n", indent(indentLevel), cell, cell, t.Extra)
+			}
+		case l.DIV:
+			cell := awkCell(t.Extra2)
+			if SignedCells {
+				f.Printf("%s%s = sdiv(%s, %s)\n", indent(indentLevel), cell, cell, typedCellValue(t.Extra, wordSize))
+			} else {
+				f.Printf("%s%s = int(%s / %d)\n", indent(indentLevel), cell, cell, cellValue(t.Extra, wordSize))
+			}
+		case l.BZ:
+			f.Printf("%sif (m[p]) {\n", indent(indentLevel))
+			indentLevel++
+		case l.LBL:
+			indentLevel--
+			f.Printf("%s}\n", indent(indentLevel))
+		case l.MOV:
+			f.Printf("%s%s = %d\n", indent(indentLevel), awkCell(t.Extra2), cellValue(t.Extra, wordSize))
+		case l.SCANL:
+			f.Printf("%swhile (m[p]) {\n%s	p--\n%s}\n", indent(indentLevel), indent(indentLevel), indent(indentLevel))
+		case l.SCANR:
+			f.Printf("%swhile (m[p]) {\n%s	p++\n%s}\n", indent(indentLevel), indent(indentLevel), indent(indentLevel))
+		case l.PRNT:
+			f.Printf("%swhile (m[p]) {\n%s	%s\n%s	p++\n%s}\n", indent(indentLevel), indent(indentLevel), output, indent(indentLevel), indent(indentLevel))
+		default:
+			log.Fatalf("Error: Unknown token %v\n", t.Tok)
+		}
+	}
+	if indentLevel > 1 {
+		if PrintWarnings {
+			fmt.Fprintf(os.Stderr, "Warning: Unbalanced brackets in code\n")
+		}
+		for indentLevel > 1 {
+			indentLevel--
+			f.Printf("%s}\n", indent(indentLevel))
+		}
+	}
+	f.Println("}")
+}
@@ -7,6 +7,9 @@ import (
 
 // PrintBF prints the tokens as Brainfuck code
 func PrintBF(f *GeneratorOutput, tokens []ParseToken, includeComments bool) {
+	// The tape initialization is done by code in front of the program
+	f.Print(tapeInitBF())
+
 	for _, t := range tokens {
 		if includeComments {
 			f.Printf("\n%d:%d: %v ", t.Pos.Line, t.Pos.Column, t.Tok.TokenName)
@@ -22,15 +22,42 @@ func PrintC(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memor
 	} else {
 		log.Fatalf("Error: Unknown word size %d\n", wordSize)
 	}
+	// The cell is output as its unsigned value, also with signed cells
+	unsignedType := wordType
+	if SignedCells {
+		// int8_t and so on, which makes the division signed
+		wordType = strings.TrimPrefix(wordType, "u")
+	}
 
 	f.Println("#include <stdio.h>")
 	f.Println("#include <stdint.h>")
 	f.Println("#include <string.h>")
 
-	f.Printf("%s mem[%d];\n", wordType, memorySize)
+	f.Printf("%s mem[%d]%s;\n", wordType, memorySize, tapeInitC(wordSize))
+
+	// Every runtime reads its bytes from the one before it
+	readByte := "getchar()"
+	if EmbeddedInput != nil {
+		f.Print(embeddedInputC())
+		readByte = "embedded_getchar()"
+	}
+	if textMode() {
+		f.Print(withInput(newlineRuntimeC(), "getchar()", readByte))
+		readByte = "get_byte()"
+	}
+	if utf8Mode() {
+		f.Print(withInput(utf8RuntimeC, "getchar()", readByte))
+	}
 	f.Println("int main() {")
 	f.Printf("	%s *p = mem;\n", wordType)
 
+	output := "putchar(*p)"
+	input := readByte
+	if utf8Mode() {
+		output = fmt.Sprintf("put_utf8((%s)*p)", unsignedType)
+		input = "get_utf8()"
+	}
+
 	indentLevel := 1
 	for _, t := range tokens {
 		if includeComments {
@@ -64,15 +91,15 @@ func PrintC(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memor
 			}
 		case l.OUT:
 			if t.Extra == 1 {
-				f.Printf("%sputchar(*p);\n", indent(indentLevel))
+				f.Printf("%s%s;\n", indent(indentLevel), output)
 			} else {
-				f.Printf("%sfor (int i = 0; i < %d; i++) {\n%s	putchar(*p);\n%s}\n", indent(indentLevel), t.Extra, indent(indentLevel), indent(indentLevel))
+				f.Printf("%sfor (int i = 0; i < %d; i++) {\n%s	%s;\n%s}\n", indent(indentLevel), t.Extra, indent(indentLevel), output, indent(indentLevel))
 			}
 		case l.IN:
 			if t.Extra == 1 {
-				f.Printf("%s*p = getchar();\n", indent(indentLevel))
+				f.Printf("%s*p = %s;\n", indent(indentLevel), input)
 			} else {
-				f.Printf("%sfor (int i = 0; i < %d; i++) {\n%s	*p = getchar();\n%s}\n", indent(indentLevel), t.Extra, indent(indentLevel), indent(indentLevel))
+				f.Printf("%sfor (int i = 0; i < %d; i++) {\n%s	*p = %s;\n%s}\n", indent(indentLevel), t.Extra, indent(indentLevel), input, indent(indentLevel))
 			}
 		case l.JMPF:
 			f.Printf("%swhile (*p) {\n", indent(indentLevel))
@@ -111,7 +138,9 @@ func PrintC(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memor
 				f.Printf("%sp[%d] = %d;\n", indent(indentLevel), t.Extra2, t.Extra)
 			}
 		case l.PRNT:
-			if wordSize == 8 {
+			if utf8Mode() {
+				f.Printf("%swhile (*p != 0) { %s; p++; }\n", indent(indentLevel), output)
+			} else if wordSize == 8 {
 				f.Printf("%sp += fputs((char *)p, stdout);\n", indent(indentLevel))
 			} else {
 				f.Printf("%swhile (p* != 0) { putchar(*p); p++; }\n", indent(indentLevel))
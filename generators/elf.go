@@ -0,0 +1,232 @@
+package generators
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// The layout of the executable, which is loaded at the usual address of non PIE executables
+const (
+	elfBase              = 0x400000
+	elfPage              = 0x1000
+	elfHeaderSize        = 64
+	elfProgramHeaderSize = 56
+	elfSectionHeaderSize = 64
+	elfSymbolSize        = 24
+)
+
+// The values of the headers that are used
+const (
+	elfTypeExec     = 2
+	elfMachineX86   = 62
+	elfLoad         = 1
+	elfGNUStack     = 0x6474e551
+	elfExecute      = 1
+	elfWrite        = 2
+	elfRead         = 4
+	elfProgbits     = 1
+	elfSymtab       = 2
+	elfStrtab       = 3
+	elfNobits       = 8
+	elfFlagWrite    = 1
+	elfFlagAlloc    = 2
+	elfFlagExecute  = 4
+	elfBindLocal    = 0
+	elfBindGlobal   = 1
+	elfSymbolNoType = 0
+)
+
+// elfBuffer is a byte buffer with the little endian encodings of the headers
+type elfBuffer []byte
+
+func (b *elfBuffer) u8(v int) {
+	*b = append(*b, byte(v))
+}
+
+func (b *elfBuffer) u16(v int) {
+	*b = binary.LittleEndian.AppendUint16(*b, uint16(v))
+}
+
+func (b *elfBuffer) u32(v int) {
+	*b = binary.LittleEndian.AppendUint32(*b, uint32(v))
+}
+
+func (b *elfBuffer) u64(v int) {
+	*b = binary.LittleEndian.AppendUint64(*b, uint64(v))
+}
+
+// pad appends zeros up to an offset
+func (b *elfBuffer) pad(offset int) {
+	for len(*b) < offset {
+		*b = append(*b, 0)
+	}
+}
+
+// elfStrings is a string table, which starts with the empty string
+type elfStrings []byte
+
+func (s *elfStrings) add(name string) int {
+	if len(*s) == 0 {
+		*s = append(*s, 0)
+	}
+	offset := len(*s)
+	*s = append(append(*s, name...), 0)
+	return offset
+}
+
+func alignUp(v int, align int) int {
+	return (v + align - 1) / align * align
+}
+
+// elfSection is a section header, with the contents of the sections that are not loaded
+type elfSection struct {
+	name    int
+	kind    int
+	flags   int
+	addr    int
+	offset  int
+	size    int
+	link    int
+	info    int
+	align   int
+	entsize int
+	data    []byte
+}
+
+// PrintELF prints the tokens as a statically linked x86-64 executable for Linux, so no
+// assembler or linker is needed. The output of the x86-64 generator is assembled and placed
+// in two segments: the code and the input are read only, and the tape and the buffers are in
+// .bss, or in .data with -tape-init. With -c a symbol table with the labels is added.
+func PrintELF(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memorySize int, wordSize int) {
+	asm := NewGeneratorOutputString()
+	PrintX86_64(asm, tokens, false, memorySize, wordSize)
+	a := newX86Assembler()
+	a.assemble(string(asm.GetOutput()))
+	f.Print(string(linkELF(a, includeComments)))
+}
+
+// linkELF places the sections, resolves the symbols and writes the executable
+func linkELF(a *x86Assembler, includeSymbols bool) []byte {
+	text, rodata, data, bss := a.sectionNamed(".text"), a.sectionNamed(".rodata"), a.sectionNamed(".data"), a.sectionNamed(".bss")
+	programHeaders := 3
+
+	// The first segment has the headers, the code and the read only data, and the second one
+	// starts on the next page at the same offset within the page as in the file
+	textOffset := alignUp(elfHeaderSize+programHeaders*elfProgramHeaderSize, 16)
+	rodataOffset := alignUp(textOffset+len(text.data), 16)
+	textEnd := rodataOffset + len(rodata.data)
+	dataOffset := alignUp(textEnd, 16)
+	text.addr = elfBase + textOffset
+	rodata.addr = elfBase + rodataOffset
+	data.addr = alignUp(elfBase+textEnd, elfPage) + dataOffset%elfPage
+	bss.addr = alignUp(data.addr+len(data.data), 16)
+	a.link()
+
+	var names elfStrings
+	sections := []elfSection{
+		{},
+		{name: names.add(".text"), kind: elfProgbits, flags: elfFlagAlloc | elfFlagExecute, addr: text.addr, offset: textOffset, size: len(text.data), align: 16},
+		{name: names.add(".rodata"), kind: elfProgbits, flags: elfFlagAlloc, addr: rodata.addr, offset: rodataOffset, size: len(rodata.data), align: 16},
+		{name: names.add(".data"), kind: elfProgbits, flags: elfFlagAlloc | elfFlagWrite, addr: data.addr, offset: dataOffset, size: len(data.data), align: 16},
+		{name: names.add(".bss"), kind: elfNobits, flags: elfFlagAlloc | elfFlagWrite, addr: bss.addr, offset: dataOffset + len(data.data), size: len(bss.data), align: 16},
+	}
+	if includeSymbols {
+		// The local symbols come first, and the numeric local labels are left out
+		index := map[*x86Section]int{text: 1, rodata: 2, data: 3, bss: 4}
+		var symbols elfBuffer
+		var symbolNames elfStrings
+		symbols.pad(elfSymbolSize)
+		symbol := func(name string, bind int) {
+			s := a.symbols[name]
+			symbols.u32(symbolNames.add(name))
+			symbols.u8(bind<<4 | elfSymbolNoType)
+			symbols.u8(0)
+			symbols.u16(index[s.section])
+			symbols.u64(a.address(name))
+			symbols.u64(0)
+		}
+		for _, name := range a.labels {
+			if name != "_start" && !strings.Contains(name, "#") {
+				symbol(name, elfBindLocal)
+			}
+		}
+		globals := len(symbols) / elfSymbolSize
+		symbol("_start", elfBindGlobal)
+		sections = append(sections,
+			elfSection{name: names.add(".symtab"), kind: elfSymtab, link: len(sections) + 1, info: globals, align: 8, entsize: elfSymbolSize, data: symbols},
+			elfSection{name: names.add(".strtab"), kind: elfStrtab, align: 1, data: symbolNames})
+	}
+	sections = append(sections, elfSection{name: names.add(".shstrtab"), kind: elfStrtab, align: 1})
+	sections[len(sections)-1].data = names
+
+	// The sections that are not loaded follow the data, and then the section headers
+	offset := dataOffset + len(data.data)
+	for i := range sections {
+		if sections[i].data != nil {
+			offset = alignUp(offset, sections[i].align)
+			sections[i].offset = offset
+			sections[i].size = len(sections[i].data)
+			offset += sections[i].size
+		}
+	}
+	sectionHeaders := alignUp(offset, 8)
+
+	var b elfBuffer
+	b = append(b, 0x7f, 'E', 'L', 'F', 2, 1, 1)
+	b.pad(16)
+	b.u16(elfTypeExec)
+	b.u16(elfMachineX86)
+	b.u32(1)
+	b.u64(a.address("_start"))
+	b.u64(elfHeaderSize)
+	b.u64(sectionHeaders)
+	b.u32(0)
+	b.u16(elfHeaderSize)
+	b.u16(elfProgramHeaderSize)
+	b.u16(programHeaders)
+	b.u16(elfSectionHeaderSize)
+	b.u16(len(sections))
+	b.u16(len(sections) - 1)
+
+	segment := func(kind int, flags int, offset int, addr int, fileSize int, memorySize int, align int) {
+		b.u32(kind)
+		b.u32(flags)
+		b.u64(offset)
+		b.u64(addr)
+		b.u64(addr)
+		b.u64(fileSize)
+		b.u64(memorySize)
+		b.u64(align)
+	}
+	segment(elfLoad, elfRead|elfExecute, 0, elfBase, textEnd, textEnd, elfPage)
+	segment(elfLoad, elfRead|elfWrite, dataOffset, data.addr, len(data.data), bss.addr+len(bss.data)-data.addr, elfPage)
+	segment(elfGNUStack, elfRead|elfWrite, 0, 0, 0, 0, 16)
+
+	b.pad(textOffset)
+	b = append(b, text.data...)
+	b.pad(rodataOffset)
+	b = append(b, rodata.data...)
+	b.pad(dataOffset)
+	b = append(b, data.data...)
+	for _, s := range sections {
+		if s.data != nil {
+			b.pad(s.offset)
+			b = append(b, s.data...)
+		}
+	}
+
+	b.pad(sectionHeaders)
+	for _, s := range sections {
+		b.u32(s.name)
+		b.u32(s.kind)
+		b.u64(s.flags)
+		b.u64(s.addr)
+		b.u64(s.offset)
+		b.u64(s.size)
+		b.u32(s.link)
+		b.u32(s.info)
+		b.u64(s.align)
+		b.u64(s.entsize)
+	}
+	return b
+}
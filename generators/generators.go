@@ -1,6 +1,7 @@
 package generators
 
 import (
+	u "bcomp/bfutils"
 	l "bcomp/lexer"
 	"fmt"
 	"os"
@@ -9,6 +10,21 @@ import (
 
 var PrintWarnings = true
 
+// Generate code for signed cells, where DIV is a signed division
+var SignedCells = false
+
+// How the generated code reads and writes cells, like the interpreter's Options.IO
+var IOMode u.IOMode
+
+// Bytes loaded into the tape before the program starts, like the interpreter's Options.TapeInit
+var TapeInit []u.TapeInit
+
+// Input compiled into the generated code, which is read instead of stdin when it is not nil
+var EmbeddedInput []byte
+
+// The package of the generated Go code, which only has a main function in package main
+var GoPackage = "main"
+
 type ParseToken struct {
 	Pos    l.Position
 	Tok    l.Token
@@ -20,6 +36,22 @@ func (t ParseToken) String() string {
 	return fmt.Sprintf("%s (%d, %d)", t.Tok.TokenName, t.Extra, t.Extra2)
 }
 
+// cellValue wraps a constant around to the range of a cell with the given word size,
+// as the optimizer does not know the cell size when it folds constants
+func cellValue(value int, wordSize int) int {
+	return value & (1<<wordSize - 1)
+}
+
+// typedCellValue is a constant of a cell type in Go or Rust with the same bits as value, which
+// is negative for the large values of signed cells
+func typedCellValue(value int, wordSize int) string {
+	v := uint64(value) & (^uint64(0) >> (64 - wordSize))
+	if SignedCells {
+		return fmt.Sprint(int64(v<<(64-wordSize)) >> (64 - wordSize))
+	}
+	return fmt.Sprint(v)
+}
+
 func indent(n int) string {
 	return strings.Repeat("\t", n)
 }
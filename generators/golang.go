@@ -0,0 +1,280 @@
+package generators
+
+import (
+	u "bcomp/bfutils"
+	l "bcomp/lexer"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"strings"
+)
+
+// goCell returns the cell at offset from the token's pointer, after checking that it is on the tape
+func goCell(code *GeneratorOutput, t ParseToken, indentLevel int) string {
+	offset := t.Extra2
+	var address string
+	switch {
+	case offset == 0:
+		return "mem[p]"
+	case offset > 0:
+		address = fmt.Sprintf("p+%d", offset)
+	default:
+		address = fmt.Sprintf("p%d", offset)
+	}
+	goCheckAddress(code, address, indentLevel)
+	return fmt.Sprintf("mem[%s]", address)
+}
+
+// goCheckAddress prints a check that returns an error if the address is off the tape
+func goCheckAddress(code *GeneratorOutput, address string, indentLevel int) {
+	code.Printf("%sif uint(%s) >= uint(len(mem)) {\n%s	return offTape(%s)\n%s}\n", indent(indentLevel), address, indent(indentLevel), address, indent(indentLevel))
+}
+
+// PrintGo prints the tokens as Go code, with a Run function that reads the input from an
+// io.Reader and writes the output to an io.Writer. In package main it also has a main function
+// that runs it with stdin and stdout, and otherwise it can be imported. Moving the pointer off
+// the tape is checked after every move, and returned as an error by Run.
+func PrintGo(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memorySize int, wordSize int) {
+	var wordType string
+	switch wordSize {
+	case 8, 16, 32, 64:
+		wordType = fmt.Sprintf("uint%d", wordSize)
+	default:
+		log.Fatalf("Error: Unknown word size %d\n", wordSize)
+	}
+	// The cell is output as its unsigned value, also with signed cells
+	unsignedType := wordType
+	if SignedCells {
+		// int8 and so on, which makes the division signed
+		wordType = strings.TrimPrefix(wordType, "u")
+	}
+
+	hasInput, hasOutput, movesPointer := false, false, false
+	for _, t := range tokens {
+		switch t.Tok.Tok {
+		case l.IN:
+			hasInput = true
+		case l.OUT:
+			hasOutput = true
+		case l.PRNT:
+			hasOutput, movesPointer = true, true
+		case l.INCP, l.DECP, l.SCANL, l.SCANR:
+			movesPointer = true
+		case l.MUL, l.DIV, l.MOV:
+			// The cells at an offset are checked like the pointer
+			movesPointer = movesPointer || t.Extra2 != 0
+		}
+	}
+
+	imports := []string{"bufio", "io"}
+	if movesPointer || GoPackage == "main" {
+		imports = append(imports, "fmt")
+	}
+	if hasInput && EmbeddedInput != nil {
+		imports = append(imports, "strings")
+	}
+	if utf8Mode() && (hasInput || hasOutput) {
+		imports = append(imports, "unicode/utf8")
+	}
+	if GoPackage == "main" {
+		imports = append(imports, "os")
+	}
+
+	code := NewGeneratorOutputString()
+	code.Println("// Code generated by bfcompile. DO NOT EDIT.")
+	code.Println("")
+	code.Printf("package %s\n", GoPackage)
+	code.Println("")
+	code.Println("import (")
+	for _, name := range imports {
+		code.Printf("	%q\n", name)
+	}
+	code.Println(")")
+	code.Println("")
+	if EmbeddedInput != nil {
+		code.Println("// Run runs the program with the output to w. The input is embedded, so r is not read.")
+	} else {
+		code.Println("// Run runs the program with the input from r and the output to w.")
+	}
+	code.Println("func Run(r io.Reader, w io.Writer) error {")
+	code.Println("	out := bufio.NewWriter(w)")
+	code.Printf("	mem := make([]%s, %d)\n", wordType, memorySize)
+	code.Println("	p := 0")
+	if movesPointer {
+		// The pointer is checked after every move, and not with recover, which would also
+		// catch the panics of w
+		code.Println("	offTape := func(address int) error {")
+		code.Println("		out.Flush()")
+		code.Println(`		return fmt.Errorf("the pointer moved off the tape to %d", address)`)
+		code.Println("	}")
+	}
+	for _, segment := range u.TapeSegments(TapeInit) {
+		values := make([]string, len(segment.Data))
+		for i, b := range segment.Data {
+			values[i] = fmt.Sprint(tapeValue(b, wordSize))
+		}
+		code.Printf("	copy(mem[%d:], []%s{%s})\n", segment.Offset, wordType, strings.Join(values, ", "))
+	}
+
+	if hasInput {
+		if EmbeddedInput != nil {
+			code.Printf("	in := bufio.NewReader(strings.NewReader(%q))\n", string(EmbeddedInput))
+		} else {
+			code.Println("	in := bufio.NewReader(r)")
+		}
+		// Every runtime reads its bytes from the one before it
+		readByte := "in.ReadByte()"
+		if textMode() {
+			code.Print(newlineRuntimeGo())
+			readByte = "getByte()"
+		}
+		if utf8Mode() {
+			code.Print(withInput(utf8InputGo, "in.ReadByte()", readByte))
+			readByte = "getUTF8()"
+		}
+		// The output is written first, so a prompt is shown before waiting for input
+		code.Printf(`	input := func(cell *%s) error {
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		c, err := %s
+		if err == io.EOF {
+			// The cell is left unchanged at the end of the input
+			return nil
+		} else if err != nil {
+			return err
+		}
+		*cell = %s(c)
+		return nil
+	}
+`, wordType, readByte, wordType)
+	}
+	output := "out.WriteByte(byte(mem[p]))"
+	if utf8Mode() && hasOutput {
+		code.Print(utf8OutputGo)
+		output = fmt.Sprintf("putUTF8(uint64(%s(mem[p])))", unsignedType)
+	}
+	if len(tokens) == 0 && len(TapeInit) == 0 {
+		code.Println("	_ = mem")
+	}
+	code.Println("")
+
+	indentLevel := 1
+	for _, t := range tokens {
+		if includeComments {
+			code.Printf("%s// Line %d, Pos %d: %v\n", indent(indentLevel), t.Pos.Line, t.Pos.Column, t.Tok)
+		}
+
+		switch t.Tok.Tok {
+		case l.ADD:
+			if t.Extra == 1 {
+				code.Printf("%smem[p]++\n", indent(indentLevel))
+			} else {
+				code.Printf("%smem[p] += %s\n", indent(indentLevel), typedCellValue(t.Extra, wordSize))
+			}
+		case l.SUB:
+			if t.Extra == 1 {
+				code.Printf("%smem[p]--\n", indent(indentLevel))
+			} else {
+				code.Printf("%smem[p] -= %s\n", indent(indentLevel), typedCellValue(t.Extra, wordSize))
+			}
+		case l.INCP:
+			if t.Extra == 1 {
+				code.Printf("%sp++\n", indent(indentLevel))
+			} else {
+				code.Printf("%sp += %d\n", indent(indentLevel), t.Extra)
+			}
+			goCheckAddress(code, "p", indentLevel)
+		case l.DECP:
+			if t.Extra == 1 {
+				code.Printf("%sp--\n", indent(indentLevel))
+			} else {
+				code.Printf("%sp -= %d\n", indent(indentLevel), t.Extra)
+			}
+			goCheckAddress(code, "p", indentLevel)
+		case l.OUT:
+			if t.Extra == 1 {
+				code.Printf("%s%s\n", indent(indentLevel), output)
+			} else {
+				code.Printf("%sfor i := 0; i < %d; i++ {\n%s	%s\n%s}\n", indent(indentLevel), t.Extra, indent(indentLevel), output, indent(indentLevel))
+			}
+		case l.IN:
+			if t.Extra == 1 {
+				code.Printf("%sif err := input(&mem[p]); err != nil {\n%s	return err\n%s}\n", indent(indentLevel), indent(indentLevel), indent(indentLevel))
+			} else {
+				code.Printf("%sfor i := 0; i < %d; i++ {\n", indent(indentLevel), t.Extra)
+				code.Printf("%s	if err := input(&mem[p]); err != nil {\n%s		return err\n%s	}\n", indent(indentLevel), indent(indentLevel), indent(indentLevel))
+				code.Printf("%s}\n", indent(indentLevel))
+			}
+		case l.JMPF:
+			code.Printf("%sfor mem[p] != 0 {\n", indent(indentLevel))
+			indentLevel++
+		case l.JMPB:
+			indentLevel--
+			code.Printf("%s}\n", indent(indentLevel))
+		case l.MUL:
+			cell := goCell(code, t, indentLevel)
+			if t.Extra == 1 {
+				code.Printf("%s%s += mem[p]\n", indent(indentLevel), cell)
+			} else if t.Extra == -1 {
+				code.Printf("%s%s -= mem[p]\n", indent(indentLevel), cell)
+			} else {
+				code.Printf("%s%s += mem[p] * %s\n", indent(indentLevel), cell, typedCellValue(t.Extra, wordSize))
+			}
+		case l.DIV:
+			cell := goCell(code, t, indentLevel)
+			code.Printf("%s%s /= %s\n", indent(indentLevel), cell, typedCellValue(t.Extra, wordSize))
+		case l.BZ:
+			code.Printf("%sif mem[p] != 0 {\n", indent(indentLevel))
+			indentLevel++
+		case l.LBL:
+			indentLevel--
+			code.Printf("%s}\n", indent(indentLevel))
+		case l.MOV:
+			cell := goCell(code, t, indentLevel)
+			code.Printf("%s%s = %s\n", indent(indentLevel), cell, typedCellValue(t.Extra, wordSize))
+		case l.SCANL, l.SCANR, l.PRNT:
+			code.Printf("%sfor mem[p] != 0 {\n", indent(indentLevel))
+			if t.Tok.Tok == l.PRNT {
+				code.Printf("%s	%s\n", indent(indentLevel), output)
+			}
+			if t.Tok.Tok == l.SCANL {
+				code.Printf("%s	p--\n", indent(indentLevel))
+			} else {
+				code.Printf("%s	p++\n", indent(indentLevel))
+			}
+			goCheckAddress(code, "p", indentLevel+1)
+			code.Printf("%s}\n", indent(indentLevel))
+		default:
+			log.Fatalf("Error: Unknown token %v\n", t.Tok)
+		}
+	}
+	if indentLevel > 1 {
+		if PrintWarnings {
+			fmt.Fprintf(os.Stderr, "Warning: Unbalanced brackets in code\n")
+		}
+		for indentLevel > 1 {
+			indentLevel--
+			code.Printf("%s}\n", indent(indentLevel))
+		}
+	}
+	code.Println("	return out.Flush()")
+	code.Println("}")
+
+	if GoPackage == "main" {
+		code.Println("")
+		code.Println("func main() {")
+		code.Println("	if err := Run(os.Stdin, os.Stdout); err != nil {")
+		code.Println(`		fmt.Fprintln(os.Stderr, "Error:", err)`)
+		code.Println("		os.Exit(1)")
+		code.Println("	}")
+		code.Println("}")
+	}
+
+	formatted, err := format.Source(code.GetOutput())
+	if err != nil {
+		log.Fatalf("Error: Formatting the Go code: %v\n", err)
+	}
+	f.Print(string(formatted))
+}
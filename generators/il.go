@@ -2,6 +2,7 @@ package generators
 
 import (
 	l "bcomp/lexer"
+	"fmt"
 	"log"
 	"math"
 )
@@ -16,19 +17,27 @@ func printILStore(f *GeneratorOutput, wordSize int, to, from string) {
 	}
 }
 
+// ilSign is the letter QBE uses in loads and extensions for signed (s) or unsigned (u) values
+func ilSign() string {
+	if SignedCells {
+		return "s"
+	}
+	return "u"
+}
+
 func printILExt(f *GeneratorOutput, wordSize int, to, from string) {
 	if wordSize == 8 {
-		f.Printf("	%s =w extub %s\n", to, from)
+		f.Printf("	%s =w ext%sb %s\n", to, ilSign(), from)
 	} else if wordSize == 16 {
-		f.Printf("	%s =w extuh %s\n", to, from)
+		f.Printf("	%s =w ext%sh %s\n", to, ilSign(), from)
 	}
 }
 
 func printILLoad(f *GeneratorOutput, wordSize int, to, from string) {
 	if wordSize == 8 {
-		f.Printf("	%s =w loadub %s\n", to, from)
+		f.Printf("	%s =w load%sb %s\n", to, ilSign(), from)
 	} else if wordSize == 16 {
-		f.Printf("	%s =w loaduh %s\n", to, from)
+		f.Printf("	%s =w load%sh %s\n", to, ilSign(), from)
 	} else if wordSize == 32 {
 		f.Printf("	%s =w loadw %s\n", to, from)
 	}
@@ -36,7 +45,18 @@ func printILLoad(f *GeneratorOutput, wordSize int, to, from string) {
 
 // PrintIL prints the tokens as IL code
 func PrintIL(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memorySize int, wordSize int) {
-	f.Printf("data $MEM = { z %d }\n", memorySize)
+	f.Printf("data $MEM = { %s }\n", tapeInitIL(memorySize, wordSize))
+
+	// The call that reads one byte into a buffer. Every runtime reads its bytes from the one before it.
+	readCall := "call $read(w 0, l %s, w 1)"
+	embeddedReadCall := readCall
+	if EmbeddedInput != nil {
+		embeddedReadCall = "call $bf_embedded_read(l %s)"
+	}
+	byteReadCall := embeddedReadCall
+	if textMode() {
+		byteReadCall = "call $bf_read(l %s)"
+	}
 
 	f.Println("export function w $main() {")
 	f.Println("@start")
@@ -67,12 +87,30 @@ func PrintIL(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memo
 
 			printILLoad(f, wordSize, "%v", "%p")
 		case l.OUT:
+			if utf8Mode() {
+				// %v is sign extended with signed cells, but the code point is the unsigned value
+				c := "%v"
+				if wordSize < 32 {
+					c = "%c"
+					f.Printf("	%%c =w and %%v, %d\n", 1<<wordSize-1)
+				}
+				for i := 0; i < t.Extra; i++ {
+					f.Printf("	call $bf_put_utf8(w %s)\n", c)
+				}
+				break
+			}
 			for i := 0; i < t.Extra; i++ {
 				f.Printf("	call $write(w 1, l %%p, w 1)\n")
 			}
 		case l.IN:
 			for i := 0; i < t.Extra; i++ {
-				f.Printf("    call $read(w 0, l %%p, w 1)\n")
+				if utf8Mode() {
+					f.Printf("	call $bf_get_utf8(l %%p)\n")
+				} else if byteReadCall != readCall {
+					f.Printf("	%s\n", fmt.Sprintf(byteReadCall, "%p"))
+				} else {
+					f.Printf("    call $read(w 0, l %%p, w 1)\n")
+				}
 			}
 			// Since they will all be overwritten, we only push the last value back to the memory
 			printILLoad(f, wordSize, "%v", "%p")
@@ -126,7 +164,11 @@ func PrintIL(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memo
 			// p[%d] /= %d;
 			ptr := t.Extra2
 			if ptr == 0 {
-				f.Printf("	%%v =w div %%v, %d\n", t.Extra)
+				if SignedCells {
+					f.Printf("	%%v =w div %%v, %d\n", t.Extra)
+				} else {
+					f.Printf("	%%v =w udiv %%v, %d\n", t.Extra)
+				}
 
 				printILStore(f, wordSize, "%v", "%p")
 				printILExt(f, wordSize, "%v", "%v")
@@ -140,7 +182,7 @@ func PrintIL(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memo
 			f.Printf("@JMP%d\n", t.Extra)
 		case l.MOV:
 			ptr := t.Extra2
-			value := t.Extra
+			value := cellValue(t.Extra, wordSize)
 			if ptr == 0 {
 				f.Printf("	%%v =w copy %d\n", value)
 
@@ -161,4 +203,21 @@ func PrintIL(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memo
 	}
 	f.Println("	ret 0")
 	f.Println("}")
+
+	bufReadCall := fmt.Sprintf(readCall, "%buf")
+	if EmbeddedInput != nil {
+		f.Print("\n" + embeddedInputIL())
+	}
+	if textMode() {
+		f.Print("\n" + withInput(newlineRuntimeIL(), bufReadCall, fmt.Sprintf(embeddedReadCall, "%buf")))
+	}
+
+	if utf8Mode() {
+		// $bf_get_utf8 ends with storing the code point in a cell of the right size
+		f.Print("\n" + withInput(utf8RuntimeIL, bufReadCall, fmt.Sprintf(byteReadCall, "%buf")))
+		printILStore(f, wordSize, "%cp", "%cell")
+		f.Println("@done")
+		f.Println("	ret")
+		f.Println("}")
+	}
 }
@@ -28,9 +28,31 @@ func PrintJS(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memo
 		arrayType = "Uint32Array"
 	}
 
+	// Negative cells are output as the character of their unsigned value
+	outputValue := "v"
+	if SignedCells {
+		arrayType = strings.Replace(arrayType, "Uint", "Int", 1)
+		switch wordSize {
+		case 8:
+			outputValue = "v & 0xff"
+		case 16:
+			outputValue = "v & 0xffff"
+		case 32:
+			outputValue = "v >>> 0"
+		}
+	}
+
+	// The string written for the value v
+	outputString := fmt.Sprintf("String.fromCharCode(%s)", outputValue)
+	inputFunction := "input"
+	if utf8Mode() {
+		outputString = fmt.Sprintf("String.fromCodePoint(codePoint(%s))", outputValue)
+		inputFunction = "inputUTF8"
+	}
+
 	f.Println(`const process = require("process");`)
 	if hasInput {
-		f.Println(`const inputcb = [];
+		f.Print(`const inputcb = [];
 const inputbuf = [];
 
 async function input() {
@@ -44,7 +66,8 @@ async function input() {
 		});
 	});
 }
-
+`)
+		handler := `
 process.stdin.on("data", (data) => {
 	for (let i = 0; i < data.length; i++) {
 		if (inputcb.length > 0) {
@@ -54,11 +77,25 @@ process.stdin.on("data", (data) => {
 			inputbuf.push(data[i]);
 		}
 	}
-});`)
+});
+`
+		if textMode() {
+			handler = newlineRuntimeJS()
+		}
+		if EmbeddedInput != nil {
+			handler = embeddedInputJS(handler)
+		}
+		f.Print(handler)
+		if utf8Mode() {
+			f.Print(utf8InputJS)
+		}
+	}
+	if utf8Mode() {
+		f.Print(utf8RuntimeJS)
 	}
 
 	f.Printf(`async function output(v) {
-	let wrote = process.stdout.write(String.fromCharCode(v));
+	let wrote = process.stdout.write(%s);
 	if (!wrote) {
 		await new Promise((resolve) => {
 			process.stdout.once("drain", resolve);
@@ -70,7 +107,8 @@ process.stdin.on("data", (data) => {
 async function main() {
 	const mem = new %s(%d);
 	let p = 0;
-`, arrayType, memorySize)
+`, outputString, arrayType, memorySize)
+	f.Print(tapeInitJS())
 
 	indentLevel := 1
 	for _, t := range tokens {
@@ -111,9 +149,9 @@ async function main() {
 			}
 		case l.IN:
 			if t.Extra == 1 {
-				f.Printf("%smem[p] = await input();\n", indent(indentLevel))
+				f.Printf("%smem[p] = await %s();\n", indent(indentLevel), inputFunction)
 			} else {
-				f.Printf("%sfor (let i = 0; i < %d; i++) {\n%s	mem[p] = await input();\n%s}\n", indent(indentLevel), t.Extra, indent(indentLevel), indent(indentLevel))
+				f.Printf("%sfor (let i = 0; i < %d; i++) {\n%s	mem[p] = await %s();\n%s}\n", indent(indentLevel), t.Extra, indent(indentLevel), inputFunction, indent(indentLevel))
 			}
 		case l.JMPF:
 			f.Printf("%swhile (mem[p]) {\n", indent(indentLevel))
@@ -168,7 +206,9 @@ async function main() {
 			f.Printf("%s}\n", indent(indentLevel))
 		}
 	}
-	f.Println("	process.stdin.unref();")
+	if EmbeddedInput == nil {
+		f.Println("	process.stdin.unref();")
+	}
 	f.Println("}")
 	f.Println("main()")
 }
@@ -38,8 +38,13 @@ func PrintIR(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memo
 		)
 		g.addDebug("globals", "!{!%s}", g.debugRefPh("l0"))
 		g.addDebug("memtype", "!DICompositeType(tag: DW_TAG_array_type, baseType: !%s, size: %d, elements: !%s)", g.debugRefPh("uinttype"), memorySize*wordSize, g.debugRefPh("elements"))
-		g.addDebug("uinttype", "!DIDerivedType(tag: DW_TAG_typedef, name: \"uint%d\", file: !%d, line: 1, baseType: !%s)", wordSize, g.debugRef("bf_file"), g.debugRefPh("baseuinttype"))
-		g.addDebug("baseuinttype", "!DIBasicType(name: \"unsigned char\", size: %d, encoding: DW_ATE_unsigned_char)", wordSize)
+		if SignedCells {
+			g.addDebug("uinttype", "!DIDerivedType(tag: DW_TAG_typedef, name: \"int%d\", file: !%d, line: 1, baseType: !%s)", wordSize, g.debugRef("bf_file"), g.debugRefPh("baseuinttype"))
+			g.addDebug("baseuinttype", "!DIBasicType(name: \"signed char\", size: %d, encoding: DW_ATE_signed_char)", wordSize)
+		} else {
+			g.addDebug("uinttype", "!DIDerivedType(tag: DW_TAG_typedef, name: \"uint%d\", file: !%d, line: 1, baseType: !%s)", wordSize, g.debugRef("bf_file"), g.debugRefPh("baseuinttype"))
+			g.addDebug("baseuinttype", "!DIBasicType(name: \"unsigned char\", size: %d, encoding: DW_ATE_unsigned_char)", wordSize)
+		}
 		g.addDebug("elements", "!{!%s}", g.debugRefPh("elementscount"))
 		g.addDebug("elementscount", "!DISubrange(count: %d)", memorySize)
 	}
@@ -69,11 +74,28 @@ func PrintIR(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memo
 		g.addDebug("mempointertype", "!DIDerivedType(tag: DW_TAG_pointer_type, baseType: !%s, size: 64)", g.debugRefPh("uinttype"))
 	}
 
+	// The call that reads one byte. Every runtime reads its bytes from the one before it.
+	embeddedRead := "call i32 @getchar()"
+	if EmbeddedInput != nil {
+		embeddedRead = "call i32 @embedded_getchar()"
+	}
+	readByte := embeddedRead
+	if textMode() {
+		readByte = "call i32 @get_byte()"
+	}
+
+	// An initialized tape can not be a common symbol
+	memType, memInit := tapeInitLL(memorySize, wordSize)
+	linkage := "common global"
+	if len(TapeInit) > 0 {
+		linkage = "global"
+	}
+
 	if DebugSymbols {
-		f.Printf("@mem = common global [%d x i%d] zeroinitializer, align 1, !dbg !%d\n\n", memorySize, wordSize, 0)
+		f.Printf("@mem = %s %s %s, align 1, !dbg !%d\n\n", linkage, memType, memInit, 0)
 		f.Printf("define i32 @main() #0 !dbg !%d {\n", g.debugRef("main"))
 	} else {
-		f.Printf("@mem = common global [%d x i%d] zeroinitializer, align 1\n\n", memorySize, wordSize)
+		f.Printf("@mem = %s %s %s, align 1\n\n", linkage, memType, memInit)
 		f.Println("define i32 @main() #0 {")
 	}
 
@@ -155,6 +177,16 @@ func PrintIR(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memo
 				v2 := g.nextv()
 				g.printLoadPtr(p1)
 				g.printLoadValue(v1, p1)
+				if utf8Mode() {
+					// The code point is the unsigned value of the cell, also with signed cells
+					if wordSize == 32 {
+						v2 = v1
+					} else {
+						g.printf("  %%v.%d = zext i%d %%v.%d to i32", v2, wordSize, v1)
+					}
+					g.printf("  call void @put_utf8(i32 %%v.%d)", v2)
+					continue
+				}
 				v2 = g.printExtendValue(v2, v1)
 				g.printf("  %%v.%d = call i32 @putchar(i32 noundef %%v.%d)", g.nextv(), v2)
 			}
@@ -163,7 +195,11 @@ func PrintIR(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memo
 			var v1 int
 			for i := 0; i < t.Extra; i++ {
 				v1 = g.nextv()
-				g.printf("  %%v.%d = call i32 @getchar()", v1)
+				if utf8Mode() {
+					g.printf("  %%v.%d = call i32 @get_utf8()", v1)
+				} else {
+					g.printf("  %%v.%d = %s", v1, readByte)
+				}
 			}
 			v2 := g.nextv()
 			v2 = g.printTruncValue(v2, v1)
@@ -268,7 +304,11 @@ func PrintIR(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memo
 			g.printLoadValue(v1, p1)
 			v2 = g.printExtendValue(v2, v1)
 			// int32_t v3 = v2 / t.Extra
-			g.printf("  %%v.%d = sdiv i32 %%v.%d, %d", v3, v2, t.Extra)
+			if SignedCells {
+				g.printf("  %%v.%d = sdiv i32 %%v.%d, %d", v3, v2, t.Extra)
+			} else {
+				g.printf("  %%v.%d = udiv i32 %%v.%d, %d", v3, v2, t.Extra)
+			}
 			// *p = trunc(v3)
 			v4 = g.printTruncValue(v4, v3)
 			g.printStoreValue(v4, p1)
@@ -294,7 +334,7 @@ func PrintIR(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memo
 			// p[%d] = %d;
 			g.currentLine = g.addLine(t.Pos.Line, t.Pos.Column)
 			ptr := t.Extra2
-			value := t.Extra
+			value := cellValue(t.Extra, wordSize)
 
 			p1 := g.nextv()
 			g.printLoadPtr(p1)
@@ -313,6 +353,16 @@ func PrintIR(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memo
 	g.printf("  ret i32 0")
 	f.Println("}\n")
 
+	if EmbeddedInput != nil {
+		f.Println(embeddedInputLL())
+	}
+	if textMode() {
+		f.Println(withInput(newlineRuntimeLL(), "call i32 @getchar()", embeddedRead))
+	}
+	if utf8Mode() {
+		f.Println(withInput(utf8RuntimeLL, "call i32 @getchar()", readByte))
+	}
+
 	declarationCounter := 1
 
 	if DebugSymbols {
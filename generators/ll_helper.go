@@ -171,6 +171,10 @@ func (g *LLVMGenerator) printExtendValue(v2, v1 int) int {
 	if g.wordSize == 32 {
 		return v1
 	}
+	if SignedCells {
+		g.printf("  %%v.%d = sext i%d %%v.%d to i32", v2, g.wordSize, v1)
+		return v2
+	}
 	g.printf("  %%v.%d = zext i%d %%v.%d to i32", v2, g.wordSize, v1)
 	return v2
 }
@@ -0,0 +1,278 @@
+package generators
+
+import (
+	l "bcomp/lexer"
+	"fmt"
+	"log"
+)
+
+// nativeSyntax has the parts of the GNU as syntax that differ between the architectures
+type nativeSyntax struct {
+	// The line comment
+	comment string
+	// The data directive for a cell
+	directive string
+	// The section type of .note.GNU-stack
+	progbits string
+}
+
+// nativeRegisters has the registers the lowering allocates. The pointer is kept in its
+// register during the whole program, and the values of a token are kept in the temporaries,
+// where the first one is also the argument of bf_putc. The temporaries can be changed by the
+// calls to the runtime.
+type nativeRegisters struct {
+	pointer string
+	temps   []string
+}
+
+// nativeTarget is an architecture the native assembly generators write code for. The tokens
+// are lowered by printNative to these operations, and a target uses its own scratch registers
+// for values that do not fit in an immediate.
+type nativeTarget interface {
+	syntax() nativeSyntax
+	registers() nativeRegisters
+	// start sets up what the target needs at _start, before the pointer is loaded
+	start(f *GeneratorOutput)
+	// address loads the address of a symbol into a register
+	address(f *GeneratorOutput, reg string, symbol string)
+	// load loads the cell at offset from the pointer, extended to the register
+	load(f *GeneratorOutput, reg string, offset int)
+	store(f *GeneratorOutput, reg string, offset int)
+	constant(f *GeneratorOutput, reg string, value int)
+	// arith adds ("add") or subtracts ("sub") a value to a register
+	arith(f *GeneratorOutput, op string, reg string, value int)
+	// mulAdd adds src times factor to dst, and can change src
+	mulAdd(f *GeneratorOutput, dst string, src string, factor int)
+	// div divides a register by divisor, and can change the other temporaries
+	div(f *GeneratorOutput, reg string, divisor int)
+	movePointer(f *GeneratorOutput, bytes int)
+	branch(f *GeneratorOutput, reg string, zero bool, label string)
+	jump(f *GeneratorOutput, label string)
+	call(f *GeneratorOutput, name string)
+	// exit ends the program with status 0
+	exit(f *GeneratorOutput)
+	// runtime prints bf_putc, bf_flush and bf_getc
+	runtime(f *GeneratorOutput)
+}
+
+// nativeCellOperands is implemented by the targets that can use a cell in memory as an operand,
+// which is used instead of loading the cell into a temporary and storing it again
+type nativeCellOperands interface {
+	arithCell(f *GeneratorOutput, op string, offset int, value int)
+	setCell(f *GeneratorOutput, offset int, value int)
+	mulAddCell(f *GeneratorOutput, offset int, src string, factor int)
+	branchCell(f *GeneratorOutput, offset int, zero bool, label string)
+}
+
+// nativeAllocator hands out the temporaries of a target, and is reset after each token
+type nativeAllocator struct {
+	temps []string
+	used  int
+}
+
+func (a *nativeAllocator) alloc() string {
+	if a.used == len(a.temps) {
+		log.Fatalf("Error: Out of registers\n")
+	}
+	a.used++
+	return a.temps[a.used-1]
+}
+
+func (a *nativeAllocator) reset() {
+	a.used = 0
+}
+
+// nativeLowering lowers the operations on cells to the operations of a target
+type nativeLowering struct {
+	f      *GeneratorOutput
+	target nativeTarget
+	cells  nativeCellOperands
+	regs   nativeAllocator
+}
+
+func (n *nativeLowering) arithCell(op string, offset int, value int) {
+	if n.cells != nil {
+		n.cells.arithCell(n.f, op, offset, value)
+		return
+	}
+	r := n.regs.alloc()
+	n.target.load(n.f, r, offset)
+	n.target.arith(n.f, op, r, value)
+	n.target.store(n.f, r, offset)
+}
+
+func (n *nativeLowering) setCell(offset int, value int) {
+	if n.cells != nil {
+		n.cells.setCell(n.f, offset, value)
+		return
+	}
+	r := n.regs.alloc()
+	n.target.constant(n.f, r, value)
+	n.target.store(n.f, r, offset)
+}
+
+// mulAddCell adds the current cell times factor to the cell at offset
+func (n *nativeLowering) mulAddCell(offset int, factor int) {
+	src := n.regs.alloc()
+	n.target.load(n.f, src, 0)
+	if n.cells != nil {
+		n.cells.mulAddCell(n.f, offset, src, factor)
+		return
+	}
+	dst := n.regs.alloc()
+	n.target.load(n.f, dst, offset)
+	n.target.mulAdd(n.f, dst, src, factor)
+	n.target.store(n.f, dst, offset)
+}
+
+func (n *nativeLowering) divCell(offset int, divisor int) {
+	r := n.regs.alloc()
+	n.target.load(n.f, r, offset)
+	n.target.div(n.f, r, divisor)
+	n.target.store(n.f, r, offset)
+}
+
+func (n *nativeLowering) branchCell(zero bool, label string) {
+	if n.cells != nil {
+		n.cells.branchCell(n.f, 0, zero, label)
+		return
+	}
+	r := n.regs.alloc()
+	n.target.load(n.f, r, 0)
+	n.target.branch(n.f, r, zero, label)
+}
+
+func (n *nativeLowering) putc() {
+	n.target.load(n.f, n.regs.alloc(), 0)
+	n.target.call(n.f, "bf_putc")
+}
+
+// printNative prints the tokens as assembly for Linux, which can be linked with ld alone. The
+// output is buffered by bf_putc and written with the write syscall by bf_flush, and bf_getc
+// reads one byte at a time with the read syscall, or from the embedded input.
+func printNative(f *GeneratorOutput, target nativeTarget, tokens []ParseToken, includeComments bool, memorySize int, wordSize int) {
+	syntax := target.syntax()
+	regs := target.registers()
+	bytes := wordSize / 8
+	n := &nativeLowering{f: f, target: target, regs: nativeAllocator{temps: regs.temps}}
+	if cells, ok := target.(nativeCellOperands); ok {
+		n.cells = cells
+	}
+
+	f.Println("	.text")
+	f.Println("	.globl _start")
+	f.Println("_start:")
+	target.start(f)
+	target.address(f, regs.pointer, "mem")
+
+	loops := make([]int, 0)
+	scans := 0
+	for _, t := range tokens {
+		if includeComments {
+			f.Printf("%s Pos %d:%d %s (%s, %d, %d)\n", syntax.comment, t.Pos.Line, t.Pos.Column, t.Tok.Character, t.Tok.TokenName, t.Extra, t.Extra2)
+		}
+
+		n.regs.reset()
+		switch t.Tok.Tok {
+		case l.ADD:
+			n.arithCell("add", 0, cellValue(t.Extra, wordSize))
+		case l.SUB:
+			n.arithCell("sub", 0, cellValue(t.Extra, wordSize))
+		case l.INCP:
+			target.movePointer(f, t.Extra*bytes)
+		case l.DECP:
+			target.movePointer(f, -t.Extra*bytes)
+		case l.OUT:
+			for i := 0; i < t.Extra; i++ {
+				n.regs.reset()
+				n.putc()
+			}
+		case l.IN:
+			for i := 0; i < t.Extra; i++ {
+				target.call(f, "bf_getc")
+			}
+		case l.JMPF:
+			loops = append(loops, t.Extra)
+			n.branchCell(true, fmt.Sprintf(".Lend%d", t.Extra))
+			f.Printf(".Lloop%d:\n", t.Extra)
+		case l.JMPB:
+			if len(loops) == 0 {
+				log.Fatalf("Error: Unbalanced loop at %d:%d\n", t.Pos.Line, t.Pos.Column)
+			}
+			id := loops[len(loops)-1]
+			loops = loops[:len(loops)-1]
+			n.branchCell(false, fmt.Sprintf(".Lloop%d", id))
+			f.Printf(".Lend%d:\n", id)
+		case l.MUL:
+			// p[Extra2] += *p * Extra
+			n.mulAddCell(t.Extra2, t.Extra)
+		case l.DIV:
+			// p[Extra2] /= Extra
+			n.divCell(t.Extra2, t.Extra)
+		case l.BZ:
+			n.branchCell(true, fmt.Sprintf(".Lif%d", t.Extra))
+		case l.LBL:
+			f.Printf(".Lif%d:\n", t.Extra)
+		case l.MOV:
+			n.setCell(t.Extra2, cellValue(t.Extra, wordSize))
+		case l.SCANL, l.SCANR, l.PRNT:
+			// Move until a zero cell, and output the cells on the way with PRNT
+			scans++
+			target.jump(f, fmt.Sprintf(".Lscan%d", scans))
+			f.Printf(".Lscanstep%d:\n", scans)
+			if t.Tok.Tok == l.PRNT {
+				n.putc()
+				n.regs.reset()
+			}
+			if t.Tok.Tok == l.SCANL {
+				target.movePointer(f, -bytes)
+			} else {
+				target.movePointer(f, bytes)
+			}
+			f.Printf(".Lscan%d:\n", scans)
+			n.branchCell(false, fmt.Sprintf(".Lscanstep%d", scans))
+		default:
+			log.Fatalf("Error: Unknown token %v\n", t.Tok)
+		}
+	}
+
+	target.call(f, "bf_flush")
+	target.exit(f)
+	f.Println("")
+
+	// bf_getc leaves the cell unchanged at the end of the input
+	target.runtime(f)
+	if EmbeddedInput != nil {
+		f.Println("")
+		f.Println("	.section .rodata")
+		f.Println("bf_input:")
+		if len(EmbeddedInput) > 0 {
+			f.Printf("	.byte %s\n", byteList(EmbeddedInput, "%d", ", "))
+		}
+	}
+
+	f.Println("")
+	if len(TapeInit) > 0 {
+		f.Println("	.data")
+		f.Println("	.p2align 4")
+		f.Println("mem:")
+		f.Print(tapeInitAsm(memorySize, wordSize, syntax.directive))
+		f.Println("	.bss")
+	} else {
+		f.Println("	.bss")
+		f.Println("	.p2align 4")
+		f.Println("mem:")
+		f.Printf("	.zero %d\n", memorySize*bytes)
+	}
+	f.Println("bf_outbuf:")
+	f.Println("	.zero 4096")
+	f.Println("	.p2align 3")
+	f.Println("bf_outlen:")
+	f.Println("	.zero 8")
+	f.Println("bf_inpos:")
+	f.Println("	.zero 8")
+	f.Println("bf_inbuf:")
+	f.Println("	.zero 1")
+	f.Println("")
+	f.Printf("	.section .note.GNU-stack,\"\",%s\n", syntax.progbits)
+}
@@ -0,0 +1,249 @@
+package generators
+
+import (
+	u "bcomp/bfutils"
+	"strings"
+)
+
+// textMode tells if the line endings of the input are translated, like bfutils.NewlineReader does
+func textMode() bool {
+	return IOMode.Newlines != u.NewlinesBinary
+}
+
+// newlineRuntime picks the code that returns a translated newline from one of the runtimes below
+func newlineRuntime(runtime, lf, crlf string) string {
+	if IOMode.Newlines == u.NewlinesCRLFIn {
+		return strings.Replace(runtime, "$NEWLINE", crlf, 1)
+	}
+	return strings.Replace(runtime, "$NEWLINE", lf, 1)
+}
+
+// get_byte works like getchar, but translates the line endings
+func newlineRuntimeC() string {
+	return newlineRuntime(`static int after_cr = 0;
+static int pending_lf = 0;
+
+static int get_byte(void) {
+	int c;
+	if (pending_lf) {
+		pending_lf = 0;
+		return '\n';
+	}
+	c = getchar();
+	if (c == '\n' && after_cr) {
+		// The LF of a CR LF, which was already translated together with the CR
+		c = getchar();
+	}
+	after_cr = c == '\r';
+	if (c == '\r' || c == '\n') {
+$NEWLINE
+	}
+	return c;
+}
+`, `		return '\n';`, `		pending_lf = 1;
+		return '\r';`)
+}
+
+// The data handler translates the input as it arrives, instead of the one in PrintJS
+func newlineRuntimeJS() string {
+	return newlineRuntime(`let afterCR = false;
+
+function newline(c) {
+	const skip = c == 10 && afterCR;
+	afterCR = c == 13;
+	if (skip) {
+		return [];
+	}
+	if (c == 13 || c == 10) {
+$NEWLINE
+	}
+	return [c];
+}
+
+process.stdin.on("data", (data) => {
+	for (let i = 0; i < data.length; i++) {
+		for (const c of newline(data[i])) {
+			if (inputcb.length > 0) {
+				const cb = inputcb.shift();
+				cb(c);
+			} else {
+				inputbuf.push(c);
+			}
+		}
+	}
+});
+`, `		return [10];`, `		return [13, 10];`)
+}
+
+// getByte works like in.ReadByte, but translates the line endings
+func newlineRuntimeGo() string {
+	return newlineRuntime(`	afterCR, pendingLF := false, false
+	getByte := func() (byte, error) {
+		if pendingLF {
+			pendingLF = false
+			return '\n', nil
+		}
+		c, err := in.ReadByte()
+		if err == nil && c == '\n' && afterCR {
+			// The LF of a CR LF, which was already translated together with the CR
+			c, err = in.ReadByte()
+		}
+		afterCR = err == nil && c == '\r'
+		if err != nil {
+			return 0, err
+		}
+		if c == '\r' || c == '\n' {
+$NEWLINE
+		}
+		return c, nil
+	}
+`, `			return '\n', nil`, `			pendingLF = true
+			return '\r', nil`)
+}
+
+// get_byte works like read_byte, but translates the line endings
+func newlineRuntimeRust() string {
+	return newlineRuntime(`
+	fn get_byte(&mut self) -> io::Result<Option<u8>> {
+		if self.pending_lf {
+			self.pending_lf = false;
+			return Ok(Some(b'\n'));
+		}
+		let mut c = self.read_byte()?;
+		if c == Some(b'\n') && self.after_cr {
+			// The LF of a CR LF, which was already translated together with the CR
+			c = self.read_byte()?;
+		}
+		self.after_cr = c == Some(b'\r');
+		if c == Some(b'\r') || c == Some(b'\n') {
+$NEWLINE
+		}
+		Ok(c)
+	}
+`, `			return Ok(Some(b'\n'));`, `			self.pending_lf = true;
+			return Ok(Some(b'\r'));`)
+}
+
+// get_byte works like read_byte, but translates the line endings
+func newlineRuntimePython() string {
+	return newlineRuntime(`after_cr = False
+pending_lf = False
+
+
+def get_byte():
+    global after_cr, pending_lf
+    if pending_lf:
+        pending_lf = False
+        return 10
+    c = read_byte()
+    if c == 10 and after_cr:
+        # The LF of a CR LF, which was already translated together with the CR
+        c = read_byte()
+    after_cr = c == 13
+    if c == 13 or c == 10:
+$NEWLINE
+    return c
+`, `        return 10`, `        pending_lf = True
+        return 13`)
+}
+
+// getbyte works like readbyte, but translates the line endings
+func newlineRuntimeAwk() string {
+	return newlineRuntime(`function getbyte(    c) {
+	if (pendinglf) {
+		pendinglf = 0
+		return 10
+	}
+	c = readbyte()
+	if (c == 10 && aftercr) {
+		# The LF of a CR LF, which was already translated together with the CR
+		c = readbyte()
+	}
+	aftercr = (c == 13)
+	if (c == 13 || c == 10) {
+$NEWLINE
+	}
+	return c
+}
+`, `		return 10`, `		pendinglf = 1
+		return 13`)
+}
+
+// $bf_read works like read(0, buf, 1), but translates the line endings
+func newlineRuntimeIL() string {
+	return newlineRuntime(`data $bf_after_cr = { w 0 }
+data $bf_pending_lf = { w 0 }
+
+function w $bf_read(l %buf) {
+@start
+	%pending =w loadw $bf_pending_lf
+	jnz %pending, @pending, @read
+@pending
+	storew 0, $bf_pending_lf
+	storeb 10, %buf
+	ret 1
+@read
+	%r =w call $read(w 0, l %buf, w 1)
+	%eof =w cslew %r, 0
+	jnz %eof, @eof, @got
+@eof
+	ret %r
+@got
+	%c =w loadub %buf
+	%after =w loadw $bf_after_cr
+	%iscr =w ceqw %c, 13
+	storew %iscr, $bf_after_cr
+	%islf =w ceqw %c, 10
+	%skip =w and %islf, %after
+	jnz %skip, @read, @check
+@check
+	%nl =w or %iscr, %islf
+	jnz %nl, @newline, @done
+@newline
+$NEWLINE
+@done
+	ret 1
+}
+`, `	storeb 10, %buf`, `	storeb 13, %buf
+	storew 1, $bf_pending_lf`)
+}
+
+// @get_byte works like getchar, but translates the line endings
+func newlineRuntimeLL() string {
+	return newlineRuntime(`@after_cr = internal global i32 0
+@pending_lf = internal global i32 0
+
+define internal i32 @get_byte() {
+entry:
+  %pending = load i32, ptr @pending_lf
+  %haspending = icmp ne i32 %pending, 0
+  br i1 %haspending, label %flush, label %read
+
+flush:
+  store i32 0, ptr @pending_lf
+  ret i32 10
+
+read:
+  %c = call i32 @getchar()
+  %after = load i32, ptr @after_cr
+  %iscr = icmp eq i32 %c, 13
+  %iscr32 = zext i1 %iscr to i32
+  store i32 %iscr32, ptr @after_cr
+  %islf = icmp eq i32 %c, 10
+  %wascr = icmp ne i32 %after, 0
+  %skip = and i1 %islf, %wascr
+  br i1 %skip, label %read, label %check
+
+check:
+  %nl = or i1 %iscr, %islf
+  br i1 %nl, label %newline, label %done
+
+newline:
+$NEWLINE
+
+done:
+  ret i32 %c
+}
+`, `  ret i32 10`, `  store i32 1, ptr @pending_lf
+  ret i32 13`)
+}
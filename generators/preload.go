@@ -0,0 +1,230 @@
+package generators
+
+import (
+	u "bcomp/bfutils"
+	"fmt"
+	"strings"
+)
+
+// withInput returns a runtime that reads its bytes with the call from instead of the call read,
+// which chains the embedded input, the newline translation and the UTF-8 decoding
+func withInput(runtime, read, from string) string {
+	return strings.ReplaceAll(runtime, read, from)
+}
+
+// byteList formats the bytes as a comma separated list, with the given format for each byte
+func byteList(data []byte, format string, separator string) string {
+	values := make([]string, len(data))
+	for i, b := range data {
+		values[i] = fmt.Sprintf(format, b)
+	}
+	return strings.Join(values, separator)
+}
+
+// tapeValue is the value a byte from the tape initialization is stored as. With signed
+// 8 bit cells the bytes above 127 are negative.
+func tapeValue(b byte, wordSize int) int {
+	if SignedCells && wordSize == 8 {
+		return int(int8(b))
+	}
+	return int(b)
+}
+
+// tapeInitC returns the initializer of the memory in C, like { [100] = 72, 105 }
+func tapeInitC(wordSize int) string {
+	segments := u.TapeSegments(TapeInit)
+	if len(segments) == 0 {
+		return ""
+	}
+	parts := make([]string, len(segments))
+	for i, segment := range segments {
+		values := make([]string, len(segment.Data))
+		for j, b := range segment.Data {
+			values[j] = fmt.Sprint(tapeValue(b, wordSize))
+		}
+		parts[i] = fmt.Sprintf("[%d] = %s", segment.Offset, strings.Join(values, ", "))
+	}
+	return fmt.Sprintf(" = { %s }", strings.Join(parts, ", "))
+}
+
+// tapeInitIL returns the contents of the $MEM data definition
+func tapeInitIL(memorySize int, wordSize int) string {
+	letter := map[int]string{8: "b", 16: "h", 32: "w"}[wordSize]
+	parts := make([]string, 0)
+	pos := 0
+	for _, segment := range u.TapeSegments(TapeInit) {
+		if segment.Offset > pos {
+			parts = append(parts, fmt.Sprintf("z %d", (segment.Offset-pos)*wordSize/8))
+		}
+		parts = append(parts, letter+" "+byteList(segment.Data, "%d", " "))
+		pos = segment.Offset + len(segment.Data)
+	}
+	if memorySize > pos {
+		parts = append(parts, fmt.Sprintf("z %d", (memorySize-pos)*wordSize/8))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// tapeInitLL returns the type and the initializer of @mem. With a tape initialization it
+// is a packed struct of zeroed and initialized arrays, which has the same layout as the array.
+func tapeInitLL(memorySize int, wordSize int) (string, string) {
+	segments := u.TapeSegments(TapeInit)
+	if len(segments) == 0 {
+		return fmt.Sprintf("[%d x i%d]", memorySize, wordSize), "zeroinitializer"
+	}
+	types := make([]string, 0)
+	values := make([]string, 0)
+	pos := 0
+	for _, segment := range segments {
+		if segment.Offset > pos {
+			arrayType := fmt.Sprintf("[%d x i%d]", segment.Offset-pos, wordSize)
+			types = append(types, arrayType)
+			values = append(values, arrayType+" zeroinitializer")
+		}
+		arrayType := fmt.Sprintf("[%d x i%d]", len(segment.Data), wordSize)
+		types = append(types, arrayType)
+		values = append(values, fmt.Sprintf("%s [%s]", arrayType, byteList(segment.Data, fmt.Sprintf("i%d %%d", wordSize), ", ")))
+		pos = segment.Offset + len(segment.Data)
+	}
+	if memorySize > pos {
+		arrayType := fmt.Sprintf("[%d x i%d]", memorySize-pos, wordSize)
+		types = append(types, arrayType)
+		values = append(values, arrayType+" zeroinitializer")
+	}
+	return fmt.Sprintf("<{ %s }>", strings.Join(types, ", ")), fmt.Sprintf("<{ %s }>", strings.Join(values, ", "))
+}
+
+// tapeInitAsm returns the assembler directives that define the tape, where directive defines one cell
+func tapeInitAsm(memorySize int, wordSize int, directive string) string {
+	data := ""
+	pos := 0
+	for _, segment := range u.TapeSegments(TapeInit) {
+		if segment.Offset > pos {
+			data += fmt.Sprintf("	.zero %d\n", (segment.Offset-pos)*wordSize/8)
+		}
+		data += fmt.Sprintf("	%s %s\n", directive, byteList(segment.Data, "%d", ", "))
+		pos = segment.Offset + len(segment.Data)
+	}
+	if memorySize > pos {
+		data += fmt.Sprintf("	.zero %d\n", (memorySize-pos)*wordSize/8)
+	}
+	return data
+}
+
+// tapeInitJS returns the statements that load the tape initialization into mem
+func tapeInitJS() string {
+	statements := ""
+	for _, segment := range u.TapeSegments(TapeInit) {
+		statements += fmt.Sprintf("	mem.set([%s], %d);\n", byteList(segment.Data, "%d", ", "), segment.Offset)
+	}
+	return statements
+}
+
+// tapeInitBF returns brainfuck code that sets the initialized cells, and moves back to the first cell
+func tapeInitBF() string {
+	code := ""
+	pos := 0
+	for _, segment := range u.TapeSegments(TapeInit) {
+		code += strings.Repeat(">", segment.Offset-pos)
+		for j, b := range segment.Data {
+			if j > 0 {
+				code += ">"
+			}
+			code += strings.Repeat("+", int(b))
+		}
+		pos = segment.Offset + len(segment.Data) - 1
+	}
+	return code + strings.Repeat("<", pos)
+}
+
+// embeddedData returns the embedded input followed by a 0, so the arrays are never empty
+func embeddedData() []byte {
+	return append(append([]byte{}, EmbeddedInput...), 0)
+}
+
+// embedded_getchar works like getchar, but reads from the embedded input
+func embeddedInputC() string {
+	return fmt.Sprintf(`static const unsigned char embedded_input[] = { %s };
+static const size_t embedded_size = %d;
+static size_t embedded_pos = 0;
+
+static int embedded_getchar(void) {
+	if (embedded_pos < embedded_size) {
+		return embedded_input[embedded_pos++];
+	}
+	return EOF;
+}
+`, byteList(embeddedData(), "%d", ", "), len(EmbeddedInput))
+}
+
+// $bf_embedded_read works like read(0, buf, 1), but reads from the embedded input
+func embeddedInputIL() string {
+	return fmt.Sprintf(`data $bf_input = { b %s }
+data $bf_input_pos = { l 0 }
+
+function w $bf_embedded_read(l %%buf) {
+@start
+	%%pos =l loadl $bf_input_pos
+	%%end =w csgel %%pos, %d
+	jnz %%end, @eof, @read
+@eof
+	ret 0
+@read
+	%%addr =l add $bf_input, %%pos
+	%%c =w loadub %%addr
+	storeb %%c, %%buf
+	%%pos =l add %%pos, 1
+	storel %%pos, $bf_input_pos
+	ret 1
+}
+`, byteList(embeddedData(), "%d", " "), len(EmbeddedInput))
+}
+
+// @embedded_getchar works like getchar, but reads from the embedded input
+func embeddedInputLL() string {
+	return fmt.Sprintf(`@embedded_input = internal constant [%d x i8] [%s]
+@embedded_pos = internal global i64 0
+
+define internal i32 @embedded_getchar() {
+entry:
+  %%pos = load i64, ptr @embedded_pos
+  %%end = icmp sge i64 %%pos, %d
+  br i1 %%end, label %%eof, label %%read
+
+eof:
+  ret i32 -1
+
+read:
+  %%addr = getelementptr inbounds [%d x i8], ptr @embedded_input, i64 0, i64 %%pos
+  %%c = load i8, ptr %%addr
+  %%next = add i64 %%pos, 1
+  store i64 %%next, ptr @embedded_pos
+  %%v = zext i8 %%c to i32
+  ret i32 %%v
+}
+`, len(EmbeddedInput)+1, byteList(embeddedData(), "i8 %d", ", "), len(EmbeddedInput), len(EmbeddedInput)+1)
+}
+
+// The embedded input is passed to the input handler once, instead of stdin
+func embeddedInputJS(handler string) string {
+	return fmt.Sprintf("const embeddedInput = Buffer.from([%s]);\n", byteList(EmbeddedInput, "%d", ", ")) +
+		strings.Replace(handler, `process.stdin.on("data", (data) => {`, `[embeddedInput].forEach((data) => {`, 1)
+}
+
+// escapeBytes escapes the bytes for a byte string literal in Rust or Python, with \x for the
+// bytes that are not printable
+func escapeBytes(data []byte) string {
+	var b strings.Builder
+	for _, c := range data {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c >= 0x20 && c < 0x7f:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,270 @@
+package generators
+
+import (
+	u "bcomp/bfutils"
+	l "bcomp/lexer"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// pyIndent indents Python code with four spaces for each level
+func pyIndent(n int) string {
+	return strings.Repeat("    ", n)
+}
+
+// pyCell returns the cell at offset from the pointer, and the statement that checks that a
+// cell before the pointer is on the tape
+func pyCell(offset int) (string, string) {
+	switch {
+	case offset == 0:
+		return "mem[p]", ""
+	case offset > 0:
+		return fmt.Sprintf("mem[p + %d]", offset), ""
+	}
+	return fmt.Sprintf("mem[p - %d]", -offset), fmt.Sprintf("check_pointer(p - %d)", -offset)
+}
+
+// PrintPython prints the tokens as a Python 3 program. The tape is a bytearray, or an array of
+// unsigned integers for the larger cells, and every change of a cell is masked, so the cells
+// wrap around like in the other generators. With signed cells the cells are still stored as
+// their unsigned value, and only the division uses the signed value.
+func PrintPython(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memorySize int, wordSize int) {
+	// The type code of the array, which is not used for the bytearray of 8 bit cells
+	var typeCode string
+	switch wordSize {
+	case 8:
+	case 16:
+		typeCode = "H"
+	case 32:
+		typeCode = "I"
+	default:
+		log.Fatalf("Error: Unknown word size %d\n", wordSize)
+	}
+
+	hasInput, movesLeft := false, false
+	for _, t := range tokens {
+		switch t.Tok.Tok {
+		case l.IN:
+			hasInput = true
+		case l.DECP, l.SCANL:
+			movesLeft = true
+		case l.MUL, l.DIV, l.MOV:
+			movesLeft = movesLeft || t.Extra2 < 0
+		}
+	}
+
+	f.Println("#!/usr/bin/env python3")
+	f.Println("# Code generated by bfcompile. DO NOT EDIT.")
+	f.Println("")
+	if hasInput && EmbeddedInput != nil {
+		f.Println("import io")
+	}
+	f.Println("import sys")
+	if wordSize > 8 {
+		f.Println("from array import array")
+	}
+	f.Println("")
+	f.Printf("MASK = 0x%X\n", uint64(1)<<wordSize-1)
+	f.Println("")
+	f.Println("out = sys.stdout.buffer")
+	if hasInput {
+		if EmbeddedInput != nil {
+			f.Printf("stdin = io.BytesIO(b\"%s\")\n", escapeBytes(EmbeddedInput))
+		} else {
+			f.Println("stdin = sys.stdin.buffer")
+		}
+	}
+
+	// The functions are separated by two blank lines, like PEP 8 says
+	functions := []string{`def output(value):
+    out.write(bytes((value & 0xFF,)))
+`}
+	if utf8Mode() {
+		functions[0] = utf8OutputPython
+	}
+	if hasInput {
+		functions = append(functions, `def read_byte():
+    b = stdin.read(1)
+    return b[0] if b else -1
+`)
+		// Every runtime reads its bytes from the one before it
+		readByte := "read_byte()"
+		if textMode() {
+			functions = append(functions, newlineRuntimePython())
+			readByte = "get_byte()"
+		}
+		if utf8Mode() {
+			functions = append(functions, withInput(utf8InputPython, "read_byte()", readByte))
+			readByte = "get_utf8()"
+		}
+		functions = append(functions, fmt.Sprintf(`def read_input(cell):
+    # The output is written first, so a prompt is shown before waiting for input
+    out.flush()
+    c = %s
+    # The cell is left unchanged at the end of the input
+    return cell if c == -1 else c & MASK
+`, readByte))
+	}
+	if SignedCells {
+		functions = append(functions, `def signed_div(a, b):
+    # The cells are stored unsigned, and the division truncates toward zero like in C
+    if a > MASK >> 1:
+        a -= MASK + 1
+    q = abs(a) // abs(b)
+    return (-q if (a < 0) != (b < 0) else q) & MASK
+`)
+	}
+	if movesLeft {
+		functions = append(functions, `def check_pointer(p):
+    # Python would use the end of the tape for a negative index
+    if p < 0:
+        raise IndexError("the pointer moved off the tape to %d" % p)
+`)
+	}
+	for _, function := range functions {
+		f.Print("\n\n")
+		f.Print(function)
+	}
+
+	f.Print("\n\n")
+	f.Println("def main():")
+	if wordSize == 8 {
+		f.Printf("    mem = bytearray(%d)\n", memorySize)
+	} else {
+		f.Printf("    mem = array(\"%s\", [0]) * %d\n", typeCode, memorySize)
+	}
+	f.Println("    p = 0")
+	for _, segment := range u.TapeSegments(TapeInit) {
+		values := make([]string, len(segment.Data))
+		for i, b := range segment.Data {
+			values[i] = fmt.Sprint(b)
+		}
+		if wordSize == 8 {
+			f.Printf("    mem[%d:%d] = bytes((%s,))\n", segment.Offset, segment.Offset+len(segment.Data), strings.Join(values, ", "))
+		} else {
+			f.Printf("    mem[%d:%d] = array(\"%s\", [%s])\n", segment.Offset, segment.Offset+len(segment.Data), typeCode, strings.Join(values, ", "))
+		}
+	}
+
+	// Tells for the function body and each open block if it has no statements yet, as a
+	// block without statements needs a pass
+	blocks := []bool{false}
+	statement := func(format string, a ...any) {
+		f.Printf("%s%s\n", pyIndent(len(blocks)), fmt.Sprintf(format, a...))
+		blocks[len(blocks)-1] = false
+	}
+	open := func(format string, a ...any) {
+		statement(format, a...)
+		blocks = append(blocks, true)
+	}
+	closeBlock := func() {
+		if blocks[len(blocks)-1] {
+			statement("pass")
+		}
+		blocks = blocks[:len(blocks)-1]
+	}
+
+	for _, t := range tokens {
+		if includeComments {
+			f.Printf("%s# Line %d, Pos %d: %v\n", pyIndent(len(blocks)), t.Pos.Line, t.Pos.Column, t.Tok)
+		}
+
+		switch t.Tok.Tok {
+		case l.ADD:
+			statement("mem[p] = (mem[p] + %d) & MASK", cellValue(t.Extra, wordSize))
+		case l.SUB:
+			statement("mem[p] = (mem[p] - %d) & MASK", cellValue(t.Extra, wordSize))
+		case l.INCP:
+			statement("p += %d", t.Extra)
+		case l.DECP:
+			statement("p -= %d", t.Extra)
+			statement("check_pointer(p)")
+		case l.OUT:
+			if t.Extra == 1 {
+				statement("output(mem[p])")
+			} else {
+				open("for _ in range(%d):", t.Extra)
+				statement("output(mem[p])")
+				closeBlock()
+			}
+		case l.IN:
+			if t.Extra == 1 {
+				statement("mem[p] = read_input(mem[p])")
+			} else {
+				open("for _ in range(%d):", t.Extra)
+				statement("mem[p] = read_input(mem[p])")
+				closeBlock()
+			}
+		case l.JMPF:
+			open("while mem[p]:")
+		case l.JMPB:
+			closeBlock()
+		case l.MUL:
+			cell, check := pyCell(t.Extra2)
+			if check != "" {
+				statement(check)
+			}
+			switch {
+			case t.Extra == 1:
+				statement("%s = (%s + mem[p]) & MASK", cell, cell)
+			case t.Extra == -1:
+				statement("%s = (%s - mem[p]) & MASK", cell, cell)
+			case t.Extra < 0:
+				statement("%s = (%s - mem[p] * %d) & MASK", cell, cell, -t.Extra)
+			default:
+				statement("%s = (%s + mem[p] * %d) & MASK", cell, cell, t.Extra)
+			}
+		case l.DIV:
+			cell, check := pyCell(t.Extra2)
+			if check != "" {
+				statement(check)
+			}
+			if SignedCells {
+				statement("%s = signed_div(%s, %s)", cell, cell, typedCellValue(t.Extra, wordSize))
+			} else {
+				statement("%s //= %d", cell, cellValue(t.Extra, wordSize))
+			}
+		case l.BZ:
+			open("if mem[p]:")
+		case l.LBL:
+			closeBlock()
+		case l.MOV:
+			cell, check := pyCell(t.Extra2)
+			if check != "" {
+				statement(check)
+			}
+			statement("%s = %d", cell, cellValue(t.Extra, wordSize))
+		case l.SCANL:
+			open("while mem[p]:")
+			statement("p -= 1")
+			statement("check_pointer(p)")
+			closeBlock()
+		case l.SCANR:
+			open("while mem[p]:")
+			statement("p += 1")
+			closeBlock()
+		case l.PRNT:
+			open("while mem[p]:")
+			statement("output(mem[p])")
+			statement("p += 1")
+			closeBlock()
+		default:
+			log.Fatalf("Error: Unknown token %v\n", t.Tok)
+		}
+	}
+	if len(blocks) > 1 {
+		if PrintWarnings {
+			fmt.Fprintf(os.Stderr, "Warning: Unbalanced brackets in code\n")
+		}
+		for len(blocks) > 1 {
+			closeBlock()
+		}
+	}
+	f.Println("    out.flush()")
+	f.Println("")
+	f.Println("")
+	f.Println(`if __name__ == "__main__":`)
+	f.Println("    main()")
+}
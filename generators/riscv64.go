@@ -0,0 +1,225 @@
+package generators
+
+import (
+	"log"
+)
+
+// riscv64Target writes RV64GC assembly for the native generators, with the load and store
+// instructions for a cell size. t2 is the scratch register for the values that do not fit in
+// an immediate.
+type riscv64Target struct {
+	bytes     int
+	ld        string
+	st        string
+	directive string
+}
+
+func newRISCV64Target(wordSize int) riscv64Target {
+	switch wordSize {
+	case 8:
+		if SignedCells {
+			return riscv64Target{1, "lb", "sb", ".byte"}
+		}
+		return riscv64Target{1, "lbu", "sb", ".byte"}
+	case 16:
+		if SignedCells {
+			return riscv64Target{2, "lh", "sh", ".half"}
+		}
+		return riscv64Target{2, "lhu", "sh", ".half"}
+	case 32:
+		if SignedCells {
+			return riscv64Target{4, "lw", "sw", ".word"}
+		}
+		return riscv64Target{4, "lwu", "sw", ".word"}
+	}
+	log.Fatalf("Error: Unknown word size %d\n", wordSize)
+	return riscv64Target{}
+}
+
+// fitsImm12 tells if a value fits in the immediate of addi and the loads and stores
+func fitsImm12(value int) bool {
+	return value >= -2048 && value <= 2047
+}
+
+// access loads or stores the cell at offset from the pointer in s1
+func (c riscv64Target) access(f *GeneratorOutput, op string, reg string, offset int) {
+	bytes := offset * c.bytes
+	if fitsImm12(bytes) {
+		f.Printf("	%s %s, %d(s1)\n", op, reg, bytes)
+		return
+	}
+	f.Printf("	li t2, %d\n", bytes)
+	f.Println("	add t2, s1, t2")
+	f.Printf("	%s %s, 0(t2)\n", op, reg)
+}
+
+func (c riscv64Target) syntax() nativeSyntax {
+	return nativeSyntax{"#", c.directive, "@progbits"}
+}
+
+func (c riscv64Target) registers() nativeRegisters {
+	return nativeRegisters{"s1", []string{"a0", "t0", "t1"}}
+}
+
+// start loads the global pointer, as the linker relaxes la of a symbol near __global_pointer$
+// into an addi from gp. It must not relax the la of gp itself.
+func (c riscv64Target) start(f *GeneratorOutput) {
+	f.Println("	.option push")
+	f.Println("	.option norelax")
+	f.Println("	la gp, __global_pointer$")
+	f.Println("	.option pop")
+}
+
+func (c riscv64Target) address(f *GeneratorOutput, reg string, symbol string) {
+	f.Printf("	la %s, %s\n", reg, symbol)
+}
+
+func (c riscv64Target) load(f *GeneratorOutput, reg string, offset int) {
+	c.access(f, c.ld, reg, offset)
+}
+
+func (c riscv64Target) store(f *GeneratorOutput, reg string, offset int) {
+	c.access(f, c.st, reg, offset)
+}
+
+func (c riscv64Target) constant(f *GeneratorOutput, reg string, value int) {
+	f.Printf("	li %s, %d\n", reg, int32(value))
+}
+
+func (c riscv64Target) arith(f *GeneratorOutput, op string, reg string, value int) {
+	v := int(int32(value))
+	if op == "sub" {
+		v = -v
+	}
+	if fitsImm12(v) {
+		f.Printf("	addi %s, %s, %d\n", reg, reg, v)
+	} else {
+		f.Printf("	li t2, %d\n", v)
+		f.Printf("	add %s, %s, t2\n", reg, reg)
+	}
+}
+
+func (c riscv64Target) mulAdd(f *GeneratorOutput, dst string, src string, factor int) {
+	if factor != 1 {
+		f.Printf("	li t2, %d\n", factor)
+		f.Printf("	mul %s, %s, t2\n", src, src)
+	}
+	f.Printf("	add %s, %s, %s\n", dst, dst, src)
+}
+
+func (c riscv64Target) div(f *GeneratorOutput, reg string, divisor int) {
+	f.Printf("	li t2, %d\n", divisor)
+	if SignedCells {
+		f.Printf("	div %s, %s, t2\n", reg, reg)
+	} else {
+		f.Printf("	divu %s, %s, t2\n", reg, reg)
+	}
+}
+
+func (c riscv64Target) movePointer(f *GeneratorOutput, bytes int) {
+	if fitsImm12(bytes) {
+		f.Printf("	addi s1, s1, %d\n", bytes)
+	} else {
+		f.Printf("	li t2, %d\n", bytes)
+		f.Println("	add s1, s1, t2")
+	}
+}
+
+// branch jumps over a j to the label, since the conditional branches only reach 4 KiB and
+// not every assembler relaxes them
+func (c riscv64Target) branch(f *GeneratorOutput, reg string, zero bool, label string) {
+	if zero {
+		f.Printf("	bnez %s, 1f\n", reg)
+	} else {
+		f.Printf("	beqz %s, 1f\n", reg)
+	}
+	f.Printf("	j %s\n", label)
+	f.Println("1:")
+}
+
+func (c riscv64Target) jump(f *GeneratorOutput, label string) {
+	f.Printf("	j %s\n", label)
+}
+
+func (c riscv64Target) call(f *GeneratorOutput, name string) {
+	f.Printf("	call %s\n", name)
+}
+
+func (c riscv64Target) exit(f *GeneratorOutput) {
+	f.Println("	li a0, 0")
+	f.Println("	li a7, 93")
+	f.Println("	ecall")
+}
+
+func (c riscv64Target) runtime(f *GeneratorOutput) {
+	// bf_putc adds the byte in a0 to the output buffer, and writes it when it is full
+	f.Print(`bf_putc:
+	la t3, bf_outlen
+	ld t4, 0(t3)
+	la t5, bf_outbuf
+	add t5, t5, t4
+	sb a0, 0(t5)
+	addi t4, t4, 1
+	sd t4, 0(t3)
+	li t5, 4096
+	beq t4, t5, bf_flush
+	ret
+
+bf_flush:
+	la t3, bf_outlen
+	ld a2, 0(t3)
+	beqz a2, 1f
+	li a0, 1
+	la a1, bf_outbuf
+	li a7, 64
+	ecall
+	la t3, bf_outlen
+	sd zero, 0(t3)
+1:
+	ret
+
+`)
+
+	// bf_getc reads a byte into the cell, and leaves it unchanged at the end of the input
+	f.Println("bf_getc:")
+	if EmbeddedInput != nil {
+		f.Println("	la t3, bf_inpos")
+		f.Println("	ld t4, 0(t3)")
+		f.Printf("	li t5, %d\n", len(EmbeddedInput))
+		f.Println("	bgeu t4, t5, 1f")
+		f.Println("	la t5, bf_input")
+		f.Println("	add t5, t5, t4")
+		f.Println("	lbu a0, 0(t5)")
+		c.store(f, "a0", 0)
+		f.Println("	addi t4, t4, 1")
+		f.Println("	sd t4, 0(t3)")
+		f.Println("1:")
+		f.Println("	ret")
+	} else {
+		// The output is written first, so a prompt is shown before waiting for input
+		f.Println("	addi sp, sp, -16")
+		f.Println("	sd ra, 8(sp)")
+		f.Println("	call bf_flush")
+		f.Println("	li a0, 0")
+		f.Println("	la a1, bf_inbuf")
+		f.Println("	li a2, 1")
+		f.Println("	li a7, 63")
+		f.Println("	ecall")
+		f.Println("	li t3, 1")
+		f.Println("	bne a0, t3, 1f")
+		f.Println("	la a1, bf_inbuf")
+		f.Println("	lbu a0, 0(a1)")
+		c.store(f, "a0", 0)
+		f.Println("1:")
+		f.Println("	ld ra, 8(sp)")
+		f.Println("	addi sp, sp, 16")
+		f.Println("	ret")
+	}
+}
+
+// PrintRISCV64 prints the tokens as RV64GC assembly for Linux in GNU as syntax. The pointer
+// is kept in s1, the output is buffered and written with the write syscall, and the input
+// is read one byte at a time with the read syscall.
+func PrintRISCV64(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memorySize int, wordSize int) {
+	printNative(f, newRISCV64Target(wordSize), tokens, includeComments, memorySize, wordSize)
+}
@@ -0,0 +1,267 @@
+package generators
+
+import (
+	u "bcomp/bfutils"
+	l "bcomp/lexer"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// rustCell returns the cell at offset from the token's pointer, after checking that it is on the tape.
+// The address wraps around like the pointer, so a cell before the tape is caught by the same check.
+func rustCell(f *GeneratorOutput, t ParseToken, indentLevel int) string {
+	offset := t.Extra2
+	var address string
+	switch {
+	case offset == 0:
+		return "mem[p]"
+	case offset > 0:
+		address = fmt.Sprintf("p.wrapping_add(%d)", offset)
+	default:
+		address = fmt.Sprintf("p.wrapping_sub(%d)", -offset)
+	}
+	f.Printf("%scheck_pointer!(%s, %d, %d);\n", indent(indentLevel), address, t.Pos.Line, t.Pos.Column)
+	return fmt.Sprintf("mem[%s]", address)
+}
+
+// rustInputRuntime is the reader of the input, which gets the methods of the I/O modes
+const rustInputRuntime = `struct Input<R: Read> {
+	reader: R,
+$FIELDS}
+
+impl<R: Read> Input<R> {
+	// read_byte reads a byte, or None at the end of the input
+	fn read_byte(&mut self) -> io::Result<Option<u8>> {
+		let mut buf = [0u8; 1];
+		loop {
+			match self.reader.read(&mut buf) {
+				Ok(0) => return Ok(None),
+				Ok(_) => return Ok(Some(buf[0])),
+				Err(err) if err.kind() == io::ErrorKind::Interrupted => {}
+				Err(err) => return Err(err),
+			}
+		}
+	}
+$METHODS}
+
+`
+
+// PrintRust prints the tokens as a Rust program, which reads stdin and writes a buffered
+// stdout. The cells wrap around with the wrapping_ methods, also in debug builds. Moving the
+// pointer off the tape panics when the tape is indexed, and with the bounds_checks feature it
+// is reported with the position in the brainfuck code.
+func PrintRust(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memorySize int, wordSize int) {
+	var wordType string
+	switch wordSize {
+	case 8, 16, 32, 64:
+		wordType = fmt.Sprintf("u%d", wordSize)
+	default:
+		log.Fatalf("Error: Unknown word size %d\n", wordSize)
+	}
+	// The cell is output as its unsigned value, also with signed cells
+	unsignedType := wordType
+	if SignedCells {
+		// i8 and so on, which makes the division signed
+		wordType = "i" + strings.TrimPrefix(wordType, "u")
+	}
+
+	hasInput, hasOutput, movesPointer := false, false, false
+	for _, t := range tokens {
+		switch t.Tok.Tok {
+		case l.IN:
+			hasInput = true
+		case l.OUT:
+			hasOutput = true
+		case l.PRNT:
+			hasOutput, movesPointer = true, true
+		case l.INCP, l.DECP, l.SCANL, l.SCANR:
+			movesPointer = true
+		case l.MUL, l.DIV, l.MOV:
+			// The cells at an offset are checked like the pointer
+			movesPointer = movesPointer || t.Extra2 != 0
+		}
+	}
+
+	f.Println("// Code generated by bfcompile. DO NOT EDIT.")
+	f.Println("")
+	if movesPointer {
+		// rustc does not know the features of a crate, and cargo only knows a declared one
+		f.Println("#![allow(unexpected_cfgs)]")
+		f.Println("")
+	}
+	if hasInput {
+		f.Println("use std::io::{self, BufWriter, Read, Write};")
+	} else {
+		f.Println("use std::io::{self, BufWriter, Write};")
+	}
+	f.Println("use std::process;")
+	f.Println("")
+	f.Printf("const MEM_SIZE: usize = %d;\n", memorySize)
+	f.Println("")
+	if movesPointer {
+		f.Println("// With the bounds_checks feature the pointer is checked after it is moved, otherwise")
+		f.Println("// moving off the tape panics when the tape is indexed. The feature is enabled with")
+		f.Println("// rustc --cfg 'feature=\"bounds_checks\"', or declared in Cargo.toml")
+		f.Println(`macro_rules! check_pointer {
+	($p:expr, $line:expr, $column:expr) => {
+		if cfg!(feature = "bounds_checks") && $p >= MEM_SIZE {
+			return Err(io::Error::new(
+				io::ErrorKind::Other,
+				format!("the pointer moved off the tape at line {}, column {}", $line, $column),
+			));
+		}
+	};
+}`)
+		f.Println("")
+	}
+
+	// Every runtime reads its bytes from the one before it
+	readByte := "self.read_byte()"
+	input := "input.read_byte()?"
+	if hasInput {
+		fields, methods := "", ""
+		if textMode() {
+			fields = "	after_cr: bool,\n	pending_lf: bool,\n"
+			methods += newlineRuntimeRust()
+			readByte = "self.get_byte()"
+			input = "input.get_byte()?"
+		}
+		if utf8Mode() {
+			methods += withInput(utf8InputRust, "self.read_byte()", readByte)
+			input = "input.get_utf8()?"
+		}
+		runtime := strings.Replace(rustInputRuntime, "$FIELDS", fields, 1)
+		f.Print(strings.Replace(runtime, "$METHODS", methods, 1))
+	}
+	output := "out.write_all(&[mem[p] as u8])?"
+	if utf8Mode() && hasOutput {
+		f.Print(utf8OutputRust)
+		output = fmt.Sprintf("put_utf8(&mut out, mem[p] as %s as u64)?", unsignedType)
+	}
+
+	// p and mem are not changed by every program
+	f.Println("#[allow(unused_mut, unused_variables)]")
+	f.Println("fn run() -> io::Result<()> {")
+	f.Println("	let mut out = BufWriter::new(io::stdout().lock());")
+	f.Printf("	let mut mem: Vec<%s> = vec![0; MEM_SIZE];\n", wordType)
+	f.Println("	let mut p: usize = 0;")
+	for _, segment := range u.TapeSegments(TapeInit) {
+		values := make([]string, len(segment.Data))
+		for i, b := range segment.Data {
+			values[i] = fmt.Sprint(tapeValue(b, wordSize))
+		}
+		f.Printf("	mem[%d..%d].copy_from_slice(&[%s]);\n", segment.Offset, segment.Offset+len(segment.Data), strings.Join(values, ", "))
+	}
+	if hasInput {
+		reader := "io::stdin().lock()"
+		if EmbeddedInput != nil {
+			reader = fmt.Sprintf("&b\"%s\"[..]", escapeBytes(EmbeddedInput))
+		}
+		if textMode() {
+			f.Printf("	let mut input = Input { reader: %s, after_cr: false, pending_lf: false };\n", reader)
+		} else {
+			f.Printf("	let mut input = Input { reader: %s };\n", reader)
+		}
+	}
+	f.Println("")
+
+	indentLevel := 1
+	for _, t := range tokens {
+		if includeComments {
+			f.Printf("%s// Line %d, Pos %d: %v\n", indent(indentLevel), t.Pos.Line, t.Pos.Column, t.Tok)
+		}
+
+		switch t.Tok.Tok {
+		case l.ADD:
+			f.Printf("%smem[p] = mem[p].wrapping_add(%s);\n", indent(indentLevel), typedCellValue(t.Extra, wordSize))
+		case l.SUB:
+			f.Printf("%smem[p] = mem[p].wrapping_sub(%s);\n", indent(indentLevel), typedCellValue(t.Extra, wordSize))
+		case l.INCP:
+			f.Printf("%sp = p.wrapping_add(%d);\n", indent(indentLevel), t.Extra)
+			f.Printf("%scheck_pointer!(p, %d, %d);\n", indent(indentLevel), t.Pos.Line, t.Pos.Column)
+		case l.DECP:
+			f.Printf("%sp = p.wrapping_sub(%d);\n", indent(indentLevel), t.Extra)
+			f.Printf("%scheck_pointer!(p, %d, %d);\n", indent(indentLevel), t.Pos.Line, t.Pos.Column)
+		case l.OUT:
+			if t.Extra == 1 {
+				f.Printf("%s%s;\n", indent(indentLevel), output)
+			} else {
+				f.Printf("%sfor _ in 0..%d {\n%s	%s;\n%s}\n", indent(indentLevel), t.Extra, indent(indentLevel), output, indent(indentLevel))
+			}
+		case l.IN:
+			// The output is written first, so a prompt is shown before waiting for input, and
+			// the cell is left unchanged at the end of the input
+			if t.Extra > 1 {
+				f.Printf("%sfor _ in 0..%d {\n", indent(indentLevel), t.Extra)
+				indentLevel++
+			}
+			f.Printf("%sout.flush()?;\n", indent(indentLevel))
+			f.Printf("%sif let Some(c) = %s {\n%s	mem[p] = c as %s;\n%s}\n", indent(indentLevel), input, indent(indentLevel), wordType, indent(indentLevel))
+			if t.Extra > 1 {
+				indentLevel--
+				f.Printf("%s}\n", indent(indentLevel))
+			}
+		case l.JMPF:
+			f.Printf("%swhile mem[p] != 0 {\n", indent(indentLevel))
+			indentLevel++
+		case l.JMPB:
+			indentLevel--
+			f.Printf("%s}\n", indent(indentLevel))
+		case l.MUL:
+			cell := rustCell(f, t, indentLevel)
+			if t.Extra == 1 {
+				f.Printf("%s%s = %s.wrapping_add(mem[p]);\n", indent(indentLevel), cell, cell)
+			} else if t.Extra == -1 {
+				f.Printf("%s%s = %s.wrapping_sub(mem[p]);\n", indent(indentLevel), cell, cell)
+			} else {
+				f.Printf("%s%s = %s.wrapping_add(mem[p].wrapping_mul(%s));\n", indent(indentLevel), cell, cell, typedCellValue(t.Extra, wordSize))
+			}
+		case l.DIV:
+			cell := rustCell(f, t, indentLevel)
+			f.Printf("%s%s = %s.wrapping_div(%s);\n", indent(indentLevel), cell, cell, typedCellValue(t.Extra, wordSize))
+		case l.BZ:
+			f.Printf("%sif mem[p] != 0 {\n", indent(indentLevel))
+			indentLevel++
+		case l.LBL:
+			indentLevel--
+			f.Printf("%s}\n", indent(indentLevel))
+		case l.MOV:
+			cell := rustCell(f, t, indentLevel)
+			f.Printf("%s%s = %s;\n", indent(indentLevel), cell, typedCellValue(t.Extra, wordSize))
+		case l.SCANL, l.SCANR, l.PRNT:
+			f.Printf("%swhile mem[p] != 0 {\n", indent(indentLevel))
+			if t.Tok.Tok == l.PRNT {
+				f.Printf("%s	%s;\n", indent(indentLevel), output)
+			}
+			if t.Tok.Tok == l.SCANL {
+				f.Printf("%s	p = p.wrapping_sub(1);\n", indent(indentLevel))
+			} else {
+				f.Printf("%s	p = p.wrapping_add(1);\n", indent(indentLevel))
+			}
+			f.Printf("%s	check_pointer!(p, %d, %d);\n", indent(indentLevel), t.Pos.Line, t.Pos.Column)
+			f.Printf("%s}\n", indent(indentLevel))
+		default:
+			log.Fatalf("Error: Unknown token %v\n", t.Tok)
+		}
+	}
+	if indentLevel > 1 {
+		if PrintWarnings {
+			fmt.Fprintf(os.Stderr, "Warning: Unbalanced brackets in code\n")
+		}
+		for indentLevel > 1 {
+			indentLevel--
+			f.Printf("%s}\n", indent(indentLevel))
+		}
+	}
+	f.Println("	out.flush()")
+	f.Println("}")
+	f.Println("")
+	f.Println("fn main() {")
+	f.Println("	if let Err(err) = run() {")
+	f.Println(`		eprintln!("Error: {}", err);`)
+	f.Println("		process::exit(1);")
+	f.Println("	}")
+	f.Println("}")
+}
@@ -0,0 +1,544 @@
+package generators
+
+import (
+	u "bcomp/bfutils"
+)
+
+// utf8Mode tells if cells are written and read as UTF-8 encoded code points
+func utf8Mode() bool {
+	return IOMode.Encoding == u.EncodingUTF8
+}
+
+// The runtime functions below encode and decode UTF-8 exactly like bfutils.EncodeUTF8 and
+// bfutils.ReadUTF8, so the generated programs and the interpreter agree on invalid input.
+
+const utf8RuntimeC = `static void put_utf8(uint64_t c) {
+	if (c > 0x10ffff || (c >= 0xd800 && c <= 0xdfff)) {
+		c = 0xfffd;
+	}
+	if (c < 0x80) {
+		putchar(c);
+	} else if (c < 0x800) {
+		putchar(0xc0 | c >> 6);
+		putchar(0x80 | (c & 0x3f));
+	} else if (c < 0x10000) {
+		putchar(0xe0 | c >> 12);
+		putchar(0x80 | (c >> 6 & 0x3f));
+		putchar(0x80 | (c & 0x3f));
+	} else {
+		putchar(0xf0 | c >> 18);
+		putchar(0x80 | (c >> 12 & 0x3f));
+		putchar(0x80 | (c >> 6 & 0x3f));
+		putchar(0x80 | (c & 0x3f));
+	}
+}
+
+static int32_t get_utf8(void) {
+	int c = getchar();
+	int lead = c;
+	int n;
+	int32_t cp;
+	if (c < 0x80) {
+		// ASCII or EOF
+		return c;
+	} else if (c >= 0xc2 && c <= 0xdf) {
+		cp = c & 0x1f;
+		n = 1;
+	} else if (c >= 0xe0 && c <= 0xef) {
+		cp = c & 0x0f;
+		n = 2;
+	} else if (c >= 0xf0 && c <= 0xf4) {
+		cp = c & 0x07;
+		n = 3;
+	} else {
+		return 0xfffd;
+	}
+	for (; n > 0; n--) {
+		c = getchar();
+		if (c == EOF || (c & 0xc0) != 0x80) {
+			return 0xfffd;
+		}
+		cp = cp << 6 | (c & 0x3f);
+	}
+	if ((lead >= 0xe0 && cp < 0x800) || (lead >= 0xf0 && cp < 0x10000) || (cp >= 0xd800 && cp <= 0xdfff) || cp > 0x10ffff) {
+		return 0xfffd;
+	}
+	return cp;
+}
+`
+
+const utf8RuntimeJS = `function codePoint(v) {
+	if (v > 0x10ffff || (v >= 0xd800 && v <= 0xdfff)) {
+		return 0xfffd;
+	}
+	return v;
+}
+`
+
+const utf8InputJS = `async function inputUTF8() {
+	const lead = await input();
+	let cp, n;
+	if (lead < 0x80) {
+		return lead;
+	} else if (lead >= 0xc2 && lead <= 0xdf) {
+		cp = lead & 0x1f;
+		n = 1;
+	} else if (lead >= 0xe0 && lead <= 0xef) {
+		cp = lead & 0x0f;
+		n = 2;
+	} else if (lead >= 0xf0 && lead <= 0xf4) {
+		cp = lead & 0x07;
+		n = 3;
+	} else {
+		return 0xfffd;
+	}
+	for (; n > 0; n--) {
+		const c = await input();
+		if ((c & 0xc0) != 0x80) {
+			return 0xfffd;
+		}
+		cp = cp << 6 | c & 0x3f;
+	}
+	if ((lead >= 0xe0 && cp < 0x800) || (lead >= 0xf0 && cp < 0x10000) || (cp >= 0xd800 && cp <= 0xdfff) || cp > 0x10ffff) {
+		return 0xfffd;
+	}
+	return cp;
+}
+`
+
+// utf8InputGo reads a code point with getUTF8, which works like in.ReadByte
+const utf8InputGo = `	getUTF8 := func() (rune, error) {
+		lead, err := in.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		var cp rune
+		var n int
+		switch {
+		case lead < 0x80:
+			return rune(lead), nil
+		case lead >= 0xc2 && lead <= 0xdf:
+			cp, n = rune(lead&0x1f), 1
+		case lead >= 0xe0 && lead <= 0xef:
+			cp, n = rune(lead&0x0f), 2
+		case lead >= 0xf0 && lead <= 0xf4:
+			cp, n = rune(lead&0x07), 3
+		default:
+			return utf8.RuneError, nil
+		}
+		for ; n > 0; n-- {
+			c, err := in.ReadByte()
+			if err == io.EOF || (err == nil && c&0xc0 != 0x80) {
+				return utf8.RuneError, nil
+			} else if err != nil {
+				return 0, err
+			}
+			cp = cp<<6 | rune(c&0x3f)
+		}
+		overlong := (lead >= 0xe0 && cp < 0x800) || (lead >= 0xf0 && cp < 0x10000)
+		if overlong || (cp >= 0xd800 && cp <= 0xdfff) || cp > utf8.MaxRune {
+			return utf8.RuneError, nil
+		}
+		return cp, nil
+	}
+`
+
+// utf8OutputGo writes a code point with putUTF8, where WriteRune replaces the surrogates
+const utf8OutputGo = `	putUTF8 := func(c uint64) {
+		if c > utf8.MaxRune {
+			c = utf8.RuneError
+		}
+		out.WriteRune(rune(c))
+	}
+`
+
+// utf8InputRust reads a code point with get_utf8, which works like read_byte
+const utf8InputRust = `
+	fn get_utf8(&mut self) -> io::Result<Option<u32>> {
+		let lead = match self.read_byte()? {
+			Some(c) => c as u32,
+			None => return Ok(None),
+		};
+		let (mut cp, n) = match lead {
+			0x00..=0x7f => return Ok(Some(lead)),
+			0xc2..=0xdf => (lead & 0x1f, 1),
+			0xe0..=0xef => (lead & 0x0f, 2),
+			0xf0..=0xf4 => (lead & 0x07, 3),
+			_ => return Ok(Some(0xfffd)),
+		};
+		for _ in 0..n {
+			match self.read_byte()? {
+				Some(c) if c & 0xc0 == 0x80 => cp = cp << 6 | (c & 0x3f) as u32,
+				_ => return Ok(Some(0xfffd)),
+			}
+		}
+		if (lead >= 0xe0 && cp < 0x800) || (lead >= 0xf0 && cp < 0x10000) || char::from_u32(cp).is_none() {
+			return Ok(Some(0xfffd));
+		}
+		Ok(Some(cp))
+	}
+`
+
+// utf8OutputRust writes a code point, where the surrogates and the values past U+10FFFF
+// are replaced
+const utf8OutputRust = `fn put_utf8(out: &mut impl Write, c: u64) -> io::Result<()> {
+	let c = if c > 0x10ffff { None } else { char::from_u32(c as u32) };
+	let c = c.unwrap_or(char::REPLACEMENT_CHARACTER);
+	out.write_all(c.encode_utf8(&mut [0; 4]).as_bytes())
+}
+
+`
+
+// utf8InputPython reads a code point with get_utf8, which works like read_byte
+const utf8InputPython = `def get_utf8():
+    lead = read_byte()
+    if lead < 0x80:
+        # ASCII or the end of the input
+        return lead
+    elif 0xC2 <= lead <= 0xDF:
+        cp, n = lead & 0x1F, 1
+    elif 0xE0 <= lead <= 0xEF:
+        cp, n = lead & 0x0F, 2
+    elif 0xF0 <= lead <= 0xF4:
+        cp, n = lead & 0x07, 3
+    else:
+        return 0xFFFD
+    for _ in range(n):
+        c = read_byte()
+        if c == -1 or c & 0xC0 != 0x80:
+            return 0xFFFD
+        cp = cp << 6 | c & 0x3F
+    if (lead >= 0xE0 and cp < 0x800) or (lead >= 0xF0 and cp < 0x10000) or 0xD800 <= cp <= 0xDFFF or cp > 0x10FFFF:
+        return 0xFFFD
+    return cp
+`
+
+// utf8OutputPython writes a code point, where the surrogates and the values past U+10FFFF
+// are replaced
+const utf8OutputPython = `def output(value):
+    if 0xD800 <= value <= 0xDFFF or value > 0x10FFFF:
+        value = 0xFFFD
+    out.write(chr(value).encode())
+`
+
+// utf8InputAwk reads a code point with getutf8, which works like readbyte. POSIX awk has no bit
+// operations, so the bits are taken apart with division and modulo.
+const utf8InputAwk = `function getutf8(    lead, c, cp, n) {
+	lead = readbyte()
+	if (lead < 128) {
+		# ASCII or the end of the input
+		return lead
+	} else if (lead >= 194 && lead <= 223) {
+		cp = lead % 32
+		n = 1
+	} else if (lead >= 224 && lead <= 239) {
+		cp = lead % 16
+		n = 2
+	} else if (lead >= 240 && lead <= 244) {
+		cp = lead % 8
+		n = 3
+	} else {
+		return 65533
+	}
+	for (; n > 0; n--) {
+		c = readbyte()
+		if (c < 128 || c > 191) {
+			return 65533
+		}
+		cp = cp * 64 + c % 64
+	}
+	if ((lead >= 224 && cp < 2048) || (lead >= 240 && cp < 65536) || (cp >= 55296 && cp <= 57343) || cp > 1114111) {
+		return 65533
+	}
+	return cp
+}
+`
+
+// utf8OutputAwk writes a code point with printf "%c" for each byte, where the surrogates and the
+// values past U+10FFFF are replaced
+const utf8OutputAwk = `function pututf8(c) {
+	if (c > 1114111 || (c >= 55296 && c <= 57343)) {
+		c = 65533
+	}
+	if (c < 128) {
+		printf "%c", c
+	} else if (c < 2048) {
+		printf "%c%c", 192 + int(c / 64), 128 + c % 64
+	} else if (c < 65536) {
+		printf "%c%c%c", 224 + int(c / 4096), 128 + int(c / 64) % 64, 128 + c % 64
+	} else {
+		printf "%c%c%c%c", 240 + int(c / 262144), 128 + int(c / 4096) % 64, 128 + int(c / 64) % 64, 128 + c % 64
+	}
+}
+`
+
+const utf8RuntimeIL = `function $bf_put_utf8(w %c0) {
+@start
+	%buf =l alloc4 4
+	%c =w copy %c0
+	%big =w cugtw %c, 1114111
+	%s1 =w cugew %c, 55296
+	%s2 =w culew %c, 57343
+	%sur =w and %s1, %s2
+	%bad =w or %big, %sur
+	jnz %bad, @replace, @encode
+@replace
+	%c =w copy 65533
+@encode
+	%l1 =w cultw %c, 128
+	jnz %l1, @one, @check2
+@one
+	storeb %c, %buf
+	%len =w copy 1
+	jmp @write
+@check2
+	%l2 =w cultw %c, 2048
+	jnz %l2, @two, @check3
+@two
+	%b =w shr %c, 6
+	%b =w or %b, 192
+	storeb %b, %buf
+	%len =w copy 2
+	jmp @tail
+@check3
+	%l3 =w cultw %c, 65536
+	jnz %l3, @three, @four
+@three
+	%b =w shr %c, 12
+	%b =w or %b, 224
+	storeb %b, %buf
+	%len =w copy 3
+	jmp @tail
+@four
+	%b =w shr %c, 18
+	%b =w or %b, 240
+	storeb %b, %buf
+	%len =w copy 4
+@tail
+	%i =w sub %len, 1
+	%shift =w copy 0
+@next
+	%b =w shr %c, %shift
+	%b =w and %b, 63
+	%b =w or %b, 128
+	%il =l extuw %i
+	%addr =l add %buf, %il
+	storeb %b, %addr
+	%shift =w add %shift, 6
+	%i =w sub %i, 1
+	jnz %i, @next, @write
+@write
+	%r =w call $write(w 1, l %buf, w %len)
+	ret
+}
+
+function $bf_get_utf8(l %cell) {
+@start
+	%buf =l alloc4 4
+	%r =w call $read(w 0, l %buf, w 1)
+	%eof =w cslew %r, 0
+	jnz %eof, @done, @lead
+@lead
+	%c =w loadub %buf
+	%cp =w copy %c
+	%ascii =w cultw %c, 128
+	jnz %ascii, @store, @lead2
+@lead2
+	%n =w copy 1
+	%cp =w and %c, 31
+	%a =w cugew %c, 194
+	%b =w culew %c, 223
+	%in =w and %a, %b
+	jnz %in, @more, @lead3
+@lead3
+	%n =w copy 2
+	%cp =w and %c, 15
+	%a =w cugew %c, 224
+	%b =w culew %c, 239
+	%in =w and %a, %b
+	jnz %in, @more, @lead4
+@lead4
+	%n =w copy 3
+	%cp =w and %c, 7
+	%a =w cugew %c, 240
+	%b =w culew %c, 244
+	%in =w and %a, %b
+	jnz %in, @more, @bad
+@more
+	%r =w call $read(w 0, l %buf, w 1)
+	%eof =w cslew %r, 0
+	jnz %eof, @bad, @cont
+@cont
+	%b =w loadub %buf
+	%hi =w and %b, 192
+	%ok =w ceqw %hi, 128
+	jnz %ok, @add, @bad
+@add
+	%b =w and %b, 63
+	%cp =w shl %cp, 6
+	%cp =w or %cp, %b
+	%n =w sub %n, 1
+	jnz %n, @more, @check
+@check
+	%a =w cugew %c, 224
+	%b =w cultw %cp, 2048
+	%o3 =w and %a, %b
+	%a =w cugew %c, 240
+	%b =w cultw %cp, 65536
+	%o4 =w and %a, %b
+	%a =w cugew %cp, 55296
+	%b =w culew %cp, 57343
+	%sur =w and %a, %b
+	%big =w cugtw %cp, 1114111
+	%bad =w or %o3, %o4
+	%bad =w or %bad, %sur
+	%bad =w or %bad, %big
+	jnz %bad, @bad, @store
+@bad
+	%cp =w copy 65533
+@store
+`
+
+const utf8RuntimeLL = `define internal void @put_utf8(i32 %c0) {
+entry:
+  %big = icmp ugt i32 %c0, 1114111
+  %s1 = icmp uge i32 %c0, 55296
+  %s2 = icmp ule i32 %c0, 57343
+  %sur = and i1 %s1, %s2
+  %bad = or i1 %big, %sur
+  %c = select i1 %bad, i32 65533, i32 %c0
+  %l1 = icmp ult i32 %c, 128
+  br i1 %l1, label %one, label %check2
+
+one:
+  %r1 = call i32 @putchar(i32 %c)
+  ret void
+
+check2:
+  %l2 = icmp ult i32 %c, 2048
+  br i1 %l2, label %two, label %check3
+
+two:
+  %t1 = lshr i32 %c, 6
+  %t2 = or i32 %t1, 192
+  %r2 = call i32 @putchar(i32 %t2)
+  br label %last
+
+check3:
+  %l3 = icmp ult i32 %c, 65536
+  br i1 %l3, label %three, label %four
+
+three:
+  %h1 = lshr i32 %c, 12
+  %h2 = or i32 %h1, 224
+  %r3 = call i32 @putchar(i32 %h2)
+  br label %middle
+
+four:
+  %f1 = lshr i32 %c, 18
+  %f2 = or i32 %f1, 240
+  %r4 = call i32 @putchar(i32 %f2)
+  %f3 = lshr i32 %c, 12
+  %f4 = and i32 %f3, 63
+  %f5 = or i32 %f4, 128
+  %r5 = call i32 @putchar(i32 %f5)
+  br label %middle
+
+middle:
+  %m1 = lshr i32 %c, 6
+  %m2 = and i32 %m1, 63
+  %m3 = or i32 %m2, 128
+  %r6 = call i32 @putchar(i32 %m3)
+  br label %last
+
+last:
+  %z1 = and i32 %c, 63
+  %z2 = or i32 %z1, 128
+  %r7 = call i32 @putchar(i32 %z2)
+  ret void
+}
+
+define internal i32 @get_utf8() {
+entry:
+  %c = call i32 @getchar()
+  %ascii = icmp slt i32 %c, 128
+  br i1 %ascii, label %done, label %lead2
+
+lead2:
+  %a2 = icmp uge i32 %c, 194
+  %b2 = icmp ule i32 %c, 223
+  %in2 = and i1 %a2, %b2
+  br i1 %in2, label %set2, label %lead3
+
+set2:
+  %cp2 = and i32 %c, 31
+  br label %start
+
+lead3:
+  %a3 = icmp uge i32 %c, 224
+  %b3 = icmp ule i32 %c, 239
+  %in3 = and i1 %a3, %b3
+  br i1 %in3, label %set3, label %lead4
+
+set3:
+  %cp3 = and i32 %c, 15
+  br label %start
+
+lead4:
+  %a4 = icmp uge i32 %c, 240
+  %b4 = icmp ule i32 %c, 244
+  %in4 = and i1 %a4, %b4
+  br i1 %in4, label %set4, label %bad
+
+set4:
+  %cp4 = and i32 %c, 7
+  br label %start
+
+start:
+  %cpinit = phi i32 [ %cp2, %set2 ], [ %cp3, %set3 ], [ %cp4, %set4 ]
+  %ninit = phi i32 [ 1, %set2 ], [ 2, %set3 ], [ 3, %set4 ]
+  br label %loop
+
+loop:
+  %cp = phi i32 [ %cpinit, %start ], [ %cpnext, %next ]
+  %n = phi i32 [ %ninit, %start ], [ %nnext, %next ]
+  %more = icmp sgt i32 %n, 0
+  br i1 %more, label %read, label %check
+
+read:
+  %b = call i32 @getchar()
+  %hi = and i32 %b, 192
+  %cont = icmp eq i32 %hi, 128
+  br i1 %cont, label %next, label %bad
+
+next:
+  %low = and i32 %b, 63
+  %shifted = shl i32 %cp, 6
+  %cpnext = or i32 %shifted, %low
+  %nnext = sub i32 %n, 1
+  br label %loop
+
+check:
+  %e3 = icmp uge i32 %c, 224
+  %lt3 = icmp ult i32 %cp, 2048
+  %o3 = and i1 %e3, %lt3
+  %e4 = icmp uge i32 %c, 240
+  %lt4 = icmp ult i32 %cp, 65536
+  %o4 = and i1 %e4, %lt4
+  %su1 = icmp uge i32 %cp, 55296
+  %su2 = icmp ule i32 %cp, 57343
+  %sur = and i1 %su1, %su2
+  %big = icmp ugt i32 %cp, 1114111
+  %bad1 = or i1 %o3, %o4
+  %bad2 = or i1 %bad1, %sur
+  %bad3 = or i1 %bad2, %big
+  %res = select i1 %bad3, i32 65533, i32 %cp
+  ret i32 %res
+
+done:
+  ret i32 %c
+
+bad:
+  ret i32 65533
+}
+`
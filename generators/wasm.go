@@ -0,0 +1,422 @@
+package generators
+
+import (
+	u "bcomp/bfutils"
+	l "bcomp/lexer"
+	"log"
+)
+
+// The WebAssembly generators share the lowering of the tokens to instructions in a
+// wasmModule, which PrintWAT prints in the text format.
+
+// wasmImmediate is the kind of immediate argument an instruction takes
+type wasmImmediate int
+
+const (
+	immNone wasmImmediate = iota
+	// A block without parameters and results
+	immBlock
+	// The depth of the label to branch to
+	immLabel
+	immFunc
+	immLocal
+	immGlobal
+	// The alignment as a power of two, and the offset
+	immMemory
+	immI32
+)
+
+// wasmOp is an instruction, with its name in the text format and its opcode in the binary format
+type wasmOp struct {
+	name string
+	code byte
+	imm  wasmImmediate
+}
+
+var (
+	wasmBlock     = wasmOp{"block", 0x02, immBlock}
+	wasmLoop      = wasmOp{"loop", 0x03, immBlock}
+	wasmIf        = wasmOp{"if", 0x04, immBlock}
+	wasmEnd       = wasmOp{"end", 0x0b, immNone}
+	wasmBr        = wasmOp{"br", 0x0c, immLabel}
+	wasmBrIf      = wasmOp{"br_if", 0x0d, immLabel}
+	wasmCall      = wasmOp{"call", 0x10, immFunc}
+	wasmDrop      = wasmOp{"drop", 0x1a, immNone}
+	wasmLocalGet  = wasmOp{"local.get", 0x20, immLocal}
+	wasmLocalSet  = wasmOp{"local.set", 0x21, immLocal}
+	wasmGlobalGet = wasmOp{"global.get", 0x23, immGlobal}
+	wasmGlobalSet = wasmOp{"global.set", 0x24, immGlobal}
+	wasmLoad      = wasmOp{"i32.load", 0x28, immMemory}
+	wasmLoad8S    = wasmOp{"i32.load8_s", 0x2c, immMemory}
+	wasmLoad8U    = wasmOp{"i32.load8_u", 0x2d, immMemory}
+	wasmLoad16S   = wasmOp{"i32.load16_s", 0x2e, immMemory}
+	wasmLoad16U   = wasmOp{"i32.load16_u", 0x2f, immMemory}
+	wasmStore     = wasmOp{"i32.store", 0x36, immMemory}
+	wasmStore8    = wasmOp{"i32.store8", 0x3a, immMemory}
+	wasmStore16   = wasmOp{"i32.store16", 0x3b, immMemory}
+	wasmConst     = wasmOp{"i32.const", 0x41, immI32}
+	wasmEqz       = wasmOp{"i32.eqz", 0x45, immNone}
+	wasmGeU       = wasmOp{"i32.ge_u", 0x4f, immNone}
+	wasmAdd       = wasmOp{"i32.add", 0x6a, immNone}
+	wasmSub       = wasmOp{"i32.sub", 0x6b, immNone}
+	wasmMul       = wasmOp{"i32.mul", 0x6c, immNone}
+	wasmDivS      = wasmOp{"i32.div_s", 0x6d, immNone}
+	wasmDivU      = wasmOp{"i32.div_u", 0x6e, immNone}
+)
+
+type wasmInstr struct {
+	op   wasmOp
+	args []int
+	// Set on the first instruction of a token, with the token it was lowered from
+	token *ParseToken
+}
+
+// wasmFunc is a function where all parameters, locals and results are i32
+type wasmFunc struct {
+	name    string
+	export  string
+	params  int
+	results int
+	// Names of the parameters followed by the locals
+	locals []string
+	body   []wasmInstr
+}
+
+type wasmImport struct {
+	module string
+	name   string
+	fn     wasmFunc
+}
+
+// wasmGlobal is a mutable i32
+type wasmGlobal struct {
+	name string
+	init int
+}
+
+type wasmData struct {
+	offset int
+	data   []byte
+}
+
+type wasmModule struct {
+	imports []wasmImport
+	funcs   []*wasmFunc
+	globals []wasmGlobal
+	// Size of the memory in 64 KiB pages
+	pages int
+	data  []wasmData
+}
+
+// wasmLayout has the addresses of the linear memory, where the tape starts at 0 so moving
+// the pointer below it traps. The I/O buffers and the embedded input are after the tape.
+type wasmLayout struct {
+	// The iovec for fd_write and fd_read, which always points to the one byte buffer
+	iovec    int
+	ioBuffer int
+	// The number of bytes written or read
+	ioCount int
+	input   int
+	end     int
+}
+
+func newWasmLayout(tapeBytes int) wasmLayout {
+	iovec := (tapeBytes + 3) &^ 3
+	layout := wasmLayout{iovec: iovec, ioBuffer: iovec + 8, ioCount: iovec + 12, input: iovec + 16}
+	layout.end = layout.input + len(EmbeddedInput)
+	return layout
+}
+
+// funcIndex returns the index of a function by name, where the imported functions come first
+func (m *wasmModule) funcIndex(name string) int {
+	for i, imp := range m.imports {
+		if imp.fn.name == name {
+			return i
+		}
+	}
+	for i, fn := range m.funcs {
+		if fn.name == name {
+			return len(m.imports) + i
+		}
+	}
+	log.Fatalf("Internal error: Unknown WebAssembly function %s\n", name)
+	return -1
+}
+
+// funcName returns the name of a function by index
+func (m *wasmModule) funcName(index int) string {
+	if index < len(m.imports) {
+		return m.imports[index].fn.name
+	}
+	return m.funcs[index-len(m.imports)].name
+}
+
+func (f *wasmFunc) emit(op wasmOp, args ...int) {
+	f.body = append(f.body, wasmInstr{op: op, args: args})
+}
+
+func (f *wasmFunc) local(name string) int {
+	for i, local := range f.locals {
+		if local == name {
+			return i
+		}
+	}
+	log.Fatalf("Internal error: Unknown WebAssembly local %s\n", name)
+	return -1
+}
+
+// wasmCells has the instructions that load and store cells of a word size
+type wasmCells struct {
+	bytes int
+	align int
+	load  wasmOp
+	store wasmOp
+}
+
+func newWasmCells(wordSize int) wasmCells {
+	switch wordSize {
+	case 8:
+		if SignedCells {
+			return wasmCells{1, 0, wasmLoad8S, wasmStore8}
+		}
+		return wasmCells{1, 0, wasmLoad8U, wasmStore8}
+	case 16:
+		if SignedCells {
+			return wasmCells{2, 1, wasmLoad16S, wasmStore16}
+		}
+		return wasmCells{2, 1, wasmLoad16U, wasmStore16}
+	case 32:
+		return wasmCells{4, 2, wasmLoad, wasmStore}
+	}
+	log.Fatalf("Error: Unknown word size %d\n", wordSize)
+	return wasmCells{}
+}
+
+// address pushes the address of the cell at offset from the pointer, and returns the
+// offset the load or store should use. Negative offsets can not be a memory offset,
+// so they are subtracted from the pointer.
+func (c wasmCells) address(f *wasmFunc, offset int) int {
+	f.emit(wasmLocalGet, f.local("p"))
+	if offset < 0 {
+		f.emit(wasmConst, -offset*c.bytes)
+		f.emit(wasmSub)
+		return 0
+	}
+	return offset * c.bytes
+}
+
+// loadCell pushes the value of the cell at offset from the pointer
+func (c wasmCells) loadCell(f *wasmFunc, offset int) {
+	memOffset := c.address(f, offset)
+	f.emit(c.load, c.align, memOffset)
+}
+
+// updateCell replaces the cell at offset from the pointer with the result of the
+// instructions update adds to its value
+func (c wasmCells) updateCell(f *wasmFunc, offset int, update func()) {
+	memOffset := c.address(f, offset)
+	if offset < 0 {
+		f.emit(wasmLocalSet, f.local("a"))
+		f.emit(wasmLocalGet, f.local("a"))
+		f.emit(wasmLocalGet, f.local("a"))
+	} else {
+		f.emit(wasmLocalGet, f.local("p"))
+	}
+	f.emit(c.load, c.align, memOffset)
+	update()
+	f.emit(c.store, c.align, memOffset)
+}
+
+// movePointer adds delta cells to the pointer
+func (c wasmCells) movePointer(f *wasmFunc, delta int) {
+	f.emit(wasmLocalGet, f.local("p"))
+	if delta < 0 {
+		f.emit(wasmConst, -delta*c.bytes)
+		f.emit(wasmSub)
+	} else {
+		f.emit(wasmConst, delta*c.bytes)
+		f.emit(wasmAdd)
+	}
+	f.emit(wasmLocalSet, f.local("p"))
+}
+
+// buildWasmModule lowers the tokens to a module for WASI, which exports the memory and a _start
+// function. The output is written one byte at a time with fd_write, and the input is read one
+// byte at a time with fd_read, where the cell is left unchanged at the end of the input.
+func buildWasmModule(tokens []ParseToken, memorySize int, wordSize int) *wasmModule {
+	cells := newWasmCells(wordSize)
+	m := &wasmModule{}
+
+	m.imports = append(m.imports, wasmImport{"wasi_snapshot_preview1", "fd_write", wasmFunc{name: "fd_write", params: 4, results: 1}})
+	if EmbeddedInput == nil {
+		m.imports = append(m.imports, wasmImport{"wasi_snapshot_preview1", "fd_read", wasmFunc{name: "fd_read", params: 4, results: 1}})
+	}
+
+	layout := newWasmLayout(memorySize * cells.bytes)
+	m.pages = max(1, (layout.end+65535)/65536)
+	for _, segment := range u.TapeSegments(TapeInit) {
+		data := make([]byte, len(segment.Data)*cells.bytes)
+		for i, b := range segment.Data {
+			data[i*cells.bytes] = b
+		}
+		m.data = append(m.data, wasmData{segment.Offset * cells.bytes, data})
+	}
+	m.data = append(m.data, wasmData{layout.iovec, []byte{byte(layout.ioBuffer), byte(layout.ioBuffer >> 8), byte(layout.ioBuffer >> 16), byte(layout.ioBuffer >> 24), 1, 0, 0, 0}})
+	if len(EmbeddedInput) > 0 {
+		m.data = append(m.data, wasmData{layout.input, EmbeddedInput})
+	}
+
+	putc := &wasmFunc{name: "putc", params: 1, locals: []string{"c"}}
+	putc.emit(wasmConst, layout.ioBuffer)
+	putc.emit(wasmLocalGet, putc.local("c"))
+	putc.emit(wasmStore8, 0, 0)
+	putc.emit(wasmConst, 1)
+	putc.emit(wasmConst, layout.iovec)
+	putc.emit(wasmConst, 1)
+	putc.emit(wasmConst, layout.ioCount)
+	m.funcs = append(m.funcs, putc)
+	putc.emit(wasmCall, m.funcIndex("fd_write"))
+	putc.emit(wasmDrop)
+	putc.emit(wasmEnd)
+
+	// getc stores the next byte of the input in the cell at addr, if there is one
+	getc := &wasmFunc{name: "getc", params: 1, locals: []string{"addr"}}
+	m.funcs = append(m.funcs, getc)
+	if EmbeddedInput != nil {
+		m.globals = append(m.globals, wasmGlobal{"inpos", 0})
+		getc.emit(wasmGlobalGet, 0)
+		getc.emit(wasmConst, len(EmbeddedInput))
+		getc.emit(wasmGeU)
+		getc.emit(wasmBrIf, 0)
+		getc.emit(wasmLocalGet, getc.local("addr"))
+		getc.emit(wasmGlobalGet, 0)
+		getc.emit(wasmLoad8U, 0, layout.input)
+		getc.emit(cells.store, cells.align, 0)
+		getc.emit(wasmGlobalGet, 0)
+		getc.emit(wasmConst, 1)
+		getc.emit(wasmAdd)
+		getc.emit(wasmGlobalSet, 0)
+	} else {
+		getc.emit(wasmConst, layout.ioCount)
+		getc.emit(wasmConst, 0)
+		getc.emit(wasmStore, 2, 0)
+		getc.emit(wasmConst, 0)
+		getc.emit(wasmConst, layout.iovec)
+		getc.emit(wasmConst, 1)
+		getc.emit(wasmConst, layout.ioCount)
+		getc.emit(wasmCall, m.funcIndex("fd_read"))
+		getc.emit(wasmDrop)
+		getc.emit(wasmConst, layout.ioCount)
+		getc.emit(wasmLoad, 2, 0)
+		getc.emit(wasmEqz)
+		getc.emit(wasmBrIf, 0)
+		getc.emit(wasmLocalGet, getc.local("addr"))
+		getc.emit(wasmConst, layout.ioBuffer)
+		getc.emit(wasmLoad8U, 0, 0)
+		getc.emit(cells.store, cells.align, 0)
+	}
+	getc.emit(wasmEnd)
+
+	f := &wasmFunc{name: "main", export: "_start", locals: []string{"p", "a"}}
+	m.funcs = append(m.funcs, f)
+
+	divide := wasmDivU
+	if SignedCells {
+		divide = wasmDivS
+	}
+
+	for i := range tokens {
+		t := &tokens[i]
+		first := len(f.body)
+
+		switch t.Tok.Tok {
+		case l.ADD:
+			cells.updateCell(f, 0, func() {
+				f.emit(wasmConst, t.Extra)
+				f.emit(wasmAdd)
+			})
+		case l.SUB:
+			cells.updateCell(f, 0, func() {
+				f.emit(wasmConst, t.Extra)
+				f.emit(wasmSub)
+			})
+		case l.INCP:
+			cells.movePointer(f, t.Extra)
+		case l.DECP:
+			cells.movePointer(f, -t.Extra)
+		case l.OUT:
+			for j := 0; j < t.Extra; j++ {
+				cells.loadCell(f, 0)
+				f.emit(wasmCall, m.funcIndex("putc"))
+			}
+		case l.IN:
+			for j := 0; j < t.Extra; j++ {
+				f.emit(wasmLocalGet, f.local("p"))
+				f.emit(wasmCall, m.funcIndex("getc"))
+			}
+		case l.JMPF:
+			// Skip the loop if the cell is zero, and repeat it while it is not
+			f.emit(wasmBlock)
+			cells.loadCell(f, 0)
+			f.emit(wasmEqz)
+			f.emit(wasmBrIf, 0)
+			f.emit(wasmLoop)
+		case l.JMPB:
+			cells.loadCell(f, 0)
+			f.emit(wasmBrIf, 0)
+			f.emit(wasmEnd)
+			f.emit(wasmEnd)
+		case l.MUL:
+			// p[Extra2] += *p * Extra
+			cells.updateCell(f, t.Extra2, func() {
+				cells.loadCell(f, 0)
+				f.emit(wasmConst, t.Extra)
+				f.emit(wasmMul)
+				f.emit(wasmAdd)
+			})
+		case l.DIV:
+			// p[Extra2] /= Extra
+			cells.updateCell(f, t.Extra2, func() {
+				f.emit(wasmConst, t.Extra)
+				f.emit(divide)
+			})
+		case l.BZ:
+			cells.loadCell(f, 0)
+			f.emit(wasmIf)
+		case l.LBL:
+			f.emit(wasmEnd)
+		case l.MOV:
+			memOffset := cells.address(f, t.Extra2)
+			f.emit(wasmConst, cellValue(t.Extra, wordSize))
+			f.emit(cells.store, cells.align, memOffset)
+		case l.SCANL, l.SCANR, l.PRNT:
+			// Move until a zero cell, and output the cells on the way with PRNT
+			f.emit(wasmBlock)
+			f.emit(wasmLoop)
+			cells.loadCell(f, 0)
+			f.emit(wasmEqz)
+			f.emit(wasmBrIf, 1)
+			if t.Tok.Tok == l.PRNT {
+				cells.loadCell(f, 0)
+				f.emit(wasmCall, m.funcIndex("putc"))
+			}
+			if t.Tok.Tok == l.SCANL {
+				cells.movePointer(f, -1)
+			} else {
+				cells.movePointer(f, 1)
+			}
+			f.emit(wasmBr, 0)
+			f.emit(wasmEnd)
+			f.emit(wasmEnd)
+		default:
+			log.Fatalf("Error: Unknown token %v\n", t.Tok)
+		}
+
+		if len(f.body) > first {
+			f.body[first].token = t
+		}
+	}
+	f.emit(wasmEnd)
+
+	return m
+}
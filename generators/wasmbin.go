@@ -0,0 +1,305 @@
+package generators
+
+// PrintWASM prints the tokens as a WebAssembly module in the binary format, for WASI runtimes.
+// With comments it adds a name section, and a bf.positions section with the source position
+// of the first instruction of every token.
+func PrintWASM(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memorySize int, wordSize int) {
+	m := buildWasmModule(tokens, memorySize, wordSize)
+	f.Print(string(encodeWasmModule(m, includeComments)))
+}
+
+// The sections of the binary format, in the order they must appear
+const (
+	wasmSectionCustom   = 0
+	wasmSectionType     = 1
+	wasmSectionImport   = 2
+	wasmSectionFunction = 3
+	wasmSectionMemory   = 5
+	wasmSectionGlobal   = 6
+	wasmSectionExport   = 7
+	wasmSectionCode     = 10
+	wasmSectionData     = 11
+)
+
+const (
+	wasmTypeI32  = 0x7f
+	wasmTypeFunc = 0x60
+	// The type of a block without parameters and results
+	wasmBlockEmpty = 0x40
+	wasmKindFunc   = 0x00
+	wasmKindMemory = 0x02
+)
+
+// wasmBuffer is a byte buffer with the encodings of the binary format
+type wasmBuffer []byte
+
+func (b *wasmBuffer) byte(v byte) {
+	*b = append(*b, v)
+}
+
+// u32 appends an unsigned LEB128 number
+func (b *wasmBuffer) u32(v uint32) {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			c |= 0x80
+		}
+		b.byte(c)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+// i32 appends a signed LEB128 number
+func (b *wasmBuffer) i32(v int32) {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		done := (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0)
+		if !done {
+			c |= 0x80
+		}
+		b.byte(c)
+		if done {
+			return
+		}
+	}
+}
+
+func (b *wasmBuffer) name(s string) {
+	b.u32(uint32(len(s)))
+	*b = append(*b, s...)
+}
+
+func (b *wasmBuffer) bytes(data []byte) {
+	b.u32(uint32(len(data)))
+	*b = append(*b, data...)
+}
+
+func (b *wasmBuffer) section(id byte, contents wasmBuffer) {
+	b.byte(id)
+	b.bytes(contents)
+}
+
+// wasmPosition is the module offset of the first instruction of a token
+type wasmPosition struct {
+	offset int
+	token  *ParseToken
+}
+
+func encodeWasmModule(m *wasmModule, includeNames bool) []byte {
+	out := wasmBuffer{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}
+
+	// All functions with the same signature share a type
+	types := make([][2]int, 0)
+	typeIndex := func(fn *wasmFunc) uint32 {
+		for i, t := range types {
+			if t == [2]int{fn.params, fn.results} {
+				return uint32(i)
+			}
+		}
+		types = append(types, [2]int{fn.params, fn.results})
+		return uint32(len(types) - 1)
+	}
+	imports := wasmBuffer{}
+	imports.u32(uint32(len(m.imports)))
+	for _, imp := range m.imports {
+		imports.name(imp.module)
+		imports.name(imp.name)
+		imports.byte(wasmKindFunc)
+		imports.u32(typeIndex(&imp.fn))
+	}
+	functions := wasmBuffer{}
+	functions.u32(uint32(len(m.funcs)))
+	for _, fn := range m.funcs {
+		functions.u32(typeIndex(fn))
+	}
+	typeSection := wasmBuffer{}
+	typeSection.u32(uint32(len(types)))
+	for _, t := range types {
+		typeSection.byte(wasmTypeFunc)
+		typeSection.u32(uint32(t[0]))
+		for i := 0; i < t[0]; i++ {
+			typeSection.byte(wasmTypeI32)
+		}
+		typeSection.u32(uint32(t[1]))
+		for i := 0; i < t[1]; i++ {
+			typeSection.byte(wasmTypeI32)
+		}
+	}
+	out.section(wasmSectionType, typeSection)
+	out.section(wasmSectionImport, imports)
+	out.section(wasmSectionFunction, functions)
+
+	memory := wasmBuffer{}
+	memory.u32(1)
+	memory.byte(0x00)
+	memory.u32(uint32(m.pages))
+	out.section(wasmSectionMemory, memory)
+
+	if len(m.globals) > 0 {
+		globals := wasmBuffer{}
+		globals.u32(uint32(len(m.globals)))
+		for _, global := range m.globals {
+			globals.byte(wasmTypeI32)
+			globals.byte(0x01)
+			globals.byte(wasmConst.code)
+			globals.i32(int32(global.init))
+			globals.byte(wasmEnd.code)
+		}
+		out.section(wasmSectionGlobal, globals)
+	}
+
+	exports := wasmBuffer{}
+	exported := 0
+	for _, fn := range m.funcs {
+		if fn.export != "" {
+			exported++
+		}
+	}
+	exports.u32(uint32(1 + exported))
+	exports.name("memory")
+	exports.byte(wasmKindMemory)
+	exports.u32(0)
+	for _, fn := range m.funcs {
+		if fn.export != "" {
+			exports.name(fn.export)
+			exports.byte(wasmKindFunc)
+			exports.u32(uint32(m.funcIndex(fn.name)))
+		}
+	}
+	out.section(wasmSectionExport, exports)
+
+	// The code section is encoded last, so the offsets of the instructions in the module are known
+	bodies := make([]wasmBuffer, len(m.funcs))
+	bodyPositions := make([][]wasmPosition, len(m.funcs))
+	for i, fn := range m.funcs {
+		bodies[i], bodyPositions[i] = encodeWasmBody(fn)
+	}
+	code := wasmBuffer{}
+	code.u32(uint32(len(m.funcs)))
+	positions := make([]wasmPosition, 0)
+	codeStart := len(out) + 1 + len(uleb(uint32(wasmCodeSize(bodies))))
+	for i, body := range bodies {
+		code.u32(uint32(len(body)))
+		for _, pos := range bodyPositions[i] {
+			positions = append(positions, wasmPosition{codeStart + len(code) + pos.offset, pos.token})
+		}
+		code = append(code, body...)
+	}
+	out.section(wasmSectionCode, code)
+
+	data := wasmBuffer{}
+	data.u32(uint32(len(m.data)))
+	for _, segment := range m.data {
+		data.u32(0)
+		data.byte(wasmConst.code)
+		data.i32(int32(segment.offset))
+		data.byte(wasmEnd.code)
+		data.bytes(segment.data)
+	}
+	out.section(wasmSectionData, data)
+
+	if includeNames {
+		out.section(wasmSectionCustom, encodeWasmNames(m))
+
+		// bf.positions has the module offset, line and column of every token
+		sourceMap := wasmBuffer{}
+		sourceMap.name("bf.positions")
+		sourceMap.u32(uint32(len(positions)))
+		for _, pos := range positions {
+			sourceMap.u32(uint32(pos.offset))
+			sourceMap.u32(uint32(pos.token.Pos.Line))
+			sourceMap.u32(uint32(pos.token.Pos.Column))
+		}
+		out.section(wasmSectionCustom, sourceMap)
+	}
+
+	return out
+}
+
+func uleb(v uint32) wasmBuffer {
+	b := wasmBuffer{}
+	b.u32(v)
+	return b
+}
+
+// wasmCodeSize returns the size of the contents of the code section
+func wasmCodeSize(bodies []wasmBuffer) int {
+	size := len(uleb(uint32(len(bodies))))
+	for _, body := range bodies {
+		size += len(uleb(uint32(len(body)))) + len(body)
+	}
+	return size
+}
+
+// encodeWasmBody encodes the locals and instructions of a function, and returns the
+// offsets of the tokens in it
+func encodeWasmBody(fn *wasmFunc) (wasmBuffer, []wasmPosition) {
+	body := wasmBuffer{}
+	positions := make([]wasmPosition, 0)
+	if locals := len(fn.locals) - fn.params; locals > 0 {
+		body.u32(1)
+		body.u32(uint32(locals))
+		body.byte(wasmTypeI32)
+	} else {
+		body.u32(0)
+	}
+	for _, instr := range fn.body {
+		if instr.token != nil {
+			positions = append(positions, wasmPosition{len(body), instr.token})
+		}
+		body.byte(instr.op.code)
+		switch instr.op.imm {
+		case immBlock:
+			body.byte(wasmBlockEmpty)
+		case immLabel, immFunc, immLocal, immGlobal:
+			body.u32(uint32(instr.args[0]))
+		case immMemory:
+			body.u32(uint32(instr.args[0]))
+			body.u32(uint32(instr.args[1]))
+		case immI32:
+			body.i32(int32(instr.args[0]))
+		}
+	}
+	return body, positions
+}
+
+// encodeWasmNames encodes the name section with the names of the functions and their locals
+func encodeWasmNames(m *wasmModule) wasmBuffer {
+	names := wasmBuffer{}
+	names.name("name")
+
+	functionNames := wasmBuffer{}
+	functionNames.u32(uint32(len(m.imports) + len(m.funcs)))
+	for i := 0; i < len(m.imports)+len(m.funcs); i++ {
+		functionNames.u32(uint32(i))
+		functionNames.name(m.funcName(i))
+	}
+	names.section(1, functionNames)
+
+	localNames := wasmBuffer{}
+	localNames.u32(uint32(len(m.funcs)))
+	for _, fn := range m.funcs {
+		localNames.u32(uint32(m.funcIndex(fn.name)))
+		localNames.u32(uint32(len(fn.locals)))
+		for j, local := range fn.locals {
+			localNames.u32(uint32(j))
+			localNames.name(local)
+		}
+	}
+	names.section(2, localNames)
+
+	if len(m.globals) > 0 {
+		globalNames := wasmBuffer{}
+		globalNames.u32(uint32(len(m.globals)))
+		for i, global := range m.globals {
+			globalNames.u32(uint32(i))
+			globalNames.name(global.name)
+		}
+		names.section(7, globalNames)
+	}
+	return names
+}
@@ -0,0 +1,106 @@
+package generators
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PrintWAT prints the tokens as a WebAssembly module in the text format, for WASI runtimes
+func PrintWAT(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memorySize int, wordSize int) {
+	m := buildWasmModule(tokens, memorySize, wordSize)
+
+	f.Println("(module")
+	for _, imp := range m.imports {
+		f.Printf("  (import %q %q (func $%s%s))\n", imp.module, imp.name, imp.fn.name, watSignature(&imp.fn))
+	}
+	f.Printf("  (memory (export \"memory\") %d)\n", m.pages)
+	for _, global := range m.globals {
+		f.Printf("  (global $%s (mut i32) (i32.const %d))\n", global.name, global.init)
+	}
+	for _, data := range m.data {
+		f.Printf("  (data (i32.const %d) \"%s\")\n", data.offset, watString(data.data))
+	}
+
+	for _, fn := range m.funcs {
+		f.Printf("\n  (func $%s", fn.name)
+		if fn.export != "" {
+			f.Printf(" (export %q)", fn.export)
+		}
+		f.Printf("%s\n", watSignature(fn))
+		for _, local := range fn.locals[fn.params:] {
+			f.Printf("    (local $%s i32)\n", local)
+		}
+
+		depth := 2
+		for i, instr := range fn.body {
+			if instr.op == wasmEnd {
+				depth--
+			}
+			if i == len(fn.body)-1 {
+				// The end of the function is the closing parenthesis
+				break
+			}
+			if includeComments && instr.token != nil {
+				t := instr.token
+				f.Printf("%s;; Pos %d:%d %s (%s, %d, %d)\n", strings.Repeat("  ", depth), t.Pos.Line, t.Pos.Column, t.Tok.Character, t.Tok.TokenName, t.Extra, t.Extra2)
+			}
+			f.Printf("%s%s\n", strings.Repeat("  ", depth), watInstr(m, fn, instr))
+			if instr.op.imm == immBlock {
+				depth++
+			}
+		}
+		f.Println("  )")
+	}
+	f.Println(")")
+}
+
+// watSignature returns the parameters and results of a function, where the parameter names are optional
+func watSignature(fn *wasmFunc) string {
+	signature := ""
+	for i := 0; i < fn.params; i++ {
+		if i < len(fn.locals) {
+			signature += fmt.Sprintf(" (param $%s i32)", fn.locals[i])
+		} else {
+			signature += " (param i32)"
+		}
+	}
+	if fn.results > 0 {
+		signature += " (result" + strings.Repeat(" i32", fn.results) + ")"
+	}
+	return signature
+}
+
+func watInstr(m *wasmModule, fn *wasmFunc, instr wasmInstr) string {
+	switch instr.op.imm {
+	case immLabel:
+		return fmt.Sprintf("%s %d", instr.op.name, instr.args[0])
+	case immFunc:
+		return fmt.Sprintf("%s $%s", instr.op.name, m.funcName(instr.args[0]))
+	case immLocal:
+		return fmt.Sprintf("%s $%s", instr.op.name, fn.locals[instr.args[0]])
+	case immGlobal:
+		return fmt.Sprintf("%s $%s", instr.op.name, m.globals[instr.args[0]].name)
+	case immMemory:
+		// The alignment is always the natural one, which is the default
+		if instr.args[1] != 0 {
+			return fmt.Sprintf("%s offset=%d", instr.op.name, instr.args[1])
+		}
+	case immI32:
+		// Constants are signed, like in the binary format
+		return fmt.Sprintf("%s %d", instr.op.name, int32(instr.args[0]))
+	}
+	return instr.op.name
+}
+
+// watString escapes bytes for a string in the text format
+func watString(data []byte) string {
+	s := ""
+	for _, b := range data {
+		if b >= 0x20 && b < 0x7f && b != '"' && b != '\\' {
+			s += string(rune(b))
+		} else {
+			s += fmt.Sprintf("\\%02x", b)
+		}
+	}
+	return s
+}
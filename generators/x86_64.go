@@ -0,0 +1,224 @@
+package generators
+
+import (
+	"fmt"
+	"log"
+)
+
+// x86Registers has the names of the 8, 16 and 32 bit parts of the temporaries
+var x86Registers = map[string][3]string{
+	"%eax": {"%al", "%ax", "%eax"},
+	"%ecx": {"%cl", "%cx", "%ecx"},
+}
+
+// x86Target writes x86-64 assembly for the native generators, and uses the cells in memory as
+// operands. %ecx and %edx are the scratch registers of the division.
+type x86Target struct {
+	bytes  int
+	suffix string
+	// Loads a cell into a 32 bit register
+	extend string
+}
+
+func newX86Target(wordSize int) x86Target {
+	switch wordSize {
+	case 8:
+		if SignedCells {
+			return x86Target{1, "b", "movsbl"}
+		}
+		return x86Target{1, "b", "movzbl"}
+	case 16:
+		if SignedCells {
+			return x86Target{2, "w", "movswl"}
+		}
+		return x86Target{2, "w", "movzwl"}
+	case 32:
+		return x86Target{4, "l", "movl"}
+	}
+	log.Fatalf("Error: Unknown word size %d\n", wordSize)
+	return x86Target{}
+}
+
+// cell returns the operand of the cell at offset from the pointer in %rbx
+func (x x86Target) cell(offset int) string {
+	if offset == 0 {
+		return "(%rbx)"
+	}
+	return fmt.Sprintf("%d(%%rbx)", offset*x.bytes)
+}
+
+// low returns the part of a temporary with the size of a cell
+func (x x86Target) low(reg string) string {
+	return x86Registers[reg][map[int]int{1: 0, 2: 1, 4: 2}[x.bytes]]
+}
+
+func (x x86Target) syntax() nativeSyntax {
+	return nativeSyntax{"#", map[int]string{1: ".byte", 2: ".short", 4: ".long"}[x.bytes], "@progbits"}
+}
+
+func (x x86Target) start(f *GeneratorOutput) {}
+
+func (x x86Target) registers() nativeRegisters {
+	return nativeRegisters{"%rbx", []string{"%eax", "%ecx"}}
+}
+
+func (x x86Target) address(f *GeneratorOutput, reg string, symbol string) {
+	f.Printf("	lea %s(%%rip), %s\n", symbol, reg)
+}
+
+func (x x86Target) load(f *GeneratorOutput, reg string, offset int) {
+	f.Printf("	%s %s, %s\n", x.extend, x.cell(offset), reg)
+}
+
+func (x x86Target) store(f *GeneratorOutput, reg string, offset int) {
+	f.Printf("	mov%s %s, %s\n", x.suffix, x.low(reg), x.cell(offset))
+}
+
+func (x x86Target) constant(f *GeneratorOutput, reg string, value int) {
+	f.Printf("	mov $%d, %s\n", int32(value), reg)
+}
+
+func (x x86Target) arith(f *GeneratorOutput, op string, reg string, value int) {
+	f.Printf("	%s $%d, %s\n", op, int32(value), reg)
+}
+
+func (x x86Target) mulAdd(f *GeneratorOutput, dst string, src string, factor int) {
+	if factor != 1 {
+		f.Printf("	imul $%d, %s, %s\n", factor, src, src)
+	}
+	f.Printf("	add %s, %s\n", src, dst)
+}
+
+func (x x86Target) div(f *GeneratorOutput, reg string, divisor int) {
+	if reg != "%eax" {
+		log.Fatalf("Error: Division in %s\n", reg)
+	}
+	f.Printf("	mov $%d, %%ecx\n", divisor)
+	if SignedCells {
+		f.Println("	cltd")
+		f.Println("	idiv %ecx")
+	} else {
+		f.Println("	xor %edx, %edx")
+		f.Println("	div %ecx")
+	}
+}
+
+func (x x86Target) movePointer(f *GeneratorOutput, bytes int) {
+	if bytes < 0 {
+		f.Printf("	sub $%d, %%rbx\n", -bytes)
+	} else {
+		f.Printf("	add $%d, %%rbx\n", bytes)
+	}
+}
+
+func (x x86Target) branch(f *GeneratorOutput, reg string, zero bool, label string) {
+	f.Printf("	test %s, %s\n", reg, reg)
+	x.jumpIf(f, zero, label)
+}
+
+func (x x86Target) jumpIf(f *GeneratorOutput, zero bool, label string) {
+	if zero {
+		f.Printf("	je %s\n", label)
+	} else {
+		f.Printf("	jne %s\n", label)
+	}
+}
+
+func (x x86Target) jump(f *GeneratorOutput, label string) {
+	f.Printf("	jmp %s\n", label)
+}
+
+func (x x86Target) call(f *GeneratorOutput, name string) {
+	f.Printf("	call %s\n", name)
+}
+
+func (x x86Target) exit(f *GeneratorOutput) {
+	f.Println("	mov $60, %eax")
+	f.Println("	xor %edi, %edi")
+	f.Println("	syscall")
+}
+
+func (x x86Target) arithCell(f *GeneratorOutput, op string, offset int, value int) {
+	f.Printf("	%s%s $%d, %s\n", op, x.suffix, value, x.cell(offset))
+}
+
+func (x x86Target) setCell(f *GeneratorOutput, offset int, value int) {
+	f.Printf("	mov%s $%d, %s\n", x.suffix, value, x.cell(offset))
+}
+
+func (x x86Target) mulAddCell(f *GeneratorOutput, offset int, src string, factor int) {
+	if factor != 1 {
+		f.Printf("	imul $%d, %s, %s\n", factor, src, src)
+	}
+	f.Printf("	add%s %s, %s\n", x.suffix, x.low(src), x.cell(offset))
+}
+
+func (x x86Target) branchCell(f *GeneratorOutput, offset int, zero bool, label string) {
+	f.Printf("	cmp%s $0, %s\n", x.suffix, x.cell(offset))
+	x.jumpIf(f, zero, label)
+}
+
+func (x x86Target) runtime(f *GeneratorOutput) {
+	// bf_putc adds the byte in %al to the output buffer, and writes it when it is full
+	f.Print(`bf_putc:
+	mov bf_outlen(%rip), %rcx
+	lea bf_outbuf(%rip), %rdx
+	mov %al, (%rdx,%rcx)
+	inc %rcx
+	mov %rcx, bf_outlen(%rip)
+	cmp $4096, %rcx
+	je bf_flush
+	ret
+
+bf_flush:
+	mov bf_outlen(%rip), %rdx
+	test %rdx, %rdx
+	jz 1f
+	mov $1, %eax
+	mov $1, %edi
+	lea bf_outbuf(%rip), %rsi
+	syscall
+	movq $0, bf_outlen(%rip)
+1:
+	ret
+
+`)
+
+	if EmbeddedInput != nil {
+		f.Printf(`bf_getc:
+	mov bf_inpos(%%rip), %%rax
+	cmp $%d, %%rax
+	jae 1f
+	lea bf_input(%%rip), %%rcx
+	movzbl (%%rcx,%%rax), %%ecx
+	mov%s %s, (%%rbx)
+	inc %%rax
+	mov %%rax, bf_inpos(%%rip)
+1:
+	ret
+`, len(EmbeddedInput), x.suffix, x.low("%ecx"))
+	} else {
+		// The output is written first, so a prompt is shown before waiting for input
+		f.Printf(`bf_getc:
+	call bf_flush
+	xor %%eax, %%eax
+	xor %%edi, %%edi
+	lea bf_inbuf(%%rip), %%rsi
+	mov $1, %%edx
+	syscall
+	cmp $1, %%rax
+	jne 1f
+	movzbl bf_inbuf(%%rip), %%ecx
+	mov%s %s, (%%rbx)
+1:
+	ret
+`, x.suffix, x.low("%ecx"))
+	}
+}
+
+// PrintX86_64 prints the tokens as x86-64 assembly for Linux in GNU as syntax, which can be
+// linked with ld alone. The pointer is kept in %rbx, the output is buffered and written with
+// the write syscall, and the input is read one byte at a time with the read syscall.
+func PrintX86_64(f *GeneratorOutput, tokens []ParseToken, includeComments bool, memorySize int, wordSize int) {
+	printNative(f, newX86Target(wordSize), tokens, includeComments, memorySize, wordSize)
+}
@@ -0,0 +1,517 @@
+package generators
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// The kinds of the operands in AT&T syntax
+const (
+	x86Imm = iota
+	x86Reg
+	x86Mem
+	x86Label
+)
+
+// x86Operand is an operand of an instruction. A memory operand is either relative to %rip and
+// a symbol, or a base register with an optional index register and displacement.
+type x86Operand struct {
+	kind   int
+	imm    int
+	reg    int
+	size   int
+	base   int
+	index  int
+	disp   int
+	symbol string
+}
+
+// x86RegisterNumbers has the number and size in bytes of the registers
+var x86RegisterNumbers = func() map[string][2]int {
+	names := [][4]string{
+		{"%al", "%ax", "%eax", "%rax"},
+		{"%cl", "%cx", "%ecx", "%rcx"},
+		{"%dl", "%dx", "%edx", "%rdx"},
+		{"%bl", "%bx", "%ebx", "%rbx"},
+		{"", "%sp", "%esp", "%rsp"},
+		{"", "%bp", "%ebp", "%rbp"},
+		{"", "%si", "%esi", "%rsi"},
+		{"", "%di", "%edi", "%rdi"},
+	}
+	m := map[string][2]int{}
+	for n, sizes := range names {
+		for i, name := range sizes {
+			if name != "" {
+				m[name] = [2]int{n, 1 << i}
+			}
+		}
+	}
+	return m
+}()
+
+// x86Section is a section of the assembled program, placed at addr by the linker
+type x86Section struct {
+	name string
+	data []byte
+	addr int
+}
+
+// x86Fixup is a 32 bit displacement to a symbol, relative to the end of the instruction
+type x86Fixup struct {
+	section *x86Section
+	offset  int
+	end     int
+	symbol  string
+}
+
+type x86Symbol struct {
+	section *x86Section
+	offset  int
+}
+
+// x86Assembler assembles the instructions and directives the x86-64 generator writes
+type x86Assembler struct {
+	sections []*x86Section
+	section  *x86Section
+	symbols  map[string]x86Symbol
+	// The labels in the order they are defined
+	labels []string
+	fixups []x86Fixup
+	// The number of definitions of each numeric local label
+	numeric map[string]int
+}
+
+func newX86Assembler() *x86Assembler {
+	a := &x86Assembler{symbols: map[string]x86Symbol{}, numeric: map[string]int{}}
+	for _, name := range []string{".text", ".rodata", ".data", ".bss"} {
+		a.sections = append(a.sections, &x86Section{name: name})
+	}
+	a.section = a.sections[0]
+	return a
+}
+
+func (a *x86Assembler) sectionNamed(name string) *x86Section {
+	for _, s := range a.sections {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// assemble assembles the lines of a program, which ends the program on errors
+func (a *x86Assembler) assemble(source string) {
+	for n, line := range strings.Split(source, "\n") {
+		if err := a.line(strings.TrimSpace(line)); err != nil {
+			log.Fatalf("Error: Assembling line %d %q: %v\n", n+1, line, err)
+		}
+	}
+	for _, fixup := range a.fixups {
+		if _, ok := a.symbols[fixup.symbol]; !ok {
+			log.Fatalf("Error: Undefined symbol %s\n", fixup.symbol)
+		}
+	}
+}
+
+func (a *x86Assembler) line(line string) error {
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	if strings.HasSuffix(line, ":") {
+		name := strings.TrimSuffix(line, ":")
+		if _, err := strconv.Atoi(name); err == nil {
+			a.numeric[name]++
+			name = fmt.Sprintf("%s#%d", name, a.numeric[name]-1)
+		}
+		if _, ok := a.symbols[name]; ok {
+			return fmt.Errorf("label %s is defined twice", name)
+		}
+		a.symbols[name] = x86Symbol{a.section, len(a.section.data)}
+		a.labels = append(a.labels, name)
+		return nil
+	}
+
+	mnemonic, rest, _ := strings.Cut(line, " ")
+	if strings.HasPrefix(mnemonic, ".") {
+		return a.directive(mnemonic, strings.TrimSpace(rest))
+	}
+	operands := make([]x86Operand, 0)
+	for _, s := range x86SplitOperands(rest) {
+		op, err := a.operand(s)
+		if err != nil {
+			return err
+		}
+		operands = append(operands, op)
+	}
+	return a.instruction(mnemonic, operands)
+}
+
+func (a *x86Assembler) directive(name string, args string) error {
+	switch name {
+	case ".text", ".data", ".bss":
+		a.section = a.sectionNamed(name)
+	case ".section":
+		// Only .rodata has contents, .note.GNU-stack becomes the program header of the stack
+		a.section = a.sectionNamed(strings.Split(args, ",")[0])
+		if a.section == nil {
+			a.section = &x86Section{name: args}
+		}
+	case ".globl":
+	case ".p2align":
+		n, err := strconv.Atoi(args)
+		if err != nil {
+			return err
+		}
+		for len(a.section.data)%(1<<n) != 0 {
+			a.section.data = append(a.section.data, 0)
+		}
+	case ".zero":
+		n, err := strconv.Atoi(args)
+		if err != nil {
+			return err
+		}
+		a.section.data = append(a.section.data, make([]byte, n)...)
+	case ".byte", ".short", ".long":
+		size := map[string]int{".byte": 1, ".short": 2, ".long": 4}[name]
+		for _, s := range strings.Split(args, ",") {
+			v, err := strconv.ParseInt(strings.TrimSpace(s), 0, 64)
+			if err != nil {
+				return err
+			}
+			a.section.data = x86AppendImm(a.section.data, int(v), size)
+		}
+	default:
+		return fmt.Errorf("unknown directive %s", name)
+	}
+	return nil
+}
+
+// x86SplitOperands splits the operands at the commas outside of parentheses
+func x86SplitOperands(s string) []string {
+	operands := make([]string, 0)
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				operands = append(operands, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if strings.TrimSpace(s) != "" {
+		operands = append(operands, strings.TrimSpace(s[start:]))
+	}
+	return operands
+}
+
+func (a *x86Assembler) operand(s string) (x86Operand, error) {
+	switch {
+	case strings.HasPrefix(s, "$"):
+		v, err := strconv.ParseInt(s[1:], 0, 64)
+		return x86Operand{kind: x86Imm, imm: int(v)}, err
+	case strings.HasPrefix(s, "%"):
+		r, ok := x86RegisterNumbers[s]
+		if !ok {
+			return x86Operand{}, fmt.Errorf("unknown register %s", s)
+		}
+		return x86Operand{kind: x86Reg, reg: r[0], size: r[1]}, nil
+	case strings.HasSuffix(s, ")"):
+		disp, inner, _ := strings.Cut(strings.TrimSuffix(s, ")"), "(")
+		op := x86Operand{kind: x86Mem, base: -1, index: -1}
+		regs := strings.Split(inner, ",")
+		if regs[0] == "%rip" {
+			op.symbol = disp
+			return op, nil
+		}
+		for i, name := range regs {
+			r, ok := x86RegisterNumbers[name]
+			if !ok || r[1] != 8 {
+				return x86Operand{}, fmt.Errorf("unknown address register %s", name)
+			}
+			if i == 0 {
+				op.base = r[0]
+			} else {
+				op.index = r[0]
+			}
+		}
+		if disp != "" {
+			v, err := strconv.Atoi(disp)
+			if err != nil {
+				return x86Operand{}, err
+			}
+			op.disp = v
+		}
+		return op, nil
+	}
+	// A numeric local label refers to the next or the previous definition
+	if n := strings.TrimRight(s, "fb"); n != s {
+		if _, err := strconv.Atoi(n); err == nil {
+			if strings.HasSuffix(s, "f") {
+				return x86Operand{kind: x86Label, symbol: fmt.Sprintf("%s#%d", n, a.numeric[n])}, nil
+			}
+			return x86Operand{kind: x86Label, symbol: fmt.Sprintf("%s#%d", n, a.numeric[n]-1)}, nil
+		}
+	}
+	return x86Operand{kind: x86Label, symbol: s}, nil
+}
+
+// x86AppendImm appends a little endian immediate of size bytes
+func x86AppendImm(b []byte, v int, size int) []byte {
+	switch size {
+	case 1:
+		return append(b, byte(v))
+	case 2:
+		return binary.LittleEndian.AppendUint16(b, uint16(v))
+	}
+	return binary.LittleEndian.AppendUint32(b, uint32(v))
+}
+
+// x86Code is an instruction being encoded, with the position of its displacement to a symbol
+type x86Code struct {
+	bytes  []byte
+	fixup  int
+	symbol string
+}
+
+func (c *x86Code) emit(b ...byte) {
+	c.bytes = append(c.bytes, b...)
+}
+
+// prefix emits the operand size prefix or REX.W for an operation size
+func (c *x86Code) prefix(size int) {
+	switch size {
+	case 2:
+		c.emit(0x66)
+	case 8:
+		c.emit(0x48)
+	}
+}
+
+// rel emits a 32 bit displacement to a symbol
+func (c *x86Code) rel(symbol string) {
+	c.fixup = len(c.bytes)
+	c.symbol = symbol
+	c.emit(0, 0, 0, 0)
+}
+
+// modrm emits the ModRM byte, and the SIB byte and displacement of a memory operand
+func (c *x86Code) modrm(reg int, rm x86Operand) {
+	if rm.kind == x86Reg {
+		c.emit(byte(0xc0 | reg<<3 | rm.reg))
+		return
+	}
+	if rm.symbol != "" {
+		c.emit(byte(0x05 | reg<<3))
+		c.rel(rm.symbol)
+		return
+	}
+	mod := 0x80
+	switch {
+	case rm.disp == 0 && rm.base != 5:
+		mod = 0x00
+	case rm.disp >= -128 && rm.disp <= 127:
+		mod = 0x40
+	}
+	if rm.index >= 0 || rm.base == 4 {
+		index := rm.index
+		if index < 0 {
+			index = 4
+		}
+		c.emit(byte(mod|reg<<3|4), byte(index<<3|rm.base))
+	} else {
+		c.emit(byte(mod | reg<<3 | rm.base))
+	}
+	switch mod {
+	case 0x40:
+		c.emit(byte(rm.disp))
+	case 0x80:
+		c.bytes = x86AppendImm(c.bytes, rm.disp, 4)
+	}
+}
+
+// x86Arith has the ModRM digit of the immediate form and the opcode of the register form
+var x86Arith = map[string][2]int{
+	"add": {0, 0x00},
+	"sub": {5, 0x28},
+	"xor": {6, 0x30},
+	"cmp": {7, 0x38},
+}
+
+// x86Jumps has the second opcode byte of the conditional jumps
+var x86Jumps = map[string]byte{"je": 0x84, "jz": 0x84, "jne": 0x85, "jnz": 0x85, "jae": 0x83}
+
+// x86Extends has the opcodes of the loads that extend a cell to 32 bits
+var x86Extends = map[string]byte{"movzbl": 0xb6, "movsbl": 0xbe, "movzwl": 0xb7, "movswl": 0xbf}
+
+// x86Sized are the mnemonics that can have a size suffix
+var x86Sized = []string{"mov", "test", "add", "sub", "xor", "cmp", "inc"}
+
+// x86SplitSuffix returns the mnemonic without its size suffix, and the size of the suffix
+func x86SplitSuffix(mnemonic string) (string, int) {
+	for _, base := range x86Sized {
+		if mnemonic == base {
+			return base, 0
+		}
+		if len(mnemonic) == len(base)+1 && strings.HasPrefix(mnemonic, base) {
+			if size, ok := map[byte]int{'b': 1, 'w': 2, 'l': 4, 'q': 8}[mnemonic[len(base)]]; ok {
+				return base, size
+			}
+		}
+	}
+	return mnemonic, 0
+}
+
+func (a *x86Assembler) instruction(mnemonic string, ops []x86Operand) error {
+	c := &x86Code{fixup: -1}
+	count := func(n int) bool {
+		return len(ops) == n
+	}
+	if jump, ok := x86Jumps[mnemonic]; ok && count(1) {
+		c.emit(0x0f, jump)
+		c.rel(ops[0].symbol)
+		return a.append(c)
+	}
+	if extend, ok := x86Extends[mnemonic]; ok && count(2) && ops[1].kind == x86Reg {
+		c.emit(0x0f, extend)
+		c.modrm(ops[1].reg, ops[0])
+		return a.append(c)
+	}
+
+	base, size := x86SplitSuffix(mnemonic)
+	if size == 0 {
+		for _, op := range ops {
+			if op.kind == x86Reg {
+				size = op.size
+			}
+		}
+	}
+	_, arith := x86Arith[base]
+	switch {
+	case mnemonic == "syscall" && count(0):
+		c.emit(0x0f, 0x05)
+	case mnemonic == "ret" && count(0):
+		c.emit(0xc3)
+	case mnemonic == "cltd" && count(0):
+		c.emit(0x99)
+	case mnemonic == "jmp" && count(1):
+		c.emit(0xe9)
+		c.rel(ops[0].symbol)
+	case mnemonic == "call" && count(1):
+		c.emit(0xe8)
+		c.rel(ops[0].symbol)
+	case mnemonic == "lea" && count(2) && ops[1].kind == x86Reg:
+		c.prefix(size)
+		c.emit(0x8d)
+		c.modrm(ops[1].reg, ops[0])
+	case (mnemonic == "div" || mnemonic == "idiv") && count(1) && ops[0].kind == x86Reg:
+		c.prefix(size)
+		c.emit(0xf7)
+		c.modrm(map[string]int{"div": 6, "idiv": 7}[mnemonic], ops[0])
+	case mnemonic == "imul" && count(3) && ops[0].kind == x86Imm && ops[2].kind == x86Reg:
+		c.prefix(size)
+		if ops[0].imm >= -128 && ops[0].imm <= 127 {
+			c.emit(0x6b)
+			c.modrm(ops[2].reg, ops[1])
+			c.emit(byte(ops[0].imm))
+		} else {
+			c.emit(0x69)
+			c.modrm(ops[2].reg, ops[1])
+			c.bytes = x86AppendImm(c.bytes, ops[0].imm, 4)
+		}
+	case size == 0:
+		return fmt.Errorf("unknown operand size")
+	case base == "inc" && count(1):
+		c.prefix(size)
+		c.emit(0xfe | x86Wide(size))
+		c.modrm(0, ops[0])
+	case (base == "mov" || base == "test" || arith) && count(2):
+		return a.binary(c, base, size, ops[0], ops[1])
+	default:
+		return fmt.Errorf("unknown instruction")
+	}
+	return a.append(c)
+}
+
+// x86Wide returns the bit of the opcodes that selects a 16, 32 or 64 bit operation
+func x86Wide(size int) byte {
+	if size > 1 {
+		return 1
+	}
+	return 0
+}
+
+// binary encodes mov, test and the arithmetic with a source and a destination
+func (a *x86Assembler) binary(c *x86Code, base string, size int, src x86Operand, dst x86Operand) error {
+	wide := x86Wide(size)
+	c.prefix(size)
+	switch {
+	case src.kind == x86Imm && base == "mov" && dst.kind == x86Reg && size == 4:
+		c.emit(0xb8 + byte(dst.reg))
+		c.bytes = x86AppendImm(c.bytes, src.imm, 4)
+	case src.kind == x86Imm && base == "mov":
+		c.emit(0xc6 | wide)
+		c.modrm(0, dst)
+		c.bytes = x86AppendImm(c.bytes, src.imm, min(size, 4))
+	case src.kind == x86Imm && base != "test":
+		// The sign extended 8 bit immediate is used when it gives the same value
+		digit := x86Arith[base][0]
+		v := int64(src.imm) << (64 - 8*size) >> (64 - 8*size)
+		if size > 1 && v >= -128 && v <= 127 {
+			c.emit(0x83)
+			c.modrm(digit, dst)
+			c.emit(byte(v))
+		} else {
+			c.emit(0x80 | wide)
+			c.modrm(digit, dst)
+			c.bytes = x86AppendImm(c.bytes, src.imm, min(size, 4))
+		}
+	case src.kind == x86Reg && (dst.kind == x86Reg || dst.kind == x86Mem):
+		opcode := map[string]byte{"mov": 0x88, "test": 0x84}[base]
+		if base != "mov" && base != "test" {
+			opcode = byte(x86Arith[base][1])
+		}
+		c.emit(opcode | wide)
+		c.modrm(src.reg, dst)
+	case src.kind == x86Mem && dst.kind == x86Reg && base != "test":
+		opcode := byte(0x8a)
+		if base != "mov" {
+			opcode = byte(x86Arith[base][1]) | 2
+		}
+		c.emit(opcode | wide)
+		c.modrm(dst.reg, src)
+	default:
+		return fmt.Errorf("unknown operands")
+	}
+	return a.append(c)
+}
+
+func (a *x86Assembler) append(c *x86Code) error {
+	start := len(a.section.data)
+	if c.fixup >= 0 {
+		a.fixups = append(a.fixups, x86Fixup{a.section, start + c.fixup, start + len(c.bytes), c.symbol})
+	}
+	a.section.data = append(a.section.data, c.bytes...)
+	return nil
+}
+
+// address returns the address of a symbol after the sections have been placed
+func (a *x86Assembler) address(symbol string) int {
+	s := a.symbols[symbol]
+	return s.section.addr + s.offset
+}
+
+// link writes the displacements to the symbols after the sections have been placed
+func (a *x86Assembler) link() {
+	for _, fixup := range a.fixups {
+		rel := a.address(fixup.symbol) - (fixup.section.addr + fixup.end)
+		binary.LittleEndian.PutUint32(fixup.section.data[fixup.offset:], uint32(int32(rel)))
+	}
+}
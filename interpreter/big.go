@@ -0,0 +1,166 @@
+package interpreter
+
+import (
+	"fmt"
+	"math/big"
+
+	"bcomp/bfutils"
+	g "bcomp/generators"
+)
+
+// low64 returns the lowest 64 bits of v in two's complement, which is what
+// the trace and the observer get to see of a big cell
+func low64(v *big.Int) uint64 {
+	if v.IsInt64() {
+		return uint64(v.Int64())
+	}
+	return new(big.Int).And(v, new(big.Int).SetUint64(^uint64(0))).Uint64()
+}
+
+// outputValue is what is written when a big cell is output. Negative and huge
+// values are not code points, so they are written as U+FFFD with EncodingUTF8.
+func outputValue(v *big.Int, encoding bfutils.Encoding) uint64 {
+	if encoding == bfutils.EncodingUTF8 && !v.IsUint64() {
+		return ^uint64(0)
+	}
+	return low64(v)
+}
+
+// neverEnds returns the error for a loop the optimizer has replaced, which would never end with unbounded cells
+func neverEnds(t g.ParseToken, v *big.Int) error {
+	return fmt.Errorf("the loop optimized into %s at %d:%d never ends with %v in an unbounded cell", t.Tok.TokenName, t.Pos.Line, t.Pos.Column, v)
+}
+
+// bigCells are arbitrary precision cells, which never wrap around.
+//
+// The optimizer replaces loops like [->++<] with MUL, and [--] with DIV, which is only correct
+// if the loop ends. With wrapping cells it always does, but with unbounded cells it never ends
+// if the loop counter is negative, or not a multiple of what it is decremented with,
+// so these cases are stopped with an error.
+type bigCells struct {
+	mem []big.Int
+	// The tokens, for the error of a loop that never ends
+	tokens []g.ParseToken
+	signed bool
+	ovf    *Overflows
+	b      big.Int
+}
+
+// loadBigCells makes the tape the program starts with, like loadCells
+func loadBigCells(tokens []g.ParseToken, memorySize int, opts Options) ([]big.Int, error) {
+	if opts.Resume != nil {
+		if err := opts.Resume.check(tokens, WordSizeBig); err != nil {
+			return nil, err
+		}
+		mem := make([]big.Int, max(memorySize, len(opts.Resume.BigTape)))
+		for addr, v := range opts.Resume.BigTape {
+			mem[addr].Set(v)
+		}
+		return mem, nil
+	}
+
+	mem := make([]big.Int, memorySize)
+	for _, init := range opts.TapeInit {
+		for j, b := range init.Data {
+			mem[init.Offset+j].SetUint64(uint64(b))
+		}
+	}
+	return mem, nil
+}
+
+// written checks a cell after it is changed. A cell below zero is recorded as an
+// underflow, and stops the interpreter unless the cells are signed.
+func (c *bigCells) written(pc, addr int) (ExitReason, error) {
+	if c.mem[addr].Sign() < 0 {
+		if c.ovf != nil {
+			c.ovf.record(Underflow, pc)
+		}
+		if !c.signed {
+			return ExitNegativeCell, nil
+		}
+	}
+	return ExitCompleted, nil
+}
+
+func (c *bigCells) len() int {
+	return len(c.mem)
+}
+
+func (c *bigCells) grow(size int) {
+	c.mem = append(c.mem, make([]big.Int, size-len(c.mem))...)
+}
+
+func (c *bigCells) isZero(addr int) bool {
+	return c.mem[addr].Sign() == 0
+}
+
+func (c *bigCells) value(addr int) uint64 {
+	return low64(&c.mem[addr])
+}
+
+func (c *bigCells) output(addr int, encoding bfutils.Encoding) uint64 {
+	return outputValue(&c.mem[addr], encoding)
+}
+
+func (c *bigCells) input(addr int, v uint64) {
+	c.mem[addr].SetUint64(v)
+}
+
+func (c *bigCells) eof(pc, addr int, policy EOFPolicy) (ExitReason, error) {
+	if policy == EOFMinusOne {
+		c.mem[addr].SetInt64(-1)
+	} else {
+		c.mem[addr].SetInt64(0)
+	}
+	return c.written(pc, addr)
+}
+
+func (c *bigCells) add(pc, addr int, delta int64) (ExitReason, error) {
+	c.mem[addr].Add(&c.mem[addr], c.b.SetInt64(delta))
+	if delta < 0 {
+		return c.written(pc, addr)
+	}
+	return ExitCompleted, nil
+}
+
+func (c *bigCells) mulAdd(pc, dst, src int, factor int64) (ExitReason, error) {
+	// The loop counter is decremented by one each round, so it has to be positive for the loop to end
+	if c.mem[src].Sign() < 0 {
+		return ExitError, neverEnds(c.tokens[pc], &c.mem[src])
+	}
+	c.b.Mul(&c.mem[src], c.b.SetInt64(factor))
+	c.mem[dst].Add(&c.mem[dst], &c.b)
+	return c.written(pc, dst)
+}
+
+func (c *bigCells) div(pc, addr int, divisor int64) (ExitReason, error) {
+	var rem big.Int
+	v := &c.mem[addr]
+	v.QuoRem(v, c.b.SetInt64(divisor), &rem)
+	if rem.Sign() != 0 || v.Sign() < 0 {
+		return ExitError, neverEnds(c.tokens[pc], v.Add(v.Mul(v, &c.b), &rem))
+	}
+	return ExitCompleted, nil
+}
+
+func (c *bigCells) set(pc, addr int, v int64) (ExitReason, error) {
+	c.mem[addr].SetInt64(v)
+	return c.written(pc, addr)
+}
+
+func (c *bigCells) state(tokens []g.ParseToken, p, pc int, steps, inputPos uint64) *State {
+	tape := make([]*big.Int, len(c.mem))
+	for addr := range c.mem {
+		tape[addr] = new(big.Int).Set(&c.mem[addr])
+	}
+
+	return &State{
+		WordSize: WordSizeBig,
+		Program:  ProgramHash(tokens),
+		PC:       pc,
+		Pointer:  p,
+		InputPos: inputPos,
+		Steps:    steps,
+		BigTape:  tape,
+	}
+}
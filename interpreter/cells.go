@@ -0,0 +1,150 @@
+package interpreter
+
+import (
+	"fmt"
+	"math/bits"
+
+	"bcomp/bfutils"
+	g "bcomp/generators"
+)
+
+// cells is the tape of the interpreter with hooks, which does the arithmetic of the cells, so
+// that fixed size and arbitrary precision cells run through the same loop. The methods that
+// change a cell get the index of the token for recording overflows, and return ExitCompleted
+// unless the cell can not have the value it got.
+type cells interface {
+	len() int
+	// grow adds zero cells to the end of the tape until it has size cells
+	grow(size int)
+	isZero(addr int) bool
+	// value is the cell as the trace and the observer see it
+	value(addr int) uint64
+	// output is the value written to the output for the cell
+	output(addr int, encoding bfutils.Encoding) uint64
+	// input sets the cell to a value read from the input
+	input(addr int, v uint64)
+	// eof sets the cell at the end of the input, with EOFZero or EOFMinusOne
+	eof(pc, addr int, policy EOFPolicy) (ExitReason, error)
+	add(pc, addr int, delta int64) (ExitReason, error)
+	// mulAdd adds the cell at src times factor to the cell at dst, for MUL
+	mulAdd(pc, dst, src int, factor int64) (ExitReason, error)
+	div(pc, addr int, divisor int64) (ExitReason, error)
+	set(pc, addr int, v int64) (ExitReason, error)
+	state(tokens []g.ParseToken, p, pc int, steps, inputPos uint64) *State
+}
+
+// newCells makes the cells of the given word size for the loop with hooks
+func newCells(tokens []g.ParseToken, memorySize int, wordSize int, opts Options) (cells, error) {
+	switch wordSize {
+	case 8:
+		return newFixedCells[uint8](tokens, memorySize, opts)
+	case 16:
+		return newFixedCells[uint16](tokens, memorySize, opts)
+	case 32:
+		return newFixedCells[uint32](tokens, memorySize, opts)
+	case WordSizeBig:
+		mem, err := loadBigCells(tokens, memorySize, opts)
+		return &bigCells{mem: mem, tokens: tokens, signed: opts.Signed, ovf: opts.Overflow}, err
+	}
+	return nil, fmt.Errorf("unknown word size %d", wordSize)
+}
+
+// fixedCells are cells of 8, 16 or 32 bits, which wrap around
+type fixedCells[S uint8 | uint16 | uint32] struct {
+	mem    []S
+	signed bool
+	ovf    *Overflows
+	// The range of the cells, for recording overflows
+	minValue, maxValue int64
+}
+
+func newFixedCells[S uint8 | uint16 | uint32](tokens []g.ParseToken, memorySize int, opts Options) (*fixedCells[S], error) {
+	mem, err := loadCells[S](tokens, memorySize, opts)
+	if err != nil {
+		return nil, err
+	}
+	c := &fixedCells[S]{mem: mem, signed: opts.Signed, ovf: opts.Overflow, maxValue: int64(^S(0))}
+	if opts.Signed {
+		wordSize := bits.Len64(uint64(^S(0)))
+		c.minValue, c.maxValue = -1<<(wordSize-1), 1<<(wordSize-1)-1
+	}
+	return c, nil
+}
+
+// asInt is the value of a cell as a signed or unsigned integer
+func (c *fixedCells[S]) asInt(v S) int64 {
+	if c.signed {
+		return signedValue(v)
+	}
+	return int64(v)
+}
+
+func (c *fixedCells[S]) len() int {
+	return len(c.mem)
+}
+
+func (c *fixedCells[S]) grow(size int) {
+	c.mem = append(c.mem, make([]S, size-len(c.mem))...)
+}
+
+func (c *fixedCells[S]) isZero(addr int) bool {
+	return c.mem[addr] == 0
+}
+
+func (c *fixedCells[S]) value(addr int) uint64 {
+	return uint64(c.mem[addr])
+}
+
+func (c *fixedCells[S]) output(addr int, encoding bfutils.Encoding) uint64 {
+	return uint64(c.mem[addr])
+}
+
+func (c *fixedCells[S]) input(addr int, v uint64) {
+	c.mem[addr] = S(v)
+}
+
+func (c *fixedCells[S]) eof(pc, addr int, policy EOFPolicy) (ExitReason, error) {
+	if policy == EOFMinusOne {
+		c.mem[addr] = ^S(0)
+	} else {
+		c.mem[addr] = 0
+	}
+	return ExitCompleted, nil
+}
+
+func (c *fixedCells[S]) add(pc, addr int, delta int64) (ExitReason, error) {
+	if c.ovf != nil {
+		c.ovf.checkAdd(pc, c.asInt(c.mem[addr]), delta, c.minValue, c.maxValue)
+	}
+	c.mem[addr] += S(delta)
+	return ExitCompleted, nil
+}
+
+func (c *fixedCells[S]) mulAdd(pc, dst, src int, factor int64) (ExitReason, error) {
+	if c.ovf != nil {
+		c.ovf.checkAdd(pc, c.asInt(c.mem[dst]), c.asInt(c.mem[src])*factor, c.minValue, c.maxValue)
+	}
+	c.mem[dst] += c.mem[src] * S(factor)
+	return ExitCompleted, nil
+}
+
+func (c *fixedCells[S]) div(pc, addr int, divisor int64) (ExitReason, error) {
+	if c.signed {
+		c.mem[addr] = S(signedValue(c.mem[addr]) / divisor)
+	} else {
+		c.mem[addr] /= S(divisor)
+	}
+	return ExitCompleted, nil
+}
+
+func (c *fixedCells[S]) set(pc, addr int, v int64) (ExitReason, error) {
+	if c.ovf != nil {
+		c.ovf.checkSet(pc, v, c.minValue, c.maxValue)
+	}
+	c.mem[addr] = S(v)
+	return ExitCompleted, nil
+}
+
+func (c *fixedCells[S]) state(tokens []g.ParseToken, p, pc int, steps, inputPos uint64) *State {
+	return newState(tokens, c.mem, p, pc, steps, inputPos)
+}
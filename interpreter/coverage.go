@@ -0,0 +1,117 @@
+package interpreter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+
+	l "bcomp/lexer"
+)
+
+// Branch holds how many times a conditional jump was taken or not taken.
+// For JMPF and BZ, taken means the loop body was entered, for JMPB it means
+// that the loop jumped back for another iteration.
+type Branch struct {
+	Line     int
+	Column   int
+	Token    string
+	Executed bool
+	Taken    uint64
+	NotTaken uint64
+}
+
+// Branches returns the outcome of every conditional jump in the token stream
+func (prof *Profile) Branches() []Branch {
+	branches := make([]Branch, 0)
+	loops := make([]int, 0)
+
+	for i, t := range prof.tokens {
+		var taken uint64
+		switch t.Tok.Tok {
+		case l.JMPF, l.BZ:
+			if t.Tok.Tok == l.JMPF {
+				loops = append(loops, i)
+			}
+			taken = prof.Entries[i]
+		case l.JMPB:
+			if len(loops) == 0 {
+				continue
+			}
+			from := loops[len(loops)-1]
+			loops = loops[:len(loops)-1]
+			// Every iteration except the first in each entry came from a jump back
+			taken = prof.Iterations[from] - prof.Entries[from]
+		default:
+			continue
+		}
+
+		branches = append(branches, Branch{
+			Line:     t.Pos.Line,
+			Column:   t.Pos.Column,
+			Token:    t.Tok.TokenName,
+			Executed: prof.Counts[i] > 0,
+			Taken:    taken,
+			NotTaken: prof.Counts[i] - taken,
+		})
+	}
+
+	return branches
+}
+
+// WriteLCOV writes the line and branch coverage of the profile as an lcov tracefile
+// for the given source file
+func (prof *Profile) WriteLCOV(w io.Writer, filename string) error {
+	// A line is as covered as its most executed instruction
+	lines := make(map[int]uint64)
+	for _, pc := range prof.Positions() {
+		if count, ok := lines[pc.Line]; !ok || pc.Count > count {
+			lines[pc.Line] = pc.Count
+		}
+	}
+	lineNumbers := make([]int, 0, len(lines))
+	for line := range lines {
+		lineNumbers = append(lineNumbers, line)
+	}
+	sort.Ints(lineNumbers)
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "TN:")
+	fmt.Fprintf(out, "SF:%s\n", filename)
+
+	// The whole program is presented as a single function
+	fmt.Fprintln(out, "FN:1,main")
+	fmt.Fprintf(out, "FNDA:%d,main\n", min(prof.Steps, 1))
+	fmt.Fprintln(out, "FNF:1")
+	fmt.Fprintf(out, "FNH:%d\n", min(prof.Steps, 1))
+
+	branchesFound, branchesHit := 0, 0
+	for block, branch := range prof.Branches() {
+		for n, count := range []uint64{branch.Taken, branch.NotTaken} {
+			branchesFound++
+			if !branch.Executed {
+				fmt.Fprintf(out, "BRDA:%d,%d,%d,-\n", branch.Line, block, n)
+				continue
+			}
+			if count > 0 {
+				branchesHit++
+			}
+			fmt.Fprintf(out, "BRDA:%d,%d,%d,%d\n", branch.Line, block, n, count)
+		}
+	}
+	fmt.Fprintf(out, "BRF:%d\n", branchesFound)
+	fmt.Fprintf(out, "BRH:%d\n", branchesHit)
+
+	linesHit := 0
+	for _, line := range lineNumbers {
+		if lines[line] > 0 {
+			linesHit++
+		}
+		fmt.Fprintf(out, "DA:%d,%d\n", line, lines[line])
+	}
+	fmt.Fprintf(out, "LF:%d\n", len(lineNumbers))
+	fmt.Fprintf(out, "LH:%d\n", linesHit)
+	fmt.Fprintln(out, "end_of_record")
+
+	return out.Flush()
+}
@@ -4,34 +4,191 @@ import (
 	"bcomp/bfutils"
 	g "bcomp/generators"
 	l "bcomp/lexer"
+	"context"
 	"fmt"
+	"io"
+	"math"
+	"math/bits"
 	"os"
 )
 
 var PrintWarnings = true
 
+// WordSizeBig is the word size for cells that are arbitrary precision integers, which never wrap around
+const WordSizeBig = -1
+
 type Jump struct {
 	From int
 	To   int
 }
 
-func InterpretTokens(tokens []g.ParseToken, memorySize int, in bfutils.FileOrMemReader, out bfutils.FileOrMemWriter, wordSize int) {
-	if wordSize == 8 {
-		interpretTokensOfSize[uint8](tokens, memorySize, in, out)
-	} else if wordSize == 16 {
-		interpretTokensOfSize[uint16](tokens, memorySize, in, out)
-	} else if wordSize == 32 {
-		interpretTokensOfSize[uint32](tokens, memorySize, in, out)
-	} else {
-		fmt.Fprintf(os.Stderr, "Error: Unknown word size %d\n", wordSize)
+// Options holds limits and optional instrumentation of the interpreter.
+// The zero value runs without any limits.
+type Options struct {
+	// Stop the interpreter when the context is canceled. Note that a blocking
+	// read from the input can not be interrupted.
+	Context context.Context
+	// Maximum number of tokens to execute, 0 means no limit
+	MaxSteps uint64
+	// Maximum number of bytes to output, 0 means no limit
+	MaxOutputBytes uint64
+	// Number of cells the tape is allowed to grow beyond the memory size
+	// when the pointer moves past the end of it
+	MaxTapeGrowth int
+
+	// What happens to the current cell when reading past the end of the input
+	EOF EOFPolicy
+	// What happens when the pointer moves outside of the tape
+	Bounds BoundsMode
+	// How cells are written to the output and read from the input
+	IO bfutils.IOMode
+	// Bytes loaded into the tape before the program starts, one byte in each cell.
+	// They are not loaded when resuming from a saved state.
+	TapeInit []bfutils.TapeInit
+	// Treat cells as signed integers, which makes DIV a signed division. With WordSizeBig
+	// it allows cells to go below zero, instead of stopping with ExitNegativeCell.
+	Signed bool
+
+	// Continue from a previously saved state instead of starting from the beginning.
+	// The tokens and word size must be the same as when the state was saved, and
+	// the input must continue where it was when the state was saved.
+	Resume *State
+
+	// Collect execution counts into this profile
+	Profile *Profile
+	// Record every cell that wraps around and every pointer move below zero
+	Overflow *Overflows
+	// Write a trace of each executed step to this tracer
+	Trace *Tracer
+	// Notify this observer about every step, input, output, loop and change of memory
+	Observer Observer
+}
+
+// EOFPolicy decides what an IN instruction does to the cell when there is no more input
+type EOFPolicy int
+
+const (
+	// Leave the cell unchanged, which a lot of programs expect
+	EOFUnchanged EOFPolicy = iota
+	// Set the cell to 0
+	EOFZero
+	// Set the cell to -1, which is the highest value of the cell
+	EOFMinusOne
+)
+
+var eofPolicies = []string{
+	EOFUnchanged: "unchanged",
+	EOFZero:      "zero",
+	EOFMinusOne:  "minus1",
+}
+
+func (policy EOFPolicy) String() string {
+	return eofPolicies[policy]
+}
+
+// ParseEOFPolicy parses the name of an EOF policy: unchanged, zero or minus1
+func ParseEOFPolicy(name string) (EOFPolicy, error) {
+	for policy, policyName := range eofPolicies {
+		if name == policyName {
+			return EOFPolicy(policy), nil
+		}
 	}
+	return EOFUnchanged, fmt.Errorf("unknown EOF policy %s", name)
 }
 
-func interpretTokensOfSize[S uint8 | uint16 | uint32](tokens []g.ParseToken, memorySize int, in bfutils.FileOrMemReader, out bfutils.FileOrMemWriter) {
-	mem := make([]S, memorySize)
-	jumpLabels := make(map[int]Jump)
+// BoundsMode decides what happens when the pointer moves outside of the tape
+type BoundsMode int
+
+const (
+	// Stop with ExitOutOfBounds or ExitTapeLimit, unless the tape is allowed to grow
+	BoundsStrict BoundsMode = iota
+	// Wrap around to the other end of the tape
+	BoundsWrap
+)
+
+var boundsModes = []string{
+	BoundsStrict: "strict",
+	BoundsWrap:   "wrap",
+}
+
+func (mode BoundsMode) String() string {
+	return boundsModes[mode]
+}
 
-	// Compile jump-table
+// ParseBoundsMode parses the name of a bounds mode: strict or wrap
+func ParseBoundsMode(name string) (BoundsMode, error) {
+	for mode, modeName := range boundsModes {
+		if name == modeName {
+			return BoundsMode(mode), nil
+		}
+	}
+	return BoundsStrict, fmt.Errorf("unknown bounds mode %s", name)
+}
+
+type ExitReason int
+
+const (
+	// The program ran to the end
+	ExitCompleted ExitReason = iota
+	// The context was canceled
+	ExitCanceled
+	// The maximum number of steps was executed
+	ExitStepLimit
+	// The program tried to output more than the maximum number of bytes
+	ExitOutputLimit
+	// The pointer moved past the end of the tape, and it could not grow any further
+	ExitTapeLimit
+	// The pointer moved below the start of the tape
+	ExitOutOfBounds
+	// The output could not be written, or the interpreter was given invalid parameters
+	ExitError
+	// A cell wrapped around or the pointer moved below zero, and Overflows.Fatal is set
+	ExitOverflow
+	// A cell went below zero with WordSizeBig, and Signed is not set
+	ExitNegativeCell
+)
+
+var exitReasons = []string{
+	ExitCompleted:    "completed",
+	ExitCanceled:     "canceled",
+	ExitStepLimit:    "step limit reached",
+	ExitOutputLimit:  "output limit reached",
+	ExitTapeLimit:    "tape limit reached",
+	ExitOutOfBounds:  "pointer out of bounds",
+	ExitError:        "error",
+	ExitOverflow:     "overflow",
+	ExitNegativeCell: "cell below zero",
+}
+
+func (r ExitReason) String() string {
+	return exitReasons[r]
+}
+
+// Result describes how and where the interpreter stopped
+type Result struct {
+	Reason ExitReason
+	// Number of tokens executed
+	Steps uint64
+	// Final value of the pointer, or the offending value for ExitTapeLimit and ExitOutOfBounds
+	Pointer int
+	// Position of the last executed token
+	Pos l.Position
+	// Set when Reason is ExitError
+	Err error
+	// The state of the interpreter when it stopped, which can be saved and resumed from
+	State *State
+}
+
+func outOfBounds(addr int, pos l.Position) Result {
+	if addr < 0 {
+		return Result{Reason: ExitOutOfBounds, Pointer: addr, Pos: pos}
+	}
+	return Result{Reason: ExitTapeLimit, Pointer: addr, Pos: pos}
+}
+
+// compileJumps finds where each jump label starts and ends
+func compileJumps(tokens []g.ParseToken) map[int]Jump {
+	jumpLabels := make(map[int]Jump)
 	for i := 0; i < len(tokens); i++ {
 		t := tokens[i]
 		token := t.Tok.Tok
@@ -39,13 +196,14 @@ func interpretTokensOfSize[S uint8 | uint16 | uint32](tokens []g.ParseToken, mem
 
 		switch token {
 		case l.JMPF:
-			if (jumpLabels[jumplabel] == Jump{}) {
+			// A loop at the start of the program has From 0, so check if the label exists instead of comparing with Jump{}
+			if _, ok := jumpLabels[jumplabel]; !ok {
 				jumpLabels[jumplabel] = Jump{From: i, To: 0}
 			} else {
 				jumpLabels[jumplabel] = Jump{From: i, To: jumpLabels[jumplabel].To}
 			}
 		case l.JMPB:
-			if (jumpLabels[jumplabel] == Jump{}) {
+			if _, ok := jumpLabels[jumplabel]; !ok {
 				if PrintWarnings {
 					fmt.Fprintln(os.Stderr, "Warning: Unmatched jump label!")
 				}
@@ -53,78 +211,681 @@ func interpretTokensOfSize[S uint8 | uint16 | uint32](tokens []g.ParseToken, mem
 			} else {
 				jumpLabels[jumplabel] = Jump{From: jumpLabels[jumplabel].From, To: i}
 			}
+		case l.BZ:
+			jumpLabels[jumplabel] = Jump{From: i, To: jumpLabels[jumplabel].To}
 		case l.LBL:
-			if (jumpLabels[jumplabel] == Jump{}) {
-				jumpLabels[jumplabel] = Jump{From: i, To: i}
+			jumpLabels[jumplabel] = Jump{From: jumpLabels[jumplabel].From, To: i}
+		}
+	}
+	return jumpLabels
+}
+
+// limitedOutput writes the output of the program until the output limit is reached
+type limitedOutput struct {
+	out   bfutils.FileOrMemWriter
+	max   uint64
+	bytes uint64
+	obs   Observer
+}
+
+func (o *limitedOutput) write(v byte) (ExitReason, error) {
+	if o.max != 0 && o.bytes >= o.max {
+		return ExitOutputLimit, nil
+	}
+	if _, err := o.out.Write([]byte{v}); err != nil {
+		return ExitError, err
+	}
+	o.bytes++
+	if o.obs != nil {
+		o.obs.OnOutput(v)
+	}
+	return ExitCompleted, nil
+}
+
+// writeCell writes the value of a cell as a byte or as UTF-8
+func (o *limitedOutput) writeCell(v uint64, encoding bfutils.Encoding) (ExitReason, error) {
+	if encoding != bfutils.EncodingUTF8 {
+		return o.write(byte(v))
+	}
+	for _, b := range bfutils.EncodeUTF8(v) {
+		if reason, err := o.write(b); reason != ExitCompleted {
+			return reason, err
+		}
+	}
+	return ExitCompleted, nil
+}
+
+// cellReader reads the input of the program, and counts how many bytes it has read
+type cellReader struct {
+	in       io.Reader
+	encoding bfutils.Encoding
+	bytes    uint64
+	obs      Observer
+	buf      []byte
+}
+
+func newCellReader(in bfutils.FileOrMemReader, mode bfutils.IOMode, obs Observer) *cellReader {
+	r := &cellReader{encoding: mode.Encoding, obs: obs, buf: make([]byte, 1)}
+	// The bytes are counted before the line endings are translated, so a snapshot knows
+	// how much of the original input to skip when it is resumed
+	r.in = bfutils.NewNewlineReader(&countingReader{in, &r.bytes}, mode.Newlines)
+	return r
+}
+
+// countingReader counts the bytes read from in
+type countingReader struct {
+	in    io.Reader
+	count *uint64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.in.Read(p)
+	*r.count += uint64(n)
+	return n, err
+}
+
+// resume continues reading the input where the reader of the state stopped
+func (r *cellReader) resume(state *State) {
+	r.bytes = state.InputPos
+	if nr, ok := r.in.(*bfutils.NewlineReader); ok {
+		nr.SetState(state.LineEnding)
+	}
+}
+
+// lineEnding is the line ending the reader is in the middle of, for a snapshot
+func (r *cellReader) lineEnding() bfutils.NewlineState {
+	if nr, ok := r.in.(*bfutils.NewlineReader); ok {
+		return nr.State()
+	}
+	return bfutils.NewlineState{}
+}
+
+// read reads the value of one cell, which is a byte or a UTF-8 encoded code point.
+// It returns false if there is no more input.
+func (r *cellReader) read() (uint64, bool) {
+	var v uint64
+	var read []byte
+	if r.encoding == bfutils.EncodingUTF8 {
+		cp, data, err := bfutils.ReadUTF8(r.in)
+		if err != nil {
+			return 0, false
+		}
+		v, read = uint64(cp), data
+	} else {
+		if bfutils.ReadOneByte(r.in, r.buf) != nil {
+			return 0, false
+		}
+		v, read = uint64(r.buf[0]), r.buf
+	}
+
+	if r.obs != nil {
+		for _, b := range read {
+			r.obs.OnInput(b)
+		}
+	}
+	return v, true
+}
+
+// How many steps to run between checking if the context is canceled
+const cancelCheckInterval = 1 << 16
+
+func InterpretTokens(tokens []g.ParseToken, memorySize int, in bfutils.FileOrMemReader, out bfutils.FileOrMemWriter, wordSize int) Result {
+	return InterpretTokensWithOptions(tokens, memorySize, in, out, wordSize, Options{})
+}
+
+// ProfileTokens interprets the tokens like InterpretTokens, and returns a
+// profile of how many times each token and loop was executed
+func ProfileTokens(tokens []g.ParseToken, memorySize int, in bfutils.FileOrMemReader, out bfutils.FileOrMemWriter, wordSize int) *Profile {
+	prof := NewProfile(tokens)
+	InterpretTokensWithOptions(tokens, memorySize, in, out, wordSize, Options{Profile: prof})
+	return prof
+}
+
+func InterpretTokensWithOptions(tokens []g.ParseToken, memorySize int, in bfutils.FileOrMemReader, out bfutils.FileOrMemWriter, wordSize int, opts Options) Result {
+	if opts.Context == nil {
+		opts.Context = context.Background()
+	}
+	if err := bfutils.CheckTapeInit(opts.TapeInit, memorySize); err != nil {
+		return Result{Reason: ExitError, Err: err}
+	}
+
+	// Without any hooks nothing has to be done between the steps, which is a lot faster
+	if opts.Profile == nil && opts.Trace == nil && opts.Observer == nil && opts.Overflow == nil {
+		if wordSize == 8 {
+			return interpretTokensOfSize[uint8](tokens, memorySize, in, out, opts)
+		} else if wordSize == 16 {
+			return interpretTokensOfSize[uint16](tokens, memorySize, in, out, opts)
+		} else if wordSize == 32 {
+			return interpretTokensOfSize[uint32](tokens, memorySize, in, out, opts)
+		}
+	}
+
+	mem, err := newCells(tokens, memorySize, wordSize, opts)
+	if err != nil {
+		return Result{Reason: ExitError, Err: err}
+	}
+	return interpretTokensHooked(tokens, memorySize, mem, in, out, opts)
+}
+
+// jumpTargets finds where each jump token goes, indexed like the tokens. JMPF and BZ jump
+// to the end of their loop, and JMPB and LBL refer to the start of it.
+func jumpTargets(tokens []g.ParseToken) []int {
+	jumpLabels := compileJumps(tokens)
+	targets := make([]int, len(tokens))
+	for i, t := range tokens {
+		switch t.Tok.Tok {
+		case l.JMPF, l.BZ:
+			targets[i] = jumpLabels[t.Extra].To
+		case l.JMPB, l.LBL:
+			targets[i] = jumpLabels[t.Extra].From
+		}
+	}
+	return targets
+}
+
+// fitTape finds the cell addr refers to when it is outside of a tape of size cells. With
+// BoundsStrict the tape may grow up to limit cells, and the new size is returned, with
+// BoundsWrap the address wraps around the ends of the tape.
+func fitTape(addr, size, limit int, bounds BoundsMode) (int, int, bool) {
+	if bounds == BoundsWrap {
+		return ((addr % size) + size) % size, size, true
+	}
+	if addr < 0 || addr >= limit {
+		return addr, size, false
+	}
+	return addr, min(max(2*size, addr+1), limit), true
+}
+
+// fitCells is fitTape for a tape of fixed size cells, which is grown when needed
+func fitCells[S uint8 | uint16 | uint32](mem []S, addr, limit int, bounds BoundsMode) ([]S, int, bool) {
+	addr, size, ok := fitTape(addr, len(mem), limit, bounds)
+	if size > len(mem) {
+		mem = append(mem, make([]S, size-len(mem))...)
+	}
+	return mem, addr, ok
+}
+
+// loadCells makes the tape the program starts with, from opts.TapeInit or from the state it resumes
+func loadCells[S uint8 | uint16 | uint32](tokens []g.ParseToken, memorySize int, opts Options) ([]S, error) {
+	if opts.Resume != nil {
+		if err := opts.Resume.check(tokens, bits.Len64(uint64(^S(0)))); err != nil {
+			return nil, err
+		}
+		mem := make([]S, max(memorySize, len(opts.Resume.Tape)))
+		for addr, v := range opts.Resume.Tape {
+			mem[addr] = S(v)
+		}
+		return mem, nil
+	}
+
+	mem := make([]S, memorySize)
+	for _, init := range opts.TapeInit {
+		for j, b := range init.Data {
+			mem[init.Offset+j] = S(b)
+		}
+	}
+	return mem, nil
+}
+
+// signedValue is the value of a cell as a signed integer
+func signedValue[S uint8 | uint16 | uint32](v S) int64 {
+	wordSize := bits.Len64(uint64(^S(0)))
+	return int64(uint64(v)<<(64-wordSize)) >> (64 - wordSize)
+}
+
+// positionOf returns the position of the token at pc, or no position before the first step
+func positionOf(tokens []g.ParseToken, pc int) l.Position {
+	if pc < 0 {
+		return l.Position{}
+	}
+	return tokens[pc].Pos
+}
+
+// interpretTokensOfSize interprets the tokens when there are no hooks. The step limit and the
+// context are only checked when the number of steps reaches the next check, and the bounds
+// of the tape only when the pointer is outside of it.
+func interpretTokensOfSize[S uint8 | uint16 | uint32](tokens []g.ParseToken, memorySize int, in bfutils.FileOrMemReader, out bfutils.FileOrMemWriter, opts Options) Result {
+	mem, err := loadCells[S](tokens, memorySize, opts)
+	if err != nil {
+		return Result{Reason: ExitError, Err: err}
+	}
+	targets := jumpTargets(tokens)
+	limit := memorySize + opts.MaxTapeGrowth
+	output := &limitedOutput{out: out, max: opts.MaxOutputBytes}
+	input := newCellReader(in, opts.IO, nil)
+	encoding := opts.IO.Encoding
+
+	// last is the token executed last, for the position the interpreter stopped at
+	p, i, last := 0, 0, -1
+	var steps uint64
+	// written is how many times the OUT token at i has written its cell, if it was stopped in the middle
+	written := 0
+	if opts.Resume != nil {
+		p, i, steps, written = opts.Resume.Pointer, opts.Resume.PC, opts.Resume.Steps, opts.Resume.Written
+		input.resume(opts.Resume)
+	}
+
+	stepLimit := uint64(math.MaxUint64)
+	if opts.MaxSteps != 0 {
+		stepLimit = steps + opts.MaxSteps
+	}
+	nextCheck := steps
+
+	var result Result
+	var ok bool
+run:
+	for ; i < len(tokens); i++ {
+		if steps == nextCheck {
+			if steps == stepLimit {
+				result.Reason = ExitStepLimit
+				break run
+			}
+			if opts.Context.Err() != nil {
+				result.Reason = ExitCanceled
+				break run
 			}
+			nextCheck = min(stepLimit, steps+cancelCheckInterval)
+		}
+		steps++
+		last = i
+
+		t := &tokens[i]
+		switch t.Tok.Tok {
+		case l.ADD:
+			mem[p] += S(t.Extra)
+		case l.SUB:
+			mem[p] -= S(t.Extra)
+		case l.INCP:
+			// The pointer only moves to a cell on the tape, so that the state can be resumed
+			newp := p + t.Extra
+			if uint(newp) >= uint(len(mem)) {
+				if mem, newp, ok = fitCells(mem, newp, limit, opts.Bounds); !ok {
+					result = outOfBounds(newp, t.Pos)
+					break run
+				}
+			}
+			p = newp
+		case l.DECP:
+			newp := p - t.Extra
+			if uint(newp) >= uint(len(mem)) {
+				if mem, newp, ok = fitCells(mem, newp, limit, opts.Bounds); !ok {
+					result = outOfBounds(newp, t.Pos)
+					break run
+				}
+			}
+			p = newp
+		case l.OUT:
+			// After a resume, the writes done before the snapshot are skipped
+			for ; written < t.Extra; written++ {
+				if result.Reason, result.Err = output.writeCell(uint64(mem[p]), encoding); result.Reason != ExitCompleted {
+					break run
+				}
+			}
+			written = 0
+		case l.IN:
+			for j := 0; j < t.Extra; j++ {
+				v, ok := input.read()
+				if !ok {
+					switch opts.EOF {
+					case EOFZero:
+						v = 0
+					case EOFMinusOne:
+						v = uint64(^S(0))
+					default:
+						// Leave input as is
+						continue
+					}
+				}
+				mem[p] = S(v)
+			}
+		case l.JMPF, l.BZ:
+			if mem[p] == 0 {
+				i = targets[i]
+			}
+		case l.JMPB:
+			if mem[p] != 0 {
+				i = targets[i]
+			}
+		case l.MUL:
+			dst := p + t.Extra2
+			if uint(dst) >= uint(len(mem)) {
+				if mem, dst, ok = fitCells(mem, dst, limit, opts.Bounds); !ok {
+					result = outOfBounds(dst, t.Pos)
+					break run
+				}
+			}
+			mem[dst] += mem[p] * S(t.Extra)
+		case l.DIV:
+			dst := p + t.Extra2
+			if uint(dst) >= uint(len(mem)) {
+				if mem, dst, ok = fitCells(mem, dst, limit, opts.Bounds); !ok {
+					result = outOfBounds(dst, t.Pos)
+					break run
+				}
+			}
+			if opts.Signed {
+				mem[dst] = S(signedValue(mem[dst]) / int64(t.Extra))
+			} else {
+				mem[dst] /= S(t.Extra)
+			}
+		case l.MOV:
+			dst := p + t.Extra2
+			if uint(dst) >= uint(len(mem)) {
+				if mem, dst, ok = fitCells(mem, dst, limit, opts.Bounds); !ok {
+					result = outOfBounds(dst, t.Pos)
+					break run
+				}
+			}
+			mem[dst] = S(t.Extra)
+		case l.SCANL:
+			for mem[p] != 0 {
+				newp := p - 1
+				if newp < 0 {
+					if mem, newp, ok = fitCells(mem, newp, limit, opts.Bounds); !ok {
+						result = outOfBounds(newp, t.Pos)
+						break run
+					}
+				}
+				p = newp
+			}
+		case l.SCANR:
+			for mem[p] != 0 {
+				newp := p + 1
+				if newp >= len(mem) {
+					if mem, newp, ok = fitCells(mem, newp, limit, opts.Bounds); !ok {
+						result = outOfBounds(newp, t.Pos)
+						break run
+					}
+				}
+				p = newp
+			}
+		case l.PRNT:
+			// Output cells until a zero cell, like [.>]
+			for mem[p] != 0 {
+				if result.Reason, result.Err = output.writeCell(uint64(mem[p]), encoding); result.Reason != ExitCompleted {
+					break run
+				}
+				newp := p + 1
+				if newp >= len(mem) {
+					if mem, newp, ok = fitCells(mem, newp, limit, opts.Bounds); !ok {
+						result = outOfBounds(newp, t.Pos)
+						break run
+					}
+				}
+				p = newp
+			}
+		case l.LBL, l.NOP:
+			// Nothing to do
+		case l.EOF:
+			// End of program
+			break run
+
+		default:
+			result = Result{Reason: ExitError, Err: fmt.Errorf("unrecognized token %s at %d:%d", t.Tok.TokenName, t.Pos.Line, t.Pos.Column)}
+			break run
 		}
 	}
 
-	// Run program
-	p := 0
-	for i := 0; i < len(tokens); i++ {
-		t := tokens[i]
-		token := t.Tok.Tok
+	result.Steps = steps
+	result.Pos = positionOf(tokens, last)
+	if result.Reason != ExitTapeLimit && result.Reason != ExitOutOfBounds {
+		result.Pointer = p
+	}
+	result.State = newState(tokens, mem, p, i, steps, input.bytes)
+	result.State.LineEnding = input.lineEnding()
+	result.State.Written = written
+	if err := out.Flush(); err != nil && result.Err == nil {
+		result.Reason = ExitError
+		result.Err = err
+	}
+	return result
+}
+
+// interpretTokensHooked interprets the tokens like interpretTokensOfSize, and calls the hooks
+// of opts at every step. The cells do the arithmetic, so that it runs any kind of cells.
+func interpretTokensHooked(tokens []g.ParseToken, memorySize int, mem cells, in bfutils.FileOrMemReader, out bfutils.FileOrMemWriter, opts Options) Result {
+	prof := opts.Profile
+	trace := opts.Trace
+	obs := opts.Observer
+	ovf := opts.Overflow
+	targets := jumpTargets(tokens)
+	limit := memorySize + opts.MaxTapeGrowth
+	encoding := opts.IO.Encoding
+
+	if trace != nil {
+		trace.tape = func(addr int) uint64 {
+			if addr < 0 || addr >= mem.len() {
+				return 0
+			}
+			return mem.value(addr)
+		}
+	}
+
+	// Find the cell addr refers to for the token at pc, and record when it is below zero
+	address := func(pc, addr int) (int, bool) {
+		if ovf != nil && addr < 0 {
+			ovf.record(PointerUnderflow, pc)
+		}
+		if addr >= 0 && addr < mem.len() {
+			return addr, true
+		}
+		addr, size, ok := fitTape(addr, mem.len(), limit, opts.Bounds)
+		if size > mem.len() {
+			mem.grow(size)
+		}
+		return addr, ok
+	}
+
+	output := &limitedOutput{out: out, max: opts.MaxOutputBytes, obs: obs}
+	input := newCellReader(in, opts.IO, obs)
+
+	p, i, last := 0, 0, -1
+	var steps uint64
+	// written is how many times the OUT token at i has written its cell, if it was stopped in the middle
+	written := 0
+	if opts.Resume != nil {
+		p, i, steps, written = opts.Resume.Pointer, opts.Resume.PC, opts.Resume.Steps, opts.Resume.Written
+		input.resume(opts.Resume)
+	}
+	startSteps := steps
+
+	var result Result
+run:
+	for ; i < len(tokens); i++ {
+		t := &tokens[i]
 		value := t.Extra
 		pointer := t.Extra2
 
-		//fmt.Fprintf(os.Stderr, "%d Token: %v\n", i, t)
+		if opts.MaxSteps != 0 && steps-startSteps >= opts.MaxSteps {
+			result.Reason = ExitStepLimit
+			break run
+		}
+		if steps%cancelCheckInterval == 0 && opts.Context.Err() != nil {
+			result.Reason = ExitCanceled
+			break run
+		}
 
-		switch token {
+		steps++
+		last = i
+		if prof != nil {
+			prof.Steps++
+			prof.Counts[i]++
+		}
+		if obs != nil {
+			obs.OnStep(i, *t, p)
+		}
+		if ovf != nil {
+			ovf.hit = false
+		}
+
+		// The cell changed by the token, for the observer
+		changed := -1
+
+		switch t.Tok.Tok {
 		case l.ADD:
-			mem[p] += S(value)
+			result.Reason, result.Err = mem.add(i, p, int64(value))
+			changed = p
 		case l.SUB:
-			mem[p] -= S(value)
+			result.Reason, result.Err = mem.add(i, p, -int64(value))
+			changed = p
 		case l.INCP:
-			p += value
+			newp, ok := address(i, p+value)
+			if !ok {
+				result = outOfBounds(p+value, t.Pos)
+				break run
+			}
+			p = newp
 		case l.DECP:
-			p -= value
+			newp, ok := address(i, p-value)
+			if !ok {
+				result = outOfBounds(p-value, t.Pos)
+				break run
+			}
+			p = newp
 		case l.OUT:
-			//fmt.Fprintf(os.Stderr, "Output: %c %d\n", mem[p], mem[p])
-			for j := 0; j < value; j++ {
-				v := []byte{byte(mem[p])}
-				out.Write(v)
+			// After a resume, the writes done before the snapshot are skipped
+			v := mem.output(p, encoding)
+			for ; written < value; written++ {
+				if result.Reason, result.Err = output.writeCell(v, encoding); result.Reason != ExitCompleted {
+					break run
+				}
 			}
-			out.Flush()
+			written = 0
 		case l.IN:
-			v := make([]byte, 1)
 			for j := 0; j < value; j++ {
-				len, err := in.Read(v)
-				if err != nil || len == 0 {
-					// Leave input as is, which a lot of programs expect
+				v, ok := input.read()
+				if ok {
+					mem.input(p, v)
+				} else if opts.EOF != EOFUnchanged {
+					result.Reason, result.Err = mem.eof(i, p, opts.EOF)
 				} else {
-					mem[p] = S(v[0])
+					// Leave input as is
+					continue
+				}
+				if obs != nil {
+					obs.OnTapeWrite(p, mem.value(p))
+				}
+				if result.Reason != ExitCompleted {
+					break run
 				}
 			}
-		case l.JMPF:
-			if mem[p] == 0 {
-				i = jumpLabels[value].To
-				continue
+		case l.JMPF, l.BZ:
+			if mem.isZero(p) {
+				i = targets[i]
+				break
+			}
+			if prof != nil {
+				prof.enterLoop(i)
+			}
+			if obs != nil {
+				obs.OnLoopEnter(i)
 			}
 		case l.JMPB:
-			if mem[p] != 0 {
-				i = jumpLabels[value].From
-				continue
+			if !mem.isZero(p) {
+				i = targets[i]
+				if prof != nil {
+					prof.Iterations[i]++
+				}
+			} else if obs != nil {
+				obs.OnLoopExit(targets[i])
 			}
 		case l.MUL:
-			mem[p+pointer] += mem[p] * S(value)
+			dst, ok := address(i, p+pointer)
+			if !ok {
+				result = outOfBounds(p+pointer, t.Pos)
+				break run
+			}
+			result.Reason, result.Err = mem.mulAdd(i, dst, p, int64(value))
+			changed = dst
 		case l.DIV:
-			mem[p+pointer] /= S(value)
-
-		case l.BZ:
-			if mem[p] == 0 {
-				i = jumpLabels[value].To
-				continue
+			dst, ok := address(i, p+pointer)
+			if !ok {
+				result = outOfBounds(p+pointer, t.Pos)
+				break run
 			}
+			result.Reason, result.Err = mem.div(i, dst, int64(value))
+			changed = dst
 		case l.LBL:
-			continue
+			// Only a jump target, reached when a converted loop is done
+			if obs != nil {
+				obs.OnLoopExit(targets[i])
+			}
 
 		case l.MOV:
-			mem[p+pointer] = S(value)
+			dst, ok := address(i, p+pointer)
+			if !ok {
+				result = outOfBounds(p+pointer, t.Pos)
+				break run
+			}
+			result.Reason, result.Err = mem.set(i, dst, int64(value))
+			changed = dst
+
+		case l.SCANL, l.SCANR:
+			step := 1
+			if t.Tok.Tok == l.SCANL {
+				step = -1
+			}
+			for !mem.isZero(p) {
+				newp, ok := address(i, p+step)
+				if !ok {
+					result = outOfBounds(p+step, t.Pos)
+					break run
+				}
+				p = newp
+			}
+		case l.PRNT:
+			// Output cells until a zero cell, like [.>]
+			for !mem.isZero(p) {
+				if result.Reason, result.Err = output.writeCell(mem.output(p, encoding), encoding); result.Reason != ExitCompleted {
+					break run
+				}
+				newp, ok := address(i, p+1)
+				if !ok {
+					result = outOfBounds(p+1, t.Pos)
+					break run
+				}
+				p = newp
+			}
+		case l.NOP:
+			// Nothing to do
+		case l.EOF:
+			// End of program
+			break run
 
 		default:
-			fmt.Fprintf(os.Stderr, "Warning: Unrecognized token: %v!\n", t.Tok.TokenName)
+			result = Result{Reason: ExitError, Err: fmt.Errorf("unrecognized token %s at %d:%d", t.Tok.TokenName, t.Pos.Line, t.Pos.Column)}
+			break run
+		}
+
+		if changed >= 0 && obs != nil {
+			obs.OnTapeWrite(changed, mem.value(changed))
+		}
+		if result.Reason != ExitCompleted {
+			break run
+		}
+		if trace != nil {
+			trace.step(steps, *t, p)
+		}
+		if ovf != nil && ovf.hit && ovf.Fatal {
+			result.Reason = ExitOverflow
+			break run
 		}
 	}
 
+	result.Steps = steps
+	result.Pos = positionOf(tokens, last)
+	if result.Reason != ExitTapeLimit && result.Reason != ExitOutOfBounds {
+		result.Pointer = p
+	}
+	result.State = mem.state(tokens, p, i, steps, input.bytes)
+	result.State.LineEnding = input.lineEnding()
+	result.State.Written = written
+	if trace != nil {
+		trace.Flush()
+	}
+	if err := out.Flush(); err != nil && result.Err == nil {
+		result.Reason = ExitError
+		result.Err = err
+	}
+	return result
 }
@@ -0,0 +1,35 @@
+package interpreter
+
+import (
+	g "bcomp/generators"
+)
+
+// Observer is notified about what happens while the interpreter runs, for
+// embedding the interpreter in for example a visualizer or a debugger.
+// Register it with Options.Observer.
+type Observer interface {
+	// OnStep is called before each token is executed, pc is its index in the token stream
+	OnStep(pc int, t g.ParseToken, pointer int)
+	// OnOutput is called for every byte written to the output
+	OnOutput(value byte)
+	// OnInput is called for every byte read from the input
+	OnInput(value byte)
+	// OnLoopEnter is called when the body of a loop (JMPF) or converted loop (BZ)
+	// at index pc is entered
+	OnLoopEnter(pc int)
+	// OnLoopExit is called when the execution leaves the body of the loop at index pc
+	OnLoopExit(pc int)
+	// OnTapeWrite is called after a cell has been changed
+	OnTapeWrite(addr int, value uint64)
+}
+
+// NopObserver implements Observer by ignoring everything. Embed it to only
+// implement the callbacks you need.
+type NopObserver struct{}
+
+func (NopObserver) OnStep(pc int, t g.ParseToken, pointer int) {}
+func (NopObserver) OnOutput(value byte)                        {}
+func (NopObserver) OnInput(value byte)                         {}
+func (NopObserver) OnLoopEnter(pc int)                         {}
+func (NopObserver) OnLoopExit(pc int)                          {}
+func (NopObserver) OnTapeWrite(addr int, value uint64)         {}
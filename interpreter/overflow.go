@@ -0,0 +1,145 @@
+package interpreter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+
+	g "bcomp/generators"
+)
+
+// OverflowKind tells how a token went outside of the range of a cell or the tape
+type OverflowKind int
+
+const (
+	// A cell wrapped around from the highest value to 0
+	Overflow OverflowKind = iota
+	// A cell wrapped around from 0 to the highest value
+	Underflow
+	// The pointer moved below the start of the tape
+	PointerUnderflow
+)
+
+var overflowKinds = []string{
+	Overflow:         "overflow",
+	Underflow:        "underflow",
+	PointerUnderflow: "pointer below zero",
+}
+
+func (kind OverflowKind) String() string {
+	return overflowKinds[kind]
+}
+
+// Overflows collects every ADD, SUB, MUL or MOV that wrapped around the cell width,
+// and every pointer move below the start of the tape
+type Overflows struct {
+	tokens []g.ParseToken
+
+	// Stop the interpreter with ExitOverflow at the first overflow
+	Fatal bool
+	// Number of times each token overflowed, indexed by kind and then like the token stream
+	Counts [3][]uint64
+	// Set when the last executed token overflowed
+	hit bool
+}
+
+// OverflowCount is the number of times all tokens from one source position overflowed in the same way
+type OverflowCount struct {
+	Line   int
+	Column int
+	Token  string
+	Kind   OverflowKind
+	Count  uint64
+}
+
+func NewOverflows(tokens []g.ParseToken) *Overflows {
+	ovf := &Overflows{tokens: tokens}
+	for kind := range ovf.Counts {
+		ovf.Counts[kind] = make([]uint64, len(tokens))
+	}
+	return ovf
+}
+
+func (ovf *Overflows) record(kind OverflowKind, pc int) {
+	ovf.Counts[kind][pc]++
+	ovf.hit = true
+}
+
+// checkAdd records if adding delta to a cell with the value v goes outside of min..max
+func (ovf *Overflows) checkAdd(pc int, v int64, delta int64, min, max int64) {
+	ovf.checkSet(pc, v+delta, min, max)
+}
+
+// checkSet records if setting a cell to v goes outside of min..max
+func (ovf *Overflows) checkSet(pc int, v int64, min, max int64) {
+	if v < min {
+		ovf.record(Underflow, pc)
+	} else if v > max {
+		ovf.record(Overflow, pc)
+	}
+}
+
+// Total returns the number of overflows of all kinds
+func (ovf *Overflows) Total() uint64 {
+	var total uint64
+	for _, counts := range ovf.Counts {
+		for _, count := range counts {
+			total += count
+		}
+	}
+	return total
+}
+
+// Report aggregates the overflows back to the source positions they originated from,
+// sorted by position
+func (ovf *Overflows) Report() []OverflowCount {
+	type key struct {
+		pos  [2]int
+		kind OverflowKind
+	}
+	index := make(map[key]int)
+	report := make([]OverflowCount, 0)
+
+	for kind, counts := range ovf.Counts {
+		for pc, count := range counts {
+			if count == 0 {
+				continue
+			}
+			t := ovf.tokens[pc]
+			k := key{[2]int{t.Pos.Line, t.Pos.Column}, OverflowKind(kind)}
+			idx, ok := index[k]
+			if !ok {
+				idx = len(report)
+				index[k] = idx
+				report = append(report, OverflowCount{Line: t.Pos.Line, Column: t.Pos.Column, Token: t.Tok.TokenName, Kind: OverflowKind(kind)})
+			}
+			report[idx].Count += count
+		}
+	}
+
+	sort.Slice(report, func(a, b int) bool {
+		if report[a].Line != report[b].Line {
+			return report[a].Line < report[b].Line
+		}
+		if report[a].Column != report[b].Column {
+			return report[a].Column < report[b].Column
+		}
+		return report[a].Kind < report[b].Kind
+	})
+
+	return report
+}
+
+// WriteReport writes one line for each source position that overflowed
+func (ovf *Overflows) WriteReport(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	for _, oc := range ovf.Report() {
+		times := "times"
+		if oc.Count == 1 {
+			times = "time"
+		}
+		fmt.Fprintf(out, "%d:%d: %s %s %d %s\n", oc.Line, oc.Column, oc.Token, oc.Kind, oc.Count, times)
+	}
+	return out.Flush()
+}
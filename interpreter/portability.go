@@ -0,0 +1,171 @@
+package interpreter
+
+import (
+	"bytes"
+	"fmt"
+
+	"bcomp/bfutils"
+	g "bcomp/generators"
+	l "bcomp/lexer"
+)
+
+// Configuration is one combination of the interpreter settings brainfuck programs tend to depend on
+type Configuration struct {
+	WordSize int
+	EOF      EOFPolicy
+	Bounds   BoundsMode
+}
+
+func (c Configuration) String() string {
+	return fmt.Sprintf("-w %d -eof %s -bounds %s", c.WordSize, c.EOF, c.Bounds)
+}
+
+// Configurations returns every combination of cell size, EOF policy and bounds mode.
+// The first one is the default configuration of the interpreter.
+func Configurations() []Configuration {
+	configs := make([]Configuration, 0)
+	for _, wordSize := range []int{8, 16, 32} {
+		for eof := range eofPolicies {
+			for bounds := range boundsModes {
+				configs = append(configs, Configuration{wordSize, EOFPolicy(eof), BoundsMode(bounds)})
+			}
+		}
+	}
+	return configs
+}
+
+// PortabilityResult is the outcome of running a program in one configuration, compared to the first configuration
+type PortabilityResult struct {
+	Config Configuration
+	Result Result
+	Output []byte
+	// The output or the exit reason is not the same as in the first configuration
+	Diverges bool
+	// A cell got a different value than in the first configuration
+	CellsDiffer bool
+	// Where the first different cell value was written, and at which step
+	FirstDifference l.Position
+	Step            uint64
+}
+
+// Maximum number of changes to the tape recorded from the first configuration,
+// changes after this are not compared
+const maxRecordedWrites = 1 << 20
+
+type tapeWrite struct {
+	pc    int
+	addr  int
+	value uint64
+}
+
+// writeRecorder records the changes to the tape done by the first configuration
+type writeRecorder struct {
+	NopObserver
+	pc     int
+	writes []tapeWrite
+}
+
+func (r *writeRecorder) OnStep(pc int, t g.ParseToken, pointer int) {
+	r.pc = pc
+}
+
+func (r *writeRecorder) OnTapeWrite(addr int, value uint64) {
+	if len(r.writes) < maxRecordedWrites {
+		r.writes = append(r.writes, tapeWrite{r.pc, addr, value})
+	}
+}
+
+// writeComparer compares the changes to the tape with the ones recorded from the first configuration
+type writeComparer struct {
+	NopObserver
+	baseline  []tapeWrite
+	tokens    []g.ParseToken
+	pc        int
+	step      uint64
+	n         int
+	differ    bool
+	diffPos   l.Position
+	diffStep  uint64
+	truncated bool
+}
+
+func (c *writeComparer) OnStep(pc int, t g.ParseToken, pointer int) {
+	c.pc = pc
+	c.step++
+}
+
+func (c *writeComparer) OnTapeWrite(addr int, value uint64) {
+	if c.differ {
+		return
+	}
+	if c.n >= len(c.baseline) {
+		if !c.truncated {
+			c.found(c.pc, c.step)
+		}
+		return
+	}
+	if w := c.baseline[c.n]; w.pc != c.pc || w.addr != addr || w.value != value {
+		c.found(c.pc, c.step)
+	}
+	c.n++
+}
+
+func (c *writeComparer) found(pc int, step uint64) {
+	c.differ = true
+	c.diffPos = c.tokens[pc].Pos
+	c.diffStep = step
+}
+
+// CheckPortability runs the tokens with the given input in every configuration, and compares
+// the output, exit reason and changes to the tape with the first configuration.
+// Limits and context are taken from opts.
+func CheckPortability(tokens []g.ParseToken, memorySize int, input []byte, opts Options) []PortabilityResult {
+	configs := Configurations()
+	results := make([]PortabilityResult, 0, len(configs))
+
+	var baseline *writeRecorder
+	for n, config := range configs {
+		runOpts := Options{
+			Context:        opts.Context,
+			MaxSteps:       opts.MaxSteps,
+			MaxOutputBytes: opts.MaxOutputBytes,
+			MaxTapeGrowth:  opts.MaxTapeGrowth,
+			Signed:         opts.Signed,
+			IO:             opts.IO,
+			TapeInit:       opts.TapeInit,
+			EOF:            config.EOF,
+			Bounds:         config.Bounds,
+		}
+
+		var comparer *writeComparer
+		if n == 0 {
+			baseline = &writeRecorder{}
+			runOpts.Observer = baseline
+		} else {
+			comparer = &writeComparer{
+				baseline:  baseline.writes,
+				tokens:    tokens,
+				truncated: len(baseline.writes) >= maxRecordedWrites,
+			}
+			runOpts.Observer = comparer
+		}
+
+		out := bytes.NewBuffer([]byte{})
+		result := InterpretTokensWithOptions(tokens, memorySize, bytes.NewReader(input), bfutils.WrapBuffer(out), config.WordSize, runOpts)
+		pr := PortabilityResult{Config: config, Result: result, Output: out.Bytes()}
+
+		if comparer != nil {
+			pr.Diverges = result.Reason != results[0].Result.Reason || !bytes.Equal(pr.Output, results[0].Output)
+			if comparer.differ {
+				pr.CellsDiffer, pr.FirstDifference, pr.Step = true, comparer.diffPos, comparer.diffStep
+			} else if comparer.n < len(baseline.writes) {
+				// This configuration stopped changing the tape before the first one did
+				w := baseline.writes[comparer.n]
+				pr.CellsDiffer, pr.FirstDifference, pr.Step = true, tokens[w.pc].Pos, comparer.step
+			}
+		}
+		results = append(results, pr)
+	}
+
+	return results
+}
@@ -0,0 +1,220 @@
+package interpreter
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	g "bcomp/generators"
+	l "bcomp/lexer"
+)
+
+// Minimal protocol buffer encoder, just enough to write the pprof profile format
+// described in https://github.com/google/pprof/blob/main/proto/profile.proto
+type protobuf struct {
+	data []byte
+}
+
+func (b *protobuf) varint(v uint64) {
+	for v >= 0x80 {
+		b.data = append(b.data, byte(v)|0x80)
+		v >>= 7
+	}
+	b.data = append(b.data, byte(v))
+}
+
+func (b *protobuf) uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.varint(uint64(field) << 3)
+	b.varint(v)
+}
+
+func (b *protobuf) int64(field int, v int64) {
+	b.uint64(field, uint64(v))
+}
+
+func (b *protobuf) bytes(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+func (b *protobuf) message(field int, msg *protobuf) {
+	b.bytes(field, msg.data)
+}
+
+func (b *protobuf) packed(field int, values []uint64) {
+	var msg protobuf
+	for _, v := range values {
+		msg.varint(v)
+	}
+	b.bytes(field, msg.data)
+}
+
+// pprof message field numbers
+const (
+	pprofSampleType    = 1
+	pprofSample        = 2
+	pprofLocation      = 4
+	pprofFunction      = 5
+	pprofStringTable   = 6
+	pprofPeriodType    = 11
+	pprofPeriod        = 12
+	pprofDefaultSample = 14
+
+	pprofValueTypeType = 1
+	pprofValueTypeUnit = 2
+
+	pprofSampleLocation = 1
+	pprofSampleValue    = 2
+
+	pprofLocationId   = 1
+	pprofLocationLine = 4
+
+	pprofLineFunction = 1
+	pprofLineLine     = 2
+	pprofLineColumn   = 3
+
+	pprofFunctionId         = 1
+	pprofFunctionName       = 2
+	pprofFunctionSystemName = 3
+	pprofFunctionFilename   = 4
+	pprofFunctionStartLine  = 5
+)
+
+type pprofWriter struct {
+	profile   protobuf
+	strings   map[string]int64
+	functions map[int]uint64
+	locations map[[2]int]uint64
+	filename  string
+	tokens    []g.ParseToken
+}
+
+func (w *pprofWriter) str(s string) int64 {
+	idx, ok := w.strings[s]
+	if !ok {
+		idx = int64(len(w.strings))
+		w.strings[s] = idx
+		w.profile.bytes(pprofStringTable, []byte(s))
+	}
+	return idx
+}
+
+// Every loop in the source is represented as a function, so that pprof can show
+// how the steps are distributed between nested loops. Index -1 is the top level.
+func (w *pprofWriter) function(loop int) uint64 {
+	id, ok := w.functions[loop]
+	if ok {
+		return id
+	}
+
+	name := "main"
+	line := 1
+	if loop >= 0 {
+		t := w.tokens[loop]
+		line = t.Pos.Line
+		name = fmt.Sprintf("loop@%d:%d", t.Pos.Line, t.Pos.Column)
+		if t.Tok.Tok == l.BZ {
+			name += " (converted)"
+		}
+	}
+
+	id = uint64(len(w.functions) + 1)
+	w.functions[loop] = id
+
+	var fn protobuf
+	fn.uint64(pprofFunctionId, id)
+	fn.int64(pprofFunctionName, w.str(name))
+	fn.int64(pprofFunctionSystemName, w.str(name))
+	fn.int64(pprofFunctionFilename, w.str(w.filename))
+	fn.int64(pprofFunctionStartLine, int64(line))
+	w.profile.message(pprofFunction, &fn)
+
+	return id
+}
+
+// A location is the position of a token inside the loop (function) containing it
+func (w *pprofWriter) location(token int, loop int) uint64 {
+	key := [2]int{token, loop}
+	id, ok := w.locations[key]
+	if ok {
+		return id
+	}
+
+	fn := w.function(loop)
+	id = uint64(len(w.locations) + 1)
+	w.locations[key] = id
+
+	t := w.tokens[token]
+	var line protobuf
+	line.uint64(pprofLineFunction, fn)
+	line.int64(pprofLineLine, int64(t.Pos.Line))
+	line.int64(pprofLineColumn, int64(t.Pos.Column))
+
+	var loc protobuf
+	loc.uint64(pprofLocationId, id)
+	loc.message(pprofLocationLine, &line)
+	w.profile.message(pprofLocation, &loc)
+
+	return id
+}
+
+func valueType(w *pprofWriter, typ, unit string) *protobuf {
+	var vt protobuf
+	vt.int64(pprofValueTypeType, w.str(typ))
+	vt.int64(pprofValueTypeUnit, w.str(unit))
+	return &vt
+}
+
+// WritePprof writes the profile in the gzipped protocol buffer format read by `go tool pprof`.
+// Each loop is presented as a function, with the enclosing loops as its callers.
+func (prof *Profile) WritePprof(out io.Writer, filename string) error {
+	w := &pprofWriter{
+		strings:   make(map[string]int64),
+		functions: make(map[int]uint64),
+		locations: make(map[[2]int]uint64),
+		filename:  filename,
+		tokens:    prof.tokens,
+	}
+	w.str("")
+
+	w.profile.message(pprofSampleType, valueType(w, "steps", "count"))
+	w.profile.message(pprofPeriodType, valueType(w, "steps", "count"))
+	w.profile.int64(pprofPeriod, 1)
+	w.profile.int64(pprofDefaultSample, w.str("steps"))
+
+	// Stack of the loops enclosing the current token
+	loops := []int{-1}
+	for i, t := range prof.tokens {
+		if t.Tok.Tok == l.JMPB || t.Tok.Tok == l.LBL {
+			if len(loops) > 1 {
+				loops = loops[:len(loops)-1]
+			}
+		}
+
+		if prof.Counts[i] > 0 {
+			stack := []uint64{w.location(i, loops[len(loops)-1])}
+			for j := len(loops) - 1; j > 0; j-- {
+				stack = append(stack, w.location(loops[j], loops[j-1]))
+			}
+
+			var sample protobuf
+			sample.packed(pprofSampleLocation, stack)
+			sample.packed(pprofSampleValue, []uint64{prof.Counts[i]})
+			w.profile.message(pprofSample, &sample)
+		}
+
+		if t.Tok.Tok == l.JMPF || t.Tok.Tok == l.BZ {
+			loops = append(loops, i)
+		}
+	}
+
+	gz := gzip.NewWriter(out)
+	if _, err := gz.Write(w.profile.data); err != nil {
+		return err
+	}
+	return gz.Close()
+}
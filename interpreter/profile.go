@@ -0,0 +1,199 @@
+package interpreter
+
+import (
+	g "bcomp/generators"
+	l "bcomp/lexer"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Profile holds execution counts collected while interpreting a token stream
+type Profile struct {
+	tokens []g.ParseToken
+
+	// Total number of tokens executed
+	Steps uint64
+	// Number of times each token was executed, indexed like the token stream
+	Counts []uint64
+	// Number of times each loop (JMPF) or converted loop (BZ) was entered
+	Entries []uint64
+	// Number of times the body of each loop was run
+	Iterations []uint64
+}
+
+// PositionCount is the number of executions of all tokens originating from one source position
+type PositionCount struct {
+	Line   int      `json:"line"`
+	Column int      `json:"column"`
+	Tokens []string `json:"tokens"`
+	Count  uint64   `json:"count"`
+}
+
+// LoopCount holds the entry and iteration counts of a loop in the source
+type LoopCount struct {
+	Line       int    `json:"line"`
+	Column     int    `json:"column"`
+	Converted  bool   `json:"converted"`
+	Entries    uint64 `json:"entries"`
+	Iterations uint64 `json:"iterations"`
+}
+
+func NewProfile(tokens []g.ParseToken) *Profile {
+	return &Profile{
+		tokens:     tokens,
+		Counts:     make([]uint64, len(tokens)),
+		Entries:    make([]uint64, len(tokens)),
+		Iterations: make([]uint64, len(tokens)),
+	}
+}
+
+func (prof *Profile) enterLoop(i int) {
+	prof.Entries[i]++
+	prof.Iterations[i]++
+}
+
+// Positions aggregates the token counts back to the source positions they originated from
+func (prof *Profile) Positions() []PositionCount {
+	index := make(map[l.Position]int)
+	positions := make([]PositionCount, 0)
+
+	for i, t := range prof.tokens {
+		idx, ok := index[t.Pos]
+		if !ok {
+			idx = len(positions)
+			index[t.Pos] = idx
+			positions = append(positions, PositionCount{Line: t.Pos.Line, Column: t.Pos.Column, Tokens: []string{}})
+		}
+
+		pc := &positions[idx]
+		pc.Count += prof.Counts[i]
+		found := false
+		for _, name := range pc.Tokens {
+			if name == t.Tok.TokenName {
+				found = true
+				break
+			}
+		}
+		if !found {
+			pc.Tokens = append(pc.Tokens, t.Tok.TokenName)
+		}
+	}
+
+	sort.Slice(positions, func(a, b int) bool {
+		if positions[a].Line != positions[b].Line {
+			return positions[a].Line < positions[b].Line
+		}
+		return positions[a].Column < positions[b].Column
+	})
+
+	return positions
+}
+
+// Loops returns the counts of every loop that is still present in the token stream,
+// sorted with the most iterated loops first. Loops the optimizer has turned into
+// multiplications are marked as converted.
+func (prof *Profile) Loops() []LoopCount {
+	loops := make([]LoopCount, 0)
+	for i, t := range prof.tokens {
+		if t.Tok.Tok != l.JMPF && t.Tok.Tok != l.BZ {
+			continue
+		}
+		loops = append(loops, LoopCount{
+			Line:       t.Pos.Line,
+			Column:     t.Pos.Column,
+			Converted:  t.Tok.Tok == l.BZ,
+			Entries:    prof.Entries[i],
+			Iterations: prof.Iterations[i],
+		})
+	}
+
+	sort.SliceStable(loops, func(a, b int) bool {
+		return loops[a].Iterations > loops[b].Iterations
+	})
+
+	return loops
+}
+
+// WriteJSON writes the profile as a JSON document
+func (prof *Profile) WriteJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(struct {
+		Steps     uint64          `json:"steps"`
+		Positions []PositionCount `json:"positions"`
+		Loops     []LoopCount     `json:"loops"`
+	}{prof.Steps, prof.Positions(), prof.Loops()}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+var heatLevels = []rune(" .:-=+*#%@")
+
+func heat(count, max uint64) rune {
+	if count == 0 || max == 0 {
+		return heatLevels[0]
+	}
+	// Use a logarithmic scale, as loop counts quickly grow by orders of magnitude
+	level := 1 + int(math.Log(float64(count))/math.Log(float64(max)+1)*float64(len(heatLevels)-1))
+	if level >= len(heatLevels) {
+		level = len(heatLevels) - 1
+	}
+	return heatLevels[level]
+}
+
+// WriteListing writes the brainfuck source annotated with the execution count of each line,
+// and a heat map line under each source line showing which instructions are the hottest
+func (prof *Profile) WriteListing(w io.Writer, source []byte) error {
+	counts := make(map[l.Position]uint64)
+	lineCounts := make(map[int]uint64)
+	var max uint64
+	for _, pc := range prof.Positions() {
+		counts[l.Position{Line: pc.Line, Column: pc.Column}] = pc.Count
+		lineCounts[pc.Line] += pc.Count
+		if pc.Count > max {
+			max = pc.Count
+		}
+	}
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "Total steps: %d\n\n", prof.Steps)
+
+	scanner := bufio.NewScanner(bytes.NewReader(source))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(source)+1)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := []rune(scanner.Text())
+		fmt.Fprintf(out, "%12d | %s\n", lineCounts[line], string(text))
+
+		heatmap := make([]rune, len(text))
+		hot := false
+		for col := range text {
+			heatmap[col] = heat(counts[l.Position{Line: line, Column: col + 1}], max)
+			if heatmap[col] != heatLevels[0] {
+				hot = true
+			}
+		}
+		if hot {
+			fmt.Fprintf(out, "%12s | %s\n", "", strings.TrimRight(string(heatmap), " "))
+		}
+	}
+
+	fmt.Fprintln(out, "\nLoops not converted by the optimizer:")
+	for _, loop := range prof.Loops() {
+		if loop.Converted || loop.Iterations == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "  %d:%d: %d iterations in %d entries\n", loop.Line, loop.Column, loop.Iterations, loop.Entries)
+	}
+
+	return out.Flush()
+}
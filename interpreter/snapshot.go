@@ -0,0 +1,291 @@
+package interpreter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"math/bits"
+
+	"bcomp/bfutils"
+	g "bcomp/generators"
+	l "bcomp/lexer"
+)
+
+// State is a snapshot of a stopped interpreter, which can be resumed later with Options.Resume
+type State struct {
+	// 8, 16, 32 or WordSizeBig
+	WordSize int
+	// Hash of the token stream the state belongs to
+	Program uint64
+	// Index of the next token to execute
+	PC int
+	// How many times the OUT token at PC already wrote its cell, when the output stopped in the middle
+	Written int
+	Pointer int
+	// Number of bytes read from the input
+	InputPos uint64
+	// The line ending the input stopped in the middle of, with translated line endings
+	LineEnding bfutils.NewlineState
+	Steps      uint64
+	Tape       []uint64
+	// The cells with WordSizeBig, instead of Tape
+	BigTape []*big.Int
+}
+
+// Snapshot file format:
+//
+//	magic       "BFSNAP"
+//	version     uint16
+//	word size   uint8
+//	program     uint64
+//	pc          uint64
+//	written     uint64
+//	pointer     int64
+//	input pos   uint64
+//	line ending uint8, bit 0 is AfterCR and bit 1 PendingLF
+//	steps       uint64
+//	tape length uint64
+//	tape        tape length cells of word size bits
+//
+// With arbitrary precision cells the word size is 0, and each cell is a sign
+// byte, which is 1 for negative values, a uint64 length and the magnitude of
+// the cell in length bytes, big endian like big.Int.Bytes.
+//
+// All numbers are little endian.
+const (
+	snapshotMagic   = "BFSNAP"
+	snapshotVersion = 2
+)
+
+// ProgramHash identifies a token stream, so that a state is not resumed with another program
+func ProgramHash(tokens []g.ParseToken) uint64 {
+	h := fnv.New64a()
+	for _, t := range tokens {
+		binary.Write(h, binary.LittleEndian, [3]int64{int64(t.Tok.Tok), int64(t.Extra), int64(t.Extra2)})
+	}
+	return h.Sum64()
+}
+
+func newState[S uint8 | uint16 | uint32](tokens []g.ParseToken, mem []S, p, pc int, steps, inputPos uint64) *State {
+	tape := make([]uint64, len(mem))
+	for addr, v := range mem {
+		tape[addr] = uint64(v)
+	}
+
+	return &State{
+		WordSize: bits.Len64(uint64(^S(0))),
+		Program:  ProgramHash(tokens),
+		PC:       pc,
+		Pointer:  p,
+		InputPos: inputPos,
+		Steps:    steps,
+		Tape:     tape,
+	}
+}
+
+// tapeLen is the number of cells in the state
+func (s *State) tapeLen() int {
+	if s.WordSize == WordSizeBig {
+		return len(s.BigTape)
+	}
+	return len(s.Tape)
+}
+
+// cellSize describes the cells of a word size in an error
+func cellSize(wordSize int) string {
+	if wordSize == WordSizeBig {
+		return "arbitrary precision cells"
+	}
+	return fmt.Sprintf("%d bit cells", wordSize)
+}
+
+func (s *State) check(tokens []g.ParseToken, wordSize int) error {
+	if s.WordSize != wordSize {
+		return fmt.Errorf("state was saved with %s, not %s", cellSize(s.WordSize), cellSize(wordSize))
+	}
+	if s.Program != ProgramHash(tokens) {
+		return errors.New("state was saved from another program, or with other optimization options")
+	}
+	if s.PC < 0 || s.PC > len(tokens) || s.Pointer < 0 || s.Pointer >= max(s.tapeLen(), 1) {
+		return errors.New("state is corrupt")
+	}
+	if s.Written != 0 && (s.Written < 0 || s.PC == len(tokens) || tokens[s.PC].Tok.Tok != l.OUT || s.Written >= tokens[s.PC].Extra) {
+		return errors.New("state is corrupt")
+	}
+	return nil
+}
+
+// MarshalBinary encodes the state in the snapshot file format
+func (s *State) MarshalBinary() ([]byte, error) {
+	if s.WordSize != 8 && s.WordSize != 16 && s.WordSize != 32 && s.WordSize != WordSizeBig {
+		return nil, fmt.Errorf("unknown word size %d", s.WordSize)
+	}
+
+	buf := bytes.NewBufferString(snapshotMagic)
+	binary.Write(buf, binary.LittleEndian, uint16(snapshotVersion))
+	binary.Write(buf, binary.LittleEndian, uint8(max(s.WordSize, 0)))
+	binary.Write(buf, binary.LittleEndian, []uint64{s.Program, uint64(s.PC), uint64(s.Written)})
+	binary.Write(buf, binary.LittleEndian, int64(s.Pointer))
+	binary.Write(buf, binary.LittleEndian, s.InputPos)
+	binary.Write(buf, binary.LittleEndian, lineEndingFlags(s.LineEnding))
+	binary.Write(buf, binary.LittleEndian, []uint64{s.Steps, uint64(s.tapeLen())})
+
+	for _, v := range s.BigTape {
+		sign := uint8(0)
+		if v.Sign() < 0 {
+			sign = 1
+		}
+		magnitude := v.Bytes()
+		buf.WriteByte(sign)
+		binary.Write(buf, binary.LittleEndian, uint64(len(magnitude)))
+		buf.Write(magnitude)
+	}
+
+	for _, v := range s.Tape {
+		switch s.WordSize {
+		case 8:
+			buf.WriteByte(uint8(v))
+		case 16:
+			binary.Write(buf, binary.LittleEndian, uint16(v))
+		case 32:
+			binary.Write(buf, binary.LittleEndian, uint32(v))
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a state in the snapshot file format
+func (s *State) UnmarshalBinary(data []byte) error {
+	buf := bytes.NewReader(data)
+
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := buf.Read(magic); err != nil || string(magic) != snapshotMagic {
+		return errors.New("not a snapshot file")
+	}
+
+	var header struct {
+		Version    uint16
+		WordSize   uint8
+		Program    uint64
+		PC         uint64
+		Written    uint64
+		Pointer    int64
+		InputPos   uint64
+		LineEnding uint8
+		Steps      uint64
+		TapeLen    uint64
+	}
+	if err := binary.Read(buf, binary.LittleEndian, &header); err != nil {
+		return fmt.Errorf("reading snapshot header: %w", err)
+	}
+	if header.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+	lineEnding := bfutils.NewlineState{AfterCR: header.LineEnding&1 != 0, PendingLF: header.LineEnding&2 != 0}
+	if header.WordSize == 0 {
+		tape, err := readBigTape(buf, header.TapeLen)
+		if err != nil {
+			return err
+		}
+		*s = State{
+			WordSize:   WordSizeBig,
+			Program:    header.Program,
+			PC:         int(header.PC),
+			Written:    int(header.Written),
+			Pointer:    int(header.Pointer),
+			InputPos:   header.InputPos,
+			LineEnding: lineEnding,
+			Steps:      header.Steps,
+			BigTape:    tape,
+		}
+		return nil
+	}
+	if header.WordSize != 8 && header.WordSize != 16 && header.WordSize != 32 {
+		return fmt.Errorf("unknown word size %d", header.WordSize)
+	}
+	cellBytes := uint64(header.WordSize / 8)
+	// Dividing the rest of the data instead of multiplying the length can't overflow
+	if header.TapeLen != uint64(buf.Len())/cellBytes || uint64(buf.Len())%cellBytes != 0 {
+		return errors.New("snapshot tape is truncated")
+	}
+
+	var tape []uint64
+	switch header.WordSize {
+	case 8:
+		tape = readTape[uint8](buf, header.TapeLen)
+	case 16:
+		tape = readTape[uint16](buf, header.TapeLen)
+	case 32:
+		tape = readTape[uint32](buf, header.TapeLen)
+	}
+
+	*s = State{
+		WordSize:   int(header.WordSize),
+		Program:    header.Program,
+		PC:         int(header.PC),
+		Written:    int(header.Written),
+		Pointer:    int(header.Pointer),
+		InputPos:   header.InputPos,
+		LineEnding: lineEnding,
+		Steps:      header.Steps,
+		Tape:       tape,
+	}
+	return nil
+}
+
+// readTape decodes the cells of a snapshot, which the caller checked to be long enough
+func readTape[S uint8 | uint16 | uint32](buf *bytes.Reader, tapeLen uint64) []uint64 {
+	cells := make([]S, tapeLen)
+	binary.Read(buf, binary.LittleEndian, cells)
+
+	tape := make([]uint64, len(cells))
+	for addr, v := range cells {
+		tape[addr] = uint64(v)
+	}
+	return tape
+}
+
+// lineEndingFlags packs the line ending state in a byte of the snapshot
+func lineEndingFlags(state bfutils.NewlineState) uint8 {
+	var flags uint8
+	if state.AfterCR {
+		flags |= 1
+	}
+	if state.PendingLF {
+		flags |= 2
+	}
+	return flags
+}
+
+// readBigTape decodes the arbitrary precision cells of a snapshot
+func readBigTape(buf *bytes.Reader, tapeLen uint64) ([]*big.Int, error) {
+	// Every cell takes at least 9 bytes, which keeps a corrupt length from allocating too much
+	if tapeLen > uint64(buf.Len())/9 {
+		return nil, errors.New("snapshot tape is truncated")
+	}
+
+	tape := make([]*big.Int, tapeLen)
+	for addr := range tape {
+		var cell struct {
+			Sign   uint8
+			Length uint64
+		}
+		if err := binary.Read(buf, binary.LittleEndian, &cell); err != nil || cell.Length > uint64(buf.Len()) {
+			return nil, errors.New("snapshot tape is truncated")
+		}
+		magnitude := make([]byte, cell.Length)
+		buf.Read(magnitude)
+		tape[addr] = new(big.Int).SetBytes(magnitude)
+		if cell.Sign != 0 {
+			tape[addr].Neg(tape[addr])
+		}
+	}
+	if buf.Len() != 0 {
+		return nil, errors.New("snapshot has data after the tape")
+	}
+	return tape, nil
+}
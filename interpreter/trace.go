@@ -0,0 +1,179 @@
+package interpreter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	g "bcomp/generators"
+	l "bcomp/lexer"
+)
+
+// TracePoint is either a step number or a source position where tracing starts or stops
+type TracePoint struct {
+	Step uint64
+	Pos  l.Position
+}
+
+// ParseTracePoint parses a step number like "1000", or a source position like "12:5"
+func ParseTracePoint(s string) (TracePoint, error) {
+	if line, column, ok := strings.Cut(s, ":"); ok {
+		lineNo, err := strconv.Atoi(line)
+		if err != nil {
+			return TracePoint{}, fmt.Errorf("invalid line in position %q", s)
+		}
+		columnNo, err := strconv.Atoi(column)
+		if err != nil {
+			return TracePoint{}, fmt.Errorf("invalid column in position %q", s)
+		}
+		return TracePoint{Pos: l.Position{Line: lineNo, Column: columnNo}}, nil
+	}
+
+	step, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return TracePoint{}, fmt.Errorf("invalid step number %q", s)
+	}
+	return TracePoint{Step: step}, nil
+}
+
+func (tp TracePoint) isZero() bool {
+	return tp == TracePoint{}
+}
+
+func (tp TracePoint) matches(step uint64, t g.ParseToken) bool {
+	if tp.Step != 0 {
+		return step >= tp.Step
+	}
+	return t.Pos == tp.Pos
+}
+
+// TraceStep is a single step in a trace, with the state after the token was executed
+type TraceStep struct {
+	Step    uint64 `json:"step"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Token   string `json:"token"`
+	Pointer int    `json:"pointer"`
+	Cell    int    `json:"cell"`
+	Value   uint64 `json:"value"`
+}
+
+type TraceFormat int
+
+const (
+	TraceJSONLines TraceFormat = iota
+	TraceAsciicast
+)
+
+// Size of the terminal used for asciicast animations
+const (
+	castWidth  = 80
+	castHeight = 8
+	castCells  = 12
+	castFPS    = 10
+)
+
+// Tracer writes every executed step between Start and Stop to a writer
+type Tracer struct {
+	Format TraceFormat
+	// Start tracing at this step or position, the zero value starts at the beginning
+	Start TracePoint
+	// Stop tracing after this step or position, the zero value traces until the program ends
+	Stop TracePoint
+
+	out     *bufio.Writer
+	tape    func(addr int) uint64
+	started bool
+	stopped bool
+	frames  int
+}
+
+func NewTracer(w io.Writer, format TraceFormat) *Tracer {
+	return &Tracer{Format: format, out: bufio.NewWriter(w)}
+}
+
+func (tr *Tracer) step(step uint64, t g.ParseToken, p int) {
+	if tr.stopped {
+		return
+	}
+	if !tr.started {
+		if !tr.Start.isZero() && !tr.Start.matches(step, t) {
+			return
+		}
+		tr.started = true
+	}
+
+	// MUL, DIV and MOV operate on a cell relative to the pointer
+	cell := p
+	switch t.Tok.Tok {
+	case l.MUL, l.DIV, l.MOV:
+		cell += t.Extra2
+	}
+
+	ts := TraceStep{
+		Step:    step,
+		Line:    t.Pos.Line,
+		Column:  t.Pos.Column,
+		Token:   t.Tok.TokenName,
+		Pointer: p,
+		Cell:    cell,
+		Value:   tr.tape(cell),
+	}
+
+	if tr.Format == TraceAsciicast {
+		tr.writeFrame(ts, p)
+	} else {
+		data, _ := json.Marshal(ts)
+		tr.out.Write(append(data, '\n'))
+	}
+
+	if !tr.Stop.isZero() && tr.Stop.matches(step, t) {
+		tr.stopped = true
+	}
+}
+
+// writeFrame draws the tape around the pointer as one frame of an asciicast v2 animation
+func (tr *Tracer) writeFrame(ts TraceStep, p int) {
+	if tr.frames == 0 {
+		header, _ := json.Marshal(struct {
+			Version int `json:"version"`
+			Width   int `json:"width"`
+			Height  int `json:"height"`
+		}{2, castWidth, castHeight})
+		tr.out.Write(append(header, '\n'))
+	}
+
+	first := max(0, p-castCells/2)
+
+	var frame strings.Builder
+	// Clear the screen and move to the top left corner
+	frame.WriteString("\x1b[2J\x1b[H")
+	fmt.Fprintf(&frame, "step %-10d %d:%d %s\r\n\r\n", ts.Step, ts.Line, ts.Column, ts.Token)
+
+	border := "+" + strings.Repeat("-----+", castCells)
+	frame.WriteString(border + "\r\n|")
+	for addr := first; addr < first+castCells; addr++ {
+		fmt.Fprintf(&frame, "%5d|", tr.tape(addr))
+	}
+	frame.WriteString("\r\n" + border + "\r\n")
+	for addr := first; addr < first+castCells; addr++ {
+		if addr == p {
+			frame.WriteString("   ^  ")
+		} else {
+			frame.WriteString("      ")
+		}
+	}
+	fmt.Fprintf(&frame, "\r\np = %d\r\n", p)
+
+	event, _ := json.Marshal([]interface{}{float64(tr.frames) / castFPS, "o", frame.String()})
+	tr.out.Write(append(event, '\n'))
+	tr.frames++
+}
+
+// Flush writes any buffered trace output
+func (tr *Tracer) Flush() error {
+	return tr.out.Flush()
+}
@@ -61,6 +61,20 @@ var tokens = []string{
 	PRNT:  "PRNT",
 }
 
+// TokenIds returns every token id, including the IR operations that are only created by the optimizer
+func TokenIds() []TokenId {
+	ids := make([]TokenId, len(tokens))
+	for i := range tokens {
+		ids[i] = TokenId(i)
+	}
+	return ids
+}
+
+// NewToken returns the token for the given id
+func NewToken(id TokenId) Token {
+	return Token{id, tokens[id], ""}
+}
+
 func (t Token) String() string {
 	return fmt.Sprintf("%s (%s)", t.Character, t.TokenName)
 }
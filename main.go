@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"go/token"
+	"io"
 	"os"
+	"os/signal"
+	"strconv"
+	"time"
 
 	"bcomp/bfutils"
 	g "bcomp/generators"
@@ -21,8 +28,56 @@ var (
 	optWordSize   int
 	optMemorySize int
 	optOutput     string
+	optProfile    string
+	optProfileFormat string
+	optCoverage   string
+	optTrace      string
+	optTraceFormat string
+	optTraceStart string
+	optTraceStop  string
+	optMaxSteps   uint64
+	optMaxOutput  uint64
+	optMaxTapeGrowth int
+	optTimeout    time.Duration
+	optSnapshot   string
+	optResume     string
+	optBuffer     string
+	optEOF        string
+	optBounds     string
+	optOverflow   bool
+	optOverflowError bool
+	optSigned     bool
+	optIO         string
+	optTapeInit   []bfutils.TapeInit
+	optEmbedInput string
+	optGoPackage  string
+	ioMode        bfutils.IOMode
 )
 
+// generators are the code generators of the -g flag
+var generators = map[string]func(f *g.GeneratorOutput, tokens []g.ParseToken, includeComments bool, memorySize int, wordSize int){
+	"llvm":    g.PrintIR,
+	"qbe":     g.PrintIL,
+	"c":       g.PrintC,
+	"js":      g.PrintJS,
+	"wat":     g.PrintWAT,
+	"wasm":    g.PrintWASM,
+	"x86_64":  g.PrintX86_64,
+	"arm64":   g.PrintARM64,
+	"riscv64": g.PrintRISCV64,
+	"elf":     g.PrintELF,
+	"go":      g.PrintGo,
+	"rust":    g.PrintRust,
+	"python":  g.PrintPython,
+	"awk":     g.PrintAwk,
+	"bf": func(f *g.GeneratorOutput, tokens []g.ParseToken, includeComments bool, memorySize int, wordSize int) {
+		g.PrintBF(f, tokens, includeComments)
+	},
+	"tokens": func(f *g.GeneratorOutput, tokens []g.ParseToken, includeComments bool, memorySize int, wordSize int) {
+		g.PrintTokens(f, tokens, includeComments)
+	},
+}
+
 const PACKAGE_NAME = "bfcompile"
 const PACKAGE_VERSION = "1.0.0"
 
@@ -32,15 +87,39 @@ func main() {
 
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	// parse command line arguments
-	flag.StringVar(&optGenerator, "g", "qbe", "Code generator to use: tokens, llvm, qbe, c, js or bf")
+	flag.StringVar(&optGenerator, "g", "qbe", "Code generator to use: tokens, llvm, qbe, c, js, wat, wasm, x86_64, arm64, riscv64, elf, go, rust, python, awk or bf")
 	flag.BoolVar(&optInterpret, "i", false, "Interpret the code instead of generating code. This will ignore the -g option.")
 	flag.BoolVar(&optOptimize, "o", false, "Optimize the code")
 	flag.BoolVar(&optComments, "c", false, "Add reference comments to the generated code")
 	flag.BoolVar(&optDebug, "d", false, "Enable verbose output from optimizer")
 	flag.BoolVar(&optDebugSymbols, "lg", false, "Enable LLVM debug symbols generation")
-	flag.IntVar(&optWordSize, "w", 8, "Cell size (8, 16 or 32)")
+	optWordSize = 8
+	flag.Var(cellSize{&optWordSize}, "w", "Cell `size`: 8, 16, 32, 64 (with -g c, go and rust) or big for arbitrary precision cells, which requires -i")
+	flag.StringVar(&optIO, "io", "bytes", "How cells are read and written, as a comma separated list: bytes, or utf8 to write and read every cell as a UTF-8 encoded code point, and binary, text-lf (read every line ending as LF) or text-crlf-in (read every line ending as CR LF)")
+	flag.Var(tapeInits{&optTapeInit}, "tape-init", "Load the bytes of a `file@offset` into the tape before the program starts, one byte in each cell. The data can also be given as hex, like 0x48690a@100. Can be given more than once")
+	flag.StringVar(&optEmbedInput, "embed-input", "", "Read the input from this file instead of stdin. The generated code contains the input, so it does not read stdin at all")
+	flag.StringVar(&optGoPackage, "go-package", "main", "Package of the code from -g go. In other packages than main it has no main function, and can be imported to call its Run(io.Reader, io.Writer) function")
+	flag.BoolVar(&optSigned, "signed", false, "Use signed cells, where division is signed. With -w big it allows cells to go below zero instead of stopping with an error")
 	flag.IntVar(&optMemorySize, "m", 30000, "Memory size available to brainfuck in the generated code")
 	flag.StringVar(&optOutput, "out", "", "Set a filename to output to instead of outputting to STDOUT.")
+	flag.StringVar(&optProfile, "profile", "", "Write an execution profile of the interpreted code to the given file (requires -i)")
+	flag.StringVar(&optProfileFormat, "profile-format", "json", "Format of the execution profile: json, listing or pprof")
+	flag.StringVar(&optTrace, "trace", "", "Write a step by step trace of the interpreted code to the given file (requires -i)")
+	flag.StringVar(&optTraceFormat, "trace-format", "jsonl", "Format of the trace: jsonl or cast (asciinema animation of the tape)")
+	flag.StringVar(&optTraceStart, "trace-start", "", "Start tracing at a step number, or at a source position given as line:column")
+	flag.StringVar(&optTraceStop, "trace-stop", "", "Stop tracing after a step number, or after a source position given as line:column")
+	flag.Uint64Var(&optMaxSteps, "max-steps", 0, "Stop interpreting after this many instructions, 0 means no limit")
+	flag.Uint64Var(&optMaxOutput, "max-output", 0, "Stop interpreting when the code outputs more than this many bytes, 0 means no limit")
+	flag.IntVar(&optMaxTapeGrowth, "max-tape-growth", 0, "Number of cells the interpreter may grow the memory with, if the code moves past the end of it")
+	flag.DurationVar(&optTimeout, "timeout", 0, "Stop interpreting after the given duration, for example 10s")
+	flag.StringVar(&optSnapshot, "snapshot", "", "Save the interpreter state to the given file if it is stopped before the code completes")
+	flag.StringVar(&optResume, "resume", "", "Resume interpreting from a state saved with -snapshot. The same input must be given again, as the already read input is skipped.")
+	flag.StringVar(&optBuffer, "buffer", "auto", "Output buffering of the interpreter: full, line, none (for interactive programs) or auto (line for terminals, full otherwise)")
+	flag.StringVar(&optEOF, "eof", "unchanged", "What the interpreter does with the cell when reading past the end of the input: unchanged, zero or minus1")
+	flag.StringVar(&optBounds, "bounds", "strict", "What the interpreter does when the pointer moves outside of the memory: strict (stop with an error) or wrap")
+	flag.BoolVar(&optOverflow, "overflow", false, "Report where cells wrap around and where the pointer moves below zero in the interpreted code (requires -i)")
+	flag.BoolVar(&optOverflowError, "overflow-error", false, "Stop the interpreter with an error at the first cell that wraps around or pointer move below zero (requires -i)")
+	flag.StringVar(&optCoverage, "coverage", "", "Write line and branch coverage of the interpreted code to the given file in lcov format (requires -i)")
 
 	if optInterpret {
 		optGenerator = "qbe"
@@ -49,10 +128,17 @@ func main() {
 	// Customize usage message
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <brainfuck file>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s portability [options] <brainfuck file> [input files...]\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
-	flag.Parse()
+	// The portability command runs the interpreter in all configurations, and takes the same options
+	portability := len(os.Args) > 1 && os.Args[1] == "portability"
+	if portability {
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
 
 	args := flag.Args()
 	if len(args) == 0 {
@@ -61,13 +147,25 @@ func main() {
 		os.Exit(1)
 	}
 
-	if optWordSize != 8 && optWordSize != 16 && optWordSize != 32 {
+	if optWordSize != 8 && optWordSize != 16 && optWordSize != 32 && optWordSize != 64 && optWordSize != i.WordSizeBig {
 		fmt.Fprintf(os.Stderr, "Error: Unknown cell size: %d\n\n", optWordSize)
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if optGenerator != "qbe" && optGenerator != "c" && optGenerator != "js" && optGenerator != "bf" && optGenerator != "tokens" && optGenerator != "llvm" {
+	if optWordSize == 64 && (optInterpret || (optGenerator != "c" && optGenerator != "go" && optGenerator != "rust")) {
+		fmt.Fprintf(os.Stderr, "Error: -w 64 is only supported by the c, go and rust generators\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if optWordSize == i.WordSizeBig && !optInterpret {
+		fmt.Fprintf(os.Stderr, "Error: -w big is only supported when interpreting the code with -i\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if generators[optGenerator] == nil {
 		fmt.Fprintf(os.Stderr, "Error: Unknown generator %s\n\n", optGenerator)
 		flag.Usage()
 		os.Exit(1)
@@ -79,6 +177,42 @@ func main() {
 		os.Exit(1)
 	}
 
+	if optProfile != "" && !optInterpret {
+		fmt.Fprintf(os.Stderr, "Error: -profile parameter is only relevant when interpreting the code with -i\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if optCoverage != "" && !optInterpret {
+		fmt.Fprintf(os.Stderr, "Error: -coverage parameter is only relevant when interpreting the code with -i\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if optTrace != "" && !optInterpret {
+		fmt.Fprintf(os.Stderr, "Error: -trace parameter is only relevant when interpreting the code with -i\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if (optOverflow || optOverflowError) && !optInterpret {
+		fmt.Fprintf(os.Stderr, "Error: -overflow and -overflow-error parameters are only relevant when interpreting the code with -i\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if optTraceFormat != "jsonl" && optTraceFormat != "cast" {
+		fmt.Fprintf(os.Stderr, "Error: Unknown trace format %s\n\n", optTraceFormat)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if optProfileFormat != "json" && optProfileFormat != "listing" && optProfileFormat != "pprof" {
+		fmt.Fprintf(os.Stderr, "Error: Unknown profile format %s\n\n", optProfileFormat)
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	if optDebugSymbols {
 		bfutils.Globals.Set("LLVM_DEBUG", "true")
 	} else {
@@ -89,6 +223,56 @@ func main() {
 		p.Debug = true
 	}
 
+	if optSigned {
+		p.SignedCells = true
+		g.SignedCells = true
+	}
+
+	var err error
+	if ioMode, err = bfutils.ParseIOMode(optIO); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	g.IOMode = ioMode
+	if (optGenerator == "wat" || optGenerator == "wasm" || optGenerator == "x86_64" || optGenerator == "arm64" || optGenerator == "riscv64" || optGenerator == "elf") && !optInterpret && ioMode != (bfutils.IOMode{}) {
+		fmt.Fprintf(os.Stderr, "Error: -io %s is not supported by the %s generator\n\n", optIO, optGenerator)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if err := bfutils.CheckTapeInit(optTapeInit, optMemorySize); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	g.TapeInit = optTapeInit
+	p.TapeInitialized = len(optTapeInit) > 0
+
+	var embeddedInput []byte
+	if optEmbedInput != "" {
+		if embeddedInput, err = os.ReadFile(optEmbedInput); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		// An empty file is still embedded, and the code does not read stdin
+		if embeddedInput == nil {
+			embeddedInput = []byte{}
+		}
+		g.EmbeddedInput = embeddedInput
+	}
+	if !token.IsIdentifier(optGoPackage) {
+		fmt.Fprintf(os.Stderr, "Error: -go-package %s is not a package name\n\n", optGoPackage)
+		flag.Usage()
+		os.Exit(1)
+	}
+	g.GoPackage = optGoPackage
+	if optEmbedInput != "" && !optInterpret && (optGenerator == "bf" || optGenerator == "tokens") {
+		fmt.Fprintf(os.Stderr, "Error: -embed-input is not supported by the %s generator\n\n", optGenerator)
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	bfutils.Globals.Set("INPUT_FILENAME", flag.Args()[0])
 
 	tokens := p.ParseFile(flag.Args()[0])
@@ -133,25 +317,283 @@ func main() {
 		}
 	}
 
+	if portability {
+		checkPortability(tokens, args[1:])
+		return
+	}
+
 	if optInterpret {
-		i.InterpretTokens(tokens, optMemorySize, os.Stdin, bfutils.WrapStdout(os.Stdout), optWordSize)
+		sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		// The first Ctrl-C stops the interpreter at the next step, and restores the default
+		// handler, so a second one exits also when the interpreter waits for input
+		go func() {
+			<-sigCtx.Done()
+			stop()
+		}()
+		ctx := sigCtx
+		if optTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(sigCtx, optTimeout)
+			defer cancel()
+		}
+
+		opts := i.Options{
+			Context:        ctx,
+			MaxSteps:       optMaxSteps,
+			MaxOutputBytes: optMaxOutput,
+			MaxTapeGrowth:  optMaxTapeGrowth,
+			Signed:         optSigned,
+			IO:             ioMode,
+			TapeInit:       optTapeInit,
+		}
+		if opts.EOF, err = i.ParseEOFPolicy(optEOF); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		if opts.Bounds, err = i.ParseBoundsMode(optBounds); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		if optProfile != "" || optCoverage != "" {
+			opts.Profile = i.NewProfile(tokens)
+		}
+		if optOverflow || optOverflowError {
+			opts.Overflow = i.NewOverflows(tokens)
+			opts.Overflow.Fatal = optOverflowError
+		}
+		if optResume != "" {
+			opts.Resume = readSnapshot()
+		}
+		if optTrace != "" {
+			traceFile := openTrace()
+			defer traceFile.Close()
+			opts.Trace = newTracer(traceFile)
+		}
+
+		policy := bfutils.DefaultBufferPolicy(os.Stdout)
+		if optBuffer != "auto" {
+			if policy, err = bfutils.ParseBufferPolicy(optBuffer); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+				flag.Usage()
+				os.Exit(1)
+			}
+		}
+		stdout := bfutils.WrapStdout(os.Stdout, policy)
+		var stdin bfutils.FileOrMemReader
+		if embeddedInput != nil {
+			stdin = bytes.NewReader(embeddedInput)
+		} else {
+			stdin = bfutils.WrapStdin(os.Stdin, stdout, policy)
+		}
+		if opts.Resume != nil {
+			skipInput(stdin, opts.Resume)
+		}
+
+		result := i.InterpretTokensWithOptions(tokens, optMemorySize, stdin, stdout, optWordSize, opts)
+
+		prof := opts.Profile
+		if optProfile != "" {
+			writeProfile(prof, flag.Args()[0])
+		}
+		if optCoverage != "" {
+			writeCoverage(prof, flag.Args()[0])
+		}
+		if opts.Overflow != nil {
+			writeOverflows(opts.Overflow)
+		}
+
+		if result.Reason != i.ExitCompleted {
+			if optSnapshot != "" && result.State != nil {
+				writeSnapshot(result.State)
+			}
+			if result.Err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", result.Err)
+			} else {
+				fmt.Fprintf(os.Stderr, "Error: Interpreter stopped at %d:%d after %d steps with p=%d: %v\n", result.Pos.Line, result.Pos.Column, result.Steps, result.Pointer, result.Reason)
+			}
+			os.Exit(1)
+		}
 	} else {
 		output := g.NewGeneratorOutputFile(optOutput)
 		defer output.Close()
 
-		switch optGenerator {
-		case "llvm":
-			g.PrintIR(output, tokens, optComments, optMemorySize, optWordSize)
-		case "qbe":
-			g.PrintIL(output, tokens, optComments, optMemorySize, optWordSize)
-		case "c":
-			g.PrintC(output, tokens, optComments, optMemorySize, optWordSize)
-		case "js":
-			g.PrintJS(output, tokens, optComments, optMemorySize, optWordSize)
-		case "bf":
-			g.PrintBF(output, tokens, optComments)
-		case "tokens":
-			g.PrintTokens(output, tokens, optComments)
+		generators[optGenerator](output, tokens, optComments, optMemorySize, optWordSize)
+		if optGenerator == "elf" && optOutput != "" && optOutput != "-" {
+			os.Chmod(optOutput, 0755)
+		}
+	}
+}
+
+// tapeInits is the value of the -tape-init flag, which can be given more than once
+type tapeInits struct {
+	inits *[]bfutils.TapeInit
+}
+
+func (t tapeInits) String() string {
+	return ""
+}
+
+func (t tapeInits) Set(s string) error {
+	init, err := bfutils.ParseTapeInit(s)
+	if err != nil {
+		return err
+	}
+	*t.inits = append(*t.inits, init)
+	return nil
+}
+
+// cellSize is the value of the -w flag, which is either a number of bits or "big"
+type cellSize struct {
+	bits *int
+}
+
+func (c cellSize) String() string {
+	if c.bits == nil {
+		return ""
+	}
+	if *c.bits == i.WordSizeBig {
+		return "big"
+	}
+	return strconv.Itoa(*c.bits)
+}
+
+func (c cellSize) Set(s string) error {
+	if s == "big" {
+		*c.bits = i.WordSizeBig
+		return nil
+	}
+	bits, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid cell size %q", s)
+	}
+	*c.bits = bits
+	return nil
+}
+
+func writeProfile(prof *i.Profile, filename string) {
+	output, err := os.Create(optProfile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening file:", err)
+		os.Exit(1)
+	}
+	defer output.Close()
+
+	switch optProfileFormat {
+	case "json":
+		err = prof.WriteJSON(output)
+	case "listing":
+		var source []byte
+		source, err = os.ReadFile(filename)
+		if err == nil {
+			err = prof.WriteListing(output, source)
+		}
+	case "pprof":
+		err = prof.WritePprof(output, filename)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing profile:", err)
+		os.Exit(1)
+	}
+}
+
+func writeCoverage(prof *i.Profile, filename string) {
+	output, err := os.Create(optCoverage)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening file:", err)
+		os.Exit(1)
+	}
+	defer output.Close()
+
+	if err := prof.WriteLCOV(output, filename); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing coverage:", err)
+		os.Exit(1)
+	}
+}
+
+func writeOverflows(ovf *i.Overflows) {
+	if ovf.Total() == 0 {
+		return
+	}
+	if optWordSize == i.WordSizeBig {
+		fmt.Fprintln(os.Stderr, "Warning: The code depends on cells or the pointer going below zero:")
+	} else {
+		fmt.Fprintf(os.Stderr, "Warning: The code depends on %d-bit cells wrapping around or on the pointer moving below zero:\n", optWordSize)
+	}
+	if err := ovf.WriteReport(os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing overflow report:", err)
+		os.Exit(1)
+	}
+}
+
+func openTrace() *os.File {
+	output, err := os.Create(optTrace)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening file:", err)
+		os.Exit(1)
+	}
+	return output
+}
+
+func newTracer(output *os.File) *i.Tracer {
+	format := i.TraceJSONLines
+	if optTraceFormat == "cast" {
+		format = i.TraceAsciicast
+	}
+	tracer := i.NewTracer(output, format)
+
+	var err error
+	if optTraceStart != "" {
+		if tracer.Start, err = i.ParseTracePoint(optTraceStart); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -trace-start: %v\n", err)
+			os.Exit(1)
 		}
 	}
+	if optTraceStop != "" {
+		if tracer.Stop, err = i.ParseTracePoint(optTraceStop); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -trace-stop: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	return tracer
+}
+
+func readSnapshot() *i.State {
+	data, err := os.ReadFile(optResume)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening file:", err)
+		os.Exit(1)
+	}
+
+	state := &i.State{}
+	if err := state.UnmarshalBinary(data); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading snapshot %s: %v\n", optResume, err)
+		os.Exit(1)
+	}
+
+	return state
+}
+
+// skipInput skips the input the interpreter already had read when the snapshot was saved
+func skipInput(in io.Reader, state *i.State) {
+	if _, err := io.CopyN(io.Discard, in, int64(state.InputPos)); err != nil && err != io.EOF {
+		fmt.Fprintln(os.Stderr, "Error skipping input:", err)
+		os.Exit(1)
+	}
+}
+
+func writeSnapshot(state *i.State) {
+	data, err := state.MarshalBinary()
+	if err == nil {
+		err = os.WriteFile(optSnapshot, data, 0666)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing snapshot:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Interpreter state saved to %s\n", optSnapshot)
 }
@@ -2,15 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math/big"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"bcomp/bfutils"
 	g "bcomp/generators"
 	i "bcomp/interpreter"
+	l "bcomp/lexer"
 	p "bcomp/parser"
 
 	"github.com/google/uuid"
@@ -243,3 +253,1880 @@ func TestBZCheckComplicatedCode1(t *testing.T) {
 		t.Errorf("got %q, wanted %q", got, want)
 	}
 }
+
+func TestInterpreterProfile(t *testing.T) {
+	oldArgs := os.Args
+	oldStdout := os.Stdout
+
+	defer func() {
+		os.Args = oldArgs
+		os.Stdout = oldStdout
+		if r := recover(); r != nil {
+			t.Errorf("panic: %v", r)
+		}
+	}()
+
+	filename := tempFile()
+	defer filename.Remove()
+	stdout := tempFile()
+	defer stdout.Remove()
+
+	os.Stdout, _ = os.Create(string(stdout))
+	defer os.Stdout.Close()
+	os.Args = []string{"cmd", "-i", "-profile", string(filename), "brainfuck/hello.bf"}
+	main()
+
+	var got struct {
+		Steps     uint64
+		Positions []i.PositionCount
+		Loops     []i.LoopCount
+	}
+	if err := json.Unmarshal(filename.ReadFile(), &got); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+
+	if got.Steps != 390 {
+		t.Errorf("got %d steps, wanted %d", got.Steps, 390)
+	}
+	if len(got.Loops) != 1 || got.Loops[0].Line != 2 || got.Loops[0].Entries != 1 || got.Loops[0].Iterations != 10 {
+		t.Errorf("got loops %+v, wanted one loop at line 2 with 10 iterations", got.Loops)
+	}
+	if got.Positions[0].Line != 1 || got.Positions[0].Column != 1 || got.Positions[0].Count != 1 {
+		t.Errorf("got first position %+v, wanted 1:1 executed once", got.Positions[0])
+	}
+
+	// The listing has the count of each line, and a heat map line under it
+	os.Args = []string{"cmd", "-i", "-profile", string(filename), "-profile-format", "listing", "brainfuck/hello.bf"}
+	main()
+	listing := string(filename.ReadFile())
+	for _, want := range []string{
+		"Total steps: 390\n\n",
+		"          10 | +++++ +++++             initialize counter (cell #0) to 10\n             | ..... .....\n",
+		"         110 |     > +++++ +++++           add 10 to cell #2\n             |     @ @@@@@ @@@@@\n",
+		"\nLoops not converted by the optimizer:\n  2:1: 10 iterations in 1 entries\n",
+	} {
+		if !strings.Contains(listing, want) {
+			t.Errorf("listing has no %q, got\n%s", want, listing)
+		}
+	}
+
+	// The pprof profile can be read by pprof, and has the steps in the loop and outside of it
+	os.Args = []string{"cmd", "-i", "-profile", string(filename), "-profile-format", "pprof", "brainfuck/hello.bf"}
+	main()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not installed")
+	}
+	top, err := exec.Command("go", "tool", "pprof", "-top", string(filename)).Output()
+	if err != nil {
+		t.Fatalf("go tool pprof: %v", err)
+	}
+	// The flat and the cumulative steps of each function
+	steps := make(map[string][2]string)
+	for _, line := range strings.Split(string(top), "\n") {
+		if fields := strings.Fields(line); len(fields) == 6 {
+			steps[fields[5]] = [2]string{fields[0], fields[3]}
+		}
+	}
+	if !strings.Contains(string(top), "Type: steps\n") || steps["loop@2:1"] != [2]string{"300", "300"} || steps["main"] != [2]string{"90", "390"} {
+		t.Errorf("got pprof -top\n%s\nwanted 300 steps in loop@2:1 and 90 of 390 in main", top)
+	}
+}
+
+func TestInterpreterCoverage(t *testing.T) {
+	oldArgs := os.Args
+
+	defer func() {
+		os.Args = oldArgs
+		if r := recover(); r != nil {
+			t.Errorf("panic: %v", r)
+		}
+	}()
+
+	filename := tempFile()
+	defer filename.Remove()
+	os.Args = []string{"cmd", "-i", "-coverage", string(filename), "testdata/test06.bf"}
+	main()
+	got := filename.ReadFile()
+	want := wantOutput("test06_lcov")
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+func TestInterpreterTrace(t *testing.T) {
+	oldArgs := os.Args
+
+	defer func() {
+		os.Args = oldArgs
+		if r := recover(); r != nil {
+			t.Errorf("panic: %v", r)
+		}
+	}()
+
+	filename := tempFile()
+	defer filename.Remove()
+	os.Args = []string{"cmd", "-i", "-trace", string(filename), "-trace-start", "2:1", "-trace-stop", "14", "brainfuck/hello.bf"}
+	main()
+	got := filename.ReadFile()
+	want := wantOutput("hello_trace")
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+
+	// The asciicast has a header, and then one output event for each traced step
+	os.Args = []string{"cmd", "-i", "-trace", string(filename), "-trace-format", "cast", "-trace-start", "2:1", "-trace-stop", "14", "brainfuck/hello.bf"}
+	defer func() { optTraceFormat = "jsonl" }()
+	main()
+	lines := strings.Split(strings.TrimSuffix(string(filename.ReadFile()), "\n"), "\n")
+
+	var header struct {
+		Version int
+		Width   int
+		Height  int
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil || header.Version != 2 || header.Width == 0 || header.Height == 0 {
+		t.Errorf("got header %q (%v), wanted an asciicast v2 header", lines[0], err)
+	}
+	if events, steps := len(lines)-1, bytes.Count(want, []byte("\n")); events != steps {
+		t.Errorf("got %d events, wanted %d", events, steps)
+	}
+	last := -1.0
+	for _, line := range lines[1:] {
+		var event []any
+		if err := json.Unmarshal([]byte(line), &event); err != nil || len(event) != 3 {
+			t.Fatalf("got event %q (%v), wanted [time, \"o\", data]", line, err)
+		}
+		time, timeOK := event[0].(float64)
+		data, dataOK := event[2].(string)
+		if !timeOK || time <= last || event[1] != "o" || !dataOK || !strings.Contains(data, "step ") {
+			t.Errorf("got event %q, wanted [time, \"o\", data] after %v", line, last)
+		}
+		last = time
+	}
+}
+
+func TestInterpreterLimits(t *testing.T) {
+	tokens := p.ParseFile("testdata/test07.bf")
+	out := bytes.NewBuffer([]byte{})
+
+	result := i.InterpretTokensWithOptions(tokens, 10, bytes.NewReader(nil), bfutils.WrapBuffer(out), 8, i.Options{MaxSteps: 100})
+	if result.Reason != i.ExitTapeLimit || result.Pointer != 10 {
+		t.Errorf("got %v at p=%d, wanted %v at p=10", result.Reason, result.Pointer, i.ExitTapeLimit)
+	}
+
+	result = i.InterpretTokensWithOptions(tokens, 10, bytes.NewReader(nil), bfutils.WrapBuffer(out), 8, i.Options{MaxSteps: 100, MaxTapeGrowth: 1000})
+	if result.Reason != i.ExitStepLimit || result.Steps != 100 {
+		t.Errorf("got %v after %d steps, wanted %v after 100 steps", result.Reason, result.Steps, i.ExitStepLimit)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result = i.InterpretTokensWithOptions(tokens, 10, bytes.NewReader(nil), bfutils.WrapBuffer(out), 8, i.Options{Context: ctx})
+	if result.Reason != i.ExitCanceled || result.Steps != 0 {
+		t.Errorf("got %v after %d steps, wanted %v after 0 steps", result.Reason, result.Steps, i.ExitCanceled)
+	}
+}
+
+func TestInterpreterOverflow(t *testing.T) {
+	tokens := p.ParseFile("brainfuck/cellsize.bf")
+	out := bytes.NewBuffer([]byte{})
+
+	ovf := i.NewOverflows(tokens)
+	i.InterpretTokensWithOptions(tokens, 100, bytes.NewReader(nil), bfutils.WrapBuffer(out), 8, i.Options{Overflow: ovf})
+	report := ovf.Report()
+	if len(report) != 1 || report[0].Line != 4 || report[0].Column != 28 || report[0].Kind != i.Overflow || report[0].Count != 1 {
+		t.Errorf("got %v, wanted one overflow at 4:28", report)
+	}
+
+	ovf = i.NewOverflows(tokens)
+	i.InterpretTokensWithOptions(tokens, 100, bytes.NewReader(nil), bfutils.WrapBuffer(out), 32, i.Options{Overflow: ovf})
+	if ovf.Total() != 0 {
+		t.Errorf("got %v, wanted no overflows with 32 bit cells", ovf.Report())
+	}
+
+	ovf = i.NewOverflows(tokens)
+	ovf.Fatal = true
+	result := i.InterpretTokensWithOptions(tokens, 100, bytes.NewReader(nil), bfutils.WrapBuffer(out), 8, i.Options{Overflow: ovf})
+	if result.Reason != i.ExitOverflow || result.Pos != (l.Position{Line: 4, Column: 28}) {
+		t.Errorf("got %v at %d:%d, wanted %v at 4:28", result.Reason, result.Pos.Line, result.Pos.Column, i.ExitOverflow)
+	}
+
+	tokens = p.ParseFile("testdata/test08.bf")
+	ovf = i.NewOverflows(tokens)
+	i.InterpretTokensWithOptions(tokens, 100, bytes.NewReader(nil), bfutils.WrapBuffer(out), 8, i.Options{Overflow: ovf, Bounds: i.BoundsWrap})
+	want := []i.OverflowKind{i.Underflow, i.PointerUnderflow, i.Underflow}
+	report = ovf.Report()
+	if len(report) != len(want) {
+		t.Fatalf("got %v, wanted %v", report, want)
+	}
+	for n, kind := range want {
+		if report[n].Kind != kind {
+			t.Errorf("got %v at %d:%d, wanted %v", report[n].Kind, report[n].Line, report[n].Column, kind)
+		}
+	}
+}
+
+func TestInterpreterBigCells(t *testing.T) {
+	// The loops run 2^39 times, so the program has to be optimized into MUL
+	tokens := p.Optimize2(p.Optimize(p.ParseFile("testdata/test09.bf")), "")
+	out := bytes.NewBuffer([]byte{})
+
+	obs := &countingObserver{tapeWrites: make(map[int]uint64)}
+	result := i.InterpretTokensWithOptions(tokens, 100, bytes.NewReader(nil), bfutils.WrapBuffer(out), i.WordSizeBig, i.Options{Observer: obs})
+	if result.Reason != i.ExitCompleted || obs.tapeWrites[40] != 1<<40 {
+		t.Errorf("got %v with p[40]=%d, wanted p[40]=%d", result.Reason, obs.tapeWrites[40], uint64(1<<40))
+	}
+
+	tokens = p.ParseFile("testdata/test08.bf")
+	result = i.InterpretTokensWithOptions(tokens, 100, bytes.NewReader(nil), bfutils.WrapBuffer(out), i.WordSizeBig, i.Options{})
+	if result.Reason != i.ExitNegativeCell || result.Pos != (l.Position{Line: 1, Column: 1}) {
+		t.Errorf("got %v at %d:%d, wanted %v at 1:1", result.Reason, result.Pos.Line, result.Pos.Column, i.ExitNegativeCell)
+	}
+
+	out.Reset()
+	result = i.InterpretTokensWithOptions(tokens, 100, bytes.NewReader(nil), bfutils.WrapBuffer(out), i.WordSizeBig, i.Options{Signed: true, Bounds: i.BoundsWrap})
+	if result.Reason != i.ExitCompleted || !bytes.Equal(out.Bytes(), []byte{255}) {
+		t.Errorf("got %v with output %v, wanted the low byte of -1", result.Reason, out.Bytes())
+	}
+
+	// A loop converted to MUL never ends if the counter is negative
+	tokens = p.Optimize2([]g.ParseToken{
+		{Tok: l.NewToken(l.SUB), Extra: 1},
+		{Tok: l.NewToken(l.JMPF), Extra: 1},
+		{Tok: l.NewToken(l.SUB), Extra: 1},
+		{Tok: l.NewToken(l.INCP), Extra: 1},
+		{Tok: l.NewToken(l.ADD), Extra: 1},
+		{Tok: l.NewToken(l.DECP), Extra: 1},
+		{Tok: l.NewToken(l.JMPB), Extra: 1},
+	}, "")
+	result = i.InterpretTokensWithOptions(tokens, 100, bytes.NewReader(nil), bfutils.WrapBuffer(out), i.WordSizeBig, i.Options{Signed: true})
+	if result.Reason != i.ExitError {
+		t.Errorf("got %v, wanted %v for a MUL loop with a negative counter", result.Reason, i.ExitError)
+	}
+}
+
+// runGenerated writes the output of a generator to a file and runs it, or skips the test if the tools are not installed
+func runGenerated(t *testing.T, code []byte, ext string, run func(file string) *exec.Cmd) []byte {
+	file := filepath.Join(t.TempDir(), "main"+ext)
+	if err := os.WriteFile(file, code, 0666); err != nil {
+		t.Fatal(err)
+	}
+	cmd := run(file)
+	if _, err := exec.LookPath(cmd.Path); err != nil {
+		t.Skipf("%s is not installed", cmd.Args[0])
+	}
+	// The generated code expects input from a pipe
+	if cmd.Stdin == nil {
+		cmd.Stdin = bytes.NewReader(nil)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%v failed: %v", cmd.Args, err)
+	}
+	return out
+}
+
+func TestSignedCells(t *testing.T) {
+	g.SignedCells = true
+	defer func() { g.SignedCells = false }()
+
+	// The optimizer keeps the dividing loops with signed cells, so the DIV is built by hand.
+	// -10 / 3 is -3 with signed cells, which is 'C' after adding 70,
+	// and -3 * 2 is -6, which is 'B' after adding 72
+	tokens := []g.ParseToken{
+		{Tok: l.NewToken(l.SUB), Extra: 10},
+		{Tok: l.NewToken(l.DIV), Extra: 3},
+		{Tok: l.NewToken(l.MUL), Extra: 2, Extra2: 1},
+		{Tok: l.NewToken(l.ADD), Extra: 70},
+		{Tok: l.NewToken(l.OUT), Extra: 1},
+		{Tok: l.NewToken(l.INCP), Extra: 1},
+		{Tok: l.NewToken(l.ADD), Extra: 72},
+		{Tok: l.NewToken(l.OUT), Extra: 1},
+	}
+	want := []byte("CB")
+
+	for _, wordSize := range []int{8, 16, 32} {
+		out := bytes.NewBuffer([]byte{})
+		i.InterpretTokensWithOptions(tokens, 10, bytes.NewReader(nil), bfutils.WrapBuffer(out), wordSize, i.Options{Signed: true})
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("interpreter -w %d: got %q, wanted %q", wordSize, out.Bytes(), want)
+		}
+
+		f := g.NewGeneratorOutputString()
+		g.PrintC(f, tokens, false, 10, wordSize)
+		t.Run(fmt.Sprintf("C -w %d", wordSize), func(t *testing.T) {
+			exe := filepath.Join(t.TempDir(), "main")
+			runGenerated(t, f.GetOutput(), ".c", func(file string) *exec.Cmd { return exec.Command("cc", "-o", exe, file) })
+			got, err := exec.Command(exe).Output()
+			if err != nil || !bytes.Equal(got, want) {
+				t.Errorf("got %q (%v), wanted %q", got, err, want)
+			}
+		})
+
+		f = g.NewGeneratorOutputString()
+		g.PrintJS(f, tokens, false, 10, wordSize)
+		t.Run(fmt.Sprintf("JS -w %d", wordSize), func(t *testing.T) {
+			if got := runGenerated(t, f.GetOutput(), ".js", func(file string) *exec.Cmd { return exec.Command("node", file) }); !bytes.Equal(got, want) {
+				t.Errorf("got %q, wanted %q", got, want)
+			}
+		})
+
+		f = g.NewGeneratorOutputString()
+		g.PrintAwk(f, tokens, false, 10, wordSize)
+		t.Run(fmt.Sprintf("awk -w %d", wordSize), func(t *testing.T) {
+			if got := runGenerated(t, f.GetOutput(), ".awk", func(file string) *exec.Cmd { return exec.Command("awk", "-f", file) }); !bytes.Equal(got, want) {
+				t.Errorf("got %q, wanted %q", got, want)
+			}
+		})
+
+		f = g.NewGeneratorOutputString()
+		g.PrintIL(f, tokens, false, 10, wordSize)
+		il := f.GetOutput()
+		if !bytes.Contains(il, []byte("=w div %v, 3")) || bytes.Contains(il, []byte("udiv")) {
+			t.Errorf("QBE -w %d: DIV is not a signed division", wordSize)
+		}
+		t.Run(fmt.Sprintf("QBE -w %d", wordSize), func(t *testing.T) {
+			asm := filepath.Join(t.TempDir(), "main.s")
+			exe := filepath.Join(t.TempDir(), "main")
+			runGenerated(t, il, ".ssa", func(file string) *exec.Cmd { return exec.Command("qbe", "-o", asm, file) })
+			if out, err := exec.Command("cc", "-o", exe, asm).CombinedOutput(); err != nil {
+				t.Fatalf("cc failed: %v\n%s", err, out)
+			}
+			got, err := exec.Command(exe).Output()
+			if err != nil || !bytes.Equal(got, want) {
+				t.Errorf("got %q (%v), wanted %q", got, err, want)
+			}
+		})
+
+		f = g.NewGeneratorOutputString()
+		g.PrintIR(f, tokens, false, 10, wordSize)
+		ir := f.GetOutput()
+		if !bytes.Contains(ir, []byte("sdiv i32")) || bytes.Contains(ir, []byte("zext")) {
+			t.Errorf("LLVM -w %d: DIV is not a signed division", wordSize)
+		}
+		t.Run(fmt.Sprintf("LLVM -w %d", wordSize), func(t *testing.T) {
+			exe := filepath.Join(t.TempDir(), "main")
+			runGenerated(t, ir, ".ll", func(file string) *exec.Cmd { return exec.Command("clang", "-o", exe, file) })
+			got, err := exec.Command(exe).Output()
+			if err != nil || !bytes.Equal(got, want) {
+				t.Errorf("got %q (%v), wanted %q", got, err, want)
+			}
+		})
+	}
+
+	// The optimizer keeps loops it can not replace with a signed division
+	tokens = p.ParseFile("testdata/test10.bf")
+	p.SignedCells = true
+	defer func() { p.SignedCells = false }()
+	optimized := p.Optimize2(p.Optimize(tokens), "")
+	for _, program := range [][]g.ParseToken{tokens, optimized} {
+		out := bytes.NewBuffer([]byte{})
+		i.InterpretTokensWithOptions(program, 10, bytes.NewReader(nil), bfutils.WrapBuffer(out), 8, i.Options{Signed: true})
+		if !bytes.Equal(out.Bytes(), []byte{127}) {
+			t.Errorf("got %v, wanted [127]", out.Bytes())
+		}
+	}
+}
+
+func TestUTF8IO(t *testing.T) {
+	g.IOMode = bfutils.IOMode{Encoding: bfutils.EncodingUTF8}
+	defer func() { g.IOMode = bfutils.IOMode{} }()
+
+	// Echo the input until a newline. The invalid lead bytes, the overlong sequence, the surrogate
+	// and the sequence broken by 'x' are all read as U+FFFD, and U+1F600 does not fit in 16 bits.
+	tokens := p.ParseFile("testdata/test11.bf")
+	input := []byte("h\xc3\xa9 \u20ac\U0001f600\xff\xc0\xaf\xed\xa0\x80\xe2\x82x\n")
+	invalid := strings.Repeat("\ufffd", 5)
+	wants := map[int][]byte{
+		16: []byte("hé €\uf600" + invalid),
+		32: []byte("hé €\U0001f600" + invalid),
+	}
+
+	for wordSize, want := range wants {
+		out := bytes.NewBuffer([]byte{})
+		i.InterpretTokensWithOptions(tokens, 10, bytes.NewReader(input), bfutils.WrapBuffer(out), wordSize, i.Options{IO: bfutils.IOMode{Encoding: bfutils.EncodingUTF8}})
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("interpreter -w %d: got %q, wanted %q", wordSize, out.Bytes(), want)
+		}
+
+		f := g.NewGeneratorOutputString()
+		g.PrintC(f, tokens, false, 10, wordSize)
+		t.Run(fmt.Sprintf("C -w %d", wordSize), func(t *testing.T) {
+			exe := filepath.Join(t.TempDir(), "main")
+			runGenerated(t, f.GetOutput(), ".c", func(file string) *exec.Cmd { return exec.Command("cc", "-o", exe, file) })
+			cmd := exec.Command(exe)
+			cmd.Stdin = bytes.NewReader(input)
+			got, err := cmd.Output()
+			if err != nil || !bytes.Equal(got, want) {
+				t.Errorf("got %q (%v), wanted %q", got, err, want)
+			}
+		})
+
+		f = g.NewGeneratorOutputString()
+		g.PrintJS(f, tokens, false, 10, wordSize)
+		run := func(file string) *exec.Cmd {
+			cmd := exec.Command("node", file)
+			cmd.Stdin = bytes.NewReader(input)
+			return cmd
+		}
+		t.Run(fmt.Sprintf("JS -w %d", wordSize), func(t *testing.T) {
+			if got := runGenerated(t, f.GetOutput(), ".js", run); !bytes.Equal(got, want) {
+				t.Errorf("got %q, wanted %q", got, want)
+			}
+		})
+
+		f = g.NewGeneratorOutputString()
+		g.PrintIL(f, tokens, false, 10, wordSize)
+		if il := f.GetOutput(); !bytes.Contains(il, []byte("call $bf_put_utf8(")) || !bytes.Contains(il, []byte("call $bf_get_utf8(l %p)")) {
+			t.Errorf("QBE -w %d: I/O is not UTF-8", wordSize)
+		}
+
+		f = g.NewGeneratorOutputString()
+		g.PrintIR(f, tokens, false, 10, wordSize)
+		if ir := f.GetOutput(); !bytes.Contains(ir, []byte("call void @put_utf8(")) || !bytes.Contains(ir, []byte("call i32 @get_utf8()")) {
+			t.Errorf("LLVM -w %d: I/O is not UTF-8", wordSize)
+		}
+	}
+}
+
+func TestNewlineModes(t *testing.T) {
+	// tictactoe.bf expects Enter to be LF, which text-lf gives it also from a CR LF terminal
+	tokens := p.ParseFile("brainfuck/tictactoe.bf")
+	out := bytes.NewBuffer([]byte{})
+	opts := i.Options{IO: bfutils.IOMode{Newlines: bfutils.NewlinesLF}}
+	i.InterpretTokensWithOptions(tokens, 30000, bytes.NewReader([]byte("5\r\n8\r3\r\n4\n")), bfutils.WrapBuffer(out), 8, opts)
+	if want := wantOutput("tictactoe"); !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("got %q, wanted %q", out.Bytes(), want)
+	}
+
+	// Read and output 9 bytes
+	tokens = p.ParseFile("testdata/test12.bf")
+	input := []byte("ab\r\ncd\re\n\r\n")
+	wants := map[bfutils.Newlines][]byte{
+		bfutils.NewlinesBinary: []byte("ab\r\ncd\re\n"),
+		bfutils.NewlinesLF:     []byte("ab\ncd\ne\n\n"),
+		bfutils.NewlinesCRLFIn: []byte("ab\r\ncd\r\ne"),
+	}
+	defer func() { g.IOMode = bfutils.IOMode{} }()
+
+	for newlines, want := range wants {
+		mode := bfutils.IOMode{Newlines: newlines}
+		g.IOMode = mode
+
+		out := bytes.NewBuffer([]byte{})
+		i.InterpretTokensWithOptions(tokens, 10, bytes.NewReader(input), bfutils.WrapBuffer(out), 8, i.Options{IO: mode})
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("interpreter %s: got %q, wanted %q", newlines, out.Bytes(), want)
+		}
+
+		f := g.NewGeneratorOutputString()
+		g.PrintC(f, tokens, false, 10, 8)
+		t.Run(fmt.Sprintf("C %s", newlines), func(t *testing.T) {
+			exe := filepath.Join(t.TempDir(), "main")
+			runGenerated(t, f.GetOutput(), ".c", func(file string) *exec.Cmd { return exec.Command("cc", "-o", exe, file) })
+			cmd := exec.Command(exe)
+			cmd.Stdin = bytes.NewReader(input)
+			got, err := cmd.Output()
+			if err != nil || !bytes.Equal(got, want) {
+				t.Errorf("got %q (%v), wanted %q", got, err, want)
+			}
+		})
+
+		f = g.NewGeneratorOutputString()
+		g.PrintJS(f, tokens, false, 10, 8)
+		run := func(file string) *exec.Cmd {
+			cmd := exec.Command("node", file)
+			cmd.Stdin = bytes.NewReader(input)
+			return cmd
+		}
+		t.Run(fmt.Sprintf("JS %s", newlines), func(t *testing.T) {
+			if got := runGenerated(t, f.GetOutput(), ".js", run); !bytes.Equal(got, want) {
+				t.Errorf("got %q, wanted %q", got, want)
+			}
+		})
+
+		f = g.NewGeneratorOutputString()
+		g.PrintIL(f, tokens, false, 10, 8)
+		if il := f.GetOutput(); bytes.Contains(il, []byte("call $bf_read(l %p)")) != (newlines != bfutils.NewlinesBinary) {
+			t.Errorf("QBE %s: wrong input function", newlines)
+		}
+
+		f = g.NewGeneratorOutputString()
+		g.PrintIR(f, tokens, false, 10, 8)
+		if ir := f.GetOutput(); bytes.Contains(ir, []byte("call i32 @get_byte()")) != (newlines != bfutils.NewlinesBinary) {
+			t.Errorf("LLVM %s: wrong input function", newlines)
+		}
+	}
+}
+
+func TestInterpreterReadWithEOF(t *testing.T) {
+	// Read and output 9 bytes
+	tokens := p.ParseFile("testdata/test12.bf")
+	input := []byte("ab\r\n\xc3\xa9")
+	modes := []bfutils.IOMode{
+		{},
+		{Newlines: bfutils.NewlinesLF},
+		{Newlines: bfutils.NewlinesCRLFIn},
+		{Encoding: bfutils.EncodingUTF8},
+	}
+
+	for _, mode := range modes {
+		want := bytes.NewBuffer([]byte{})
+		i.InterpretTokensWithOptions(tokens, 10, bytes.NewReader(input), bfutils.WrapBuffer(want), 16, i.Options{IO: mode})
+
+		// DataErrReader returns io.EOF together with the last byte
+		out := bytes.NewBuffer([]byte{})
+		i.InterpretTokensWithOptions(tokens, 10, iotest.DataErrReader(bytes.NewReader(input)), bfutils.WrapBuffer(out), 16, i.Options{IO: mode})
+		if !bytes.Equal(out.Bytes(), want.Bytes()) {
+			t.Errorf("%s %s: got %q, wanted %q", mode.Encoding, mode.Newlines, out.Bytes(), want.Bytes())
+		}
+	}
+}
+
+func TestTapeInitAndEmbeddedInput(t *testing.T) {
+	hi, err := bfutils.ParseTapeInit("0x486921@1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Overwrites the first cell of the other initialization
+	x, err := bfutils.ParseTapeInit("0x3e58")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inits := []bfutils.TapeInit{hi, x}
+	segments := bfutils.TapeSegments(inits)
+	if len(segments) != 1 || !bytes.Equal(segments[0].Data, []byte(">Xi!")) {
+		t.Errorf("got %v, wanted one segment with %q", segments, ">Xi!")
+	}
+	if err := bfutils.CheckTapeInit(inits, 3); err == nil {
+		t.Errorf("no error for a tape initialization that does not fit")
+	}
+
+	// Output the tape up to the first zero cell, then echo three bytes of input
+	tokens := p.ParseFile("testdata/test13.bf")
+	p.TapeInitialized = true
+	defer func() { p.TapeInitialized = false }()
+	optimized := p.Optimize2(p.Optimize(tokens), "")
+	input := []byte("abc")
+	want := []byte(">Xi!abc")
+
+	for _, program := range [][]g.ParseToken{tokens, optimized} {
+		out := bytes.NewBuffer([]byte{})
+		i.InterpretTokensWithOptions(program, 10, bytes.NewReader(input), bfutils.WrapBuffer(out), 8, i.Options{TapeInit: inits})
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("interpreter: got %q, wanted %q", out.Bytes(), want)
+		}
+	}
+
+	g.TapeInit = inits
+	g.EmbeddedInput = input
+	defer func() {
+		g.TapeInit = nil
+		g.EmbeddedInput = nil
+	}()
+
+	for _, wordSize := range []int{8, 16} {
+		f := g.NewGeneratorOutputString()
+		g.PrintC(f, optimized, false, 10, wordSize)
+		t.Run(fmt.Sprintf("C -w %d", wordSize), func(t *testing.T) {
+			exe := filepath.Join(t.TempDir(), "main")
+			runGenerated(t, f.GetOutput(), ".c", func(file string) *exec.Cmd { return exec.Command("cc", "-o", exe, file) })
+			got, err := exec.Command(exe).Output()
+			if err != nil || !bytes.Equal(got, want) {
+				t.Errorf("got %q (%v), wanted %q", got, err, want)
+			}
+		})
+
+		f = g.NewGeneratorOutputString()
+		g.PrintJS(f, optimized, false, 10, wordSize)
+		t.Run(fmt.Sprintf("JS -w %d", wordSize), func(t *testing.T) {
+			if got := runGenerated(t, f.GetOutput(), ".js", func(file string) *exec.Cmd { return exec.Command("node", file) }); !bytes.Equal(got, want) {
+				t.Errorf("got %q, wanted %q", got, want)
+			}
+		})
+
+		f = g.NewGeneratorOutputString()
+		g.PrintIL(f, optimized, false, 10, wordSize)
+		if il := f.GetOutput(); !bytes.Contains(il, []byte("data $MEM = { ")) || !bytes.Contains(il, []byte("call $bf_embedded_read(l %p)")) {
+			t.Errorf("QBE -w %d: tape or input is not embedded", wordSize)
+		}
+
+		f = g.NewGeneratorOutputString()
+		g.PrintIR(f, optimized, false, 10, wordSize)
+		if ir := f.GetOutput(); !bytes.Contains(ir, []byte(fmt.Sprintf("[4 x i%d] [i%d 62, ", wordSize, wordSize))) || !bytes.Contains(ir, []byte("call i32 @embedded_getchar()")) {
+			t.Errorf("LLVM -w %d: tape or input is not embedded", wordSize)
+		}
+	}
+
+	// The bf generator sets the cells with code in front of the program
+	f := g.NewGeneratorOutputString()
+	g.PrintBF(f, tokens, false)
+	file := filepath.Join(t.TempDir(), "main.bf")
+	if err := os.WriteFile(file, f.GetOutput(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	out := bytes.NewBuffer([]byte{})
+	i.InterpretTokensWithOptions(p.ParseFile(file), 10, bytes.NewReader(input), bfutils.WrapBuffer(out), 8, i.Options{})
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("bf: got %q, wanted %q", out.Bytes(), want)
+	}
+}
+
+func TestWATGenerator(t *testing.T) {
+	// Uses MUL, DIV, MOV, BZ and LBL, and [.>] and [<] become PRNT and SCANL
+	tokens := p.Optimize2(p.Optimize(p.ParseFile("testdata/test14.bf")), "wat")
+	found := map[l.TokenId]bool{}
+	for _, token := range tokens {
+		found[token.Tok.Tok] = true
+	}
+	for _, id := range []l.TokenId{l.MUL, l.DIV, l.MOV, l.BZ, l.LBL, l.PRNT, l.SCANL} {
+		if !found[id] {
+			t.Errorf("optimized code has no %s", l.NewToken(id).TokenName)
+		}
+	}
+
+	out := bytes.NewBuffer([]byte{})
+	i.InterpretTokensWithOptions(tokens, 30000, bytes.NewReader(nil), bfutils.WrapBuffer(out), 8, i.Options{})
+	if want := "hi3\n"; out.String() != want {
+		t.Errorf("interpreter: got %q, wanted %q", out.String(), want)
+	}
+
+	for _, wordSize := range []int{8, 16, 32} {
+		f := g.NewGeneratorOutputString()
+		g.PrintWAT(f, tokens, true, 30000, wordSize)
+		wat := string(f.GetOutput())
+
+		for _, want := range []string{`(func $main (export "_start")`, "call $fd_write", "call $fd_read", "i32.mul", "i32.div_u", ";; Pos 1:"} {
+			if !strings.Contains(wat, want) {
+				t.Errorf("-w %d: no %q in the output", wordSize, want)
+			}
+		}
+		blocks := strings.Count(wat, "block\n") + strings.Count(wat, "loop\n") + strings.Count(wat, "if\n")
+		if ends := strings.Count(wat, "end\n"); blocks != ends {
+			t.Errorf("-w %d: %d blocks but %d ends", wordSize, blocks, ends)
+		}
+	}
+
+	g.SignedCells = true
+	defer func() { g.SignedCells = false }()
+	f := g.NewGeneratorOutputString()
+	g.PrintWAT(f, tokens, false, 30000, 16)
+	if wat := string(f.GetOutput()); !strings.Contains(wat, "i32.load16_s") || strings.Contains(wat, "i32.load16_u") {
+		t.Errorf("signed cells are not loaded as signed")
+	}
+}
+
+// wasmReader decodes the WebAssembly binary format, independently of the generator
+type wasmReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *wasmReader) byte() byte {
+	if r.pos >= len(r.data) {
+		panic(fmt.Sprintf("unexpected end at %d", r.pos))
+	}
+	r.pos++
+	return r.data[r.pos-1]
+}
+
+func (r *wasmReader) u32() uint32 {
+	v, shift := uint32(0), 0
+	for {
+		b := r.byte()
+		v |= uint32(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			return v
+		}
+	}
+}
+
+func (r *wasmReader) i32() int32 {
+	v, shift := int32(0), 0
+	for {
+		b := r.byte()
+		v |= int32(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			if shift < 32 && b&0x40 != 0 {
+				v |= -1 << shift
+			}
+			return v
+		}
+	}
+}
+
+func (r *wasmReader) bytes() []byte {
+	n := int(r.u32())
+	if r.pos+n > len(r.data) {
+		panic(fmt.Sprintf("vector of %d bytes at %d does not fit", n, r.pos))
+	}
+	r.pos += n
+	return r.data[r.pos-n : r.pos]
+}
+
+func (r *wasmReader) expect(b byte) {
+	if got := r.byte(); got != b {
+		panic(fmt.Sprintf("got 0x%02x at %d, wanted 0x%02x", got, r.pos-1, b))
+	}
+}
+
+// The instructions the generator uses, with their immediates and the natural alignment of memory accesses
+var wasmOpcodes = map[byte]struct {
+	name  string
+	imm   string
+	align uint32
+}{
+	0x02: {"block", "block", 0}, 0x03: {"loop", "block", 0}, 0x04: {"if", "block", 0}, 0x0b: {"end", "", 0},
+	0x0c: {"br", "label", 0}, 0x0d: {"br_if", "label", 0}, 0x10: {"call", "func", 0}, 0x1a: {"drop", "", 0},
+	0x20: {"local.get", "local", 0}, 0x21: {"local.set", "local", 0}, 0x23: {"global.get", "global", 0}, 0x24: {"global.set", "global", 0},
+	0x28: {"i32.load", "memory", 2}, 0x2c: {"i32.load8_s", "memory", 0}, 0x2d: {"i32.load8_u", "memory", 0},
+	0x2e: {"i32.load16_s", "memory", 1}, 0x2f: {"i32.load16_u", "memory", 1},
+	0x36: {"i32.store", "memory", 2}, 0x3a: {"i32.store8", "memory", 0}, 0x3b: {"i32.store16", "memory", 1},
+	0x41: {"i32.const", "i32", 0}, 0x45: {"i32.eqz", "", 0}, 0x4f: {"i32.ge_u", "", 0},
+	0x6a: {"i32.add", "", 0}, 0x6b: {"i32.sub", "", 0}, 0x6c: {"i32.mul", "", 0}, 0x6d: {"i32.div_s", "", 0}, 0x6e: {"i32.div_u", "", 0},
+}
+
+type wasmFuncType struct{ params, results int }
+
+// decodeWasm decodes a module from the wasm generator, and prints it in the text format like the wat
+// generator does. It uses the names from the name section, and returns the source positions from the
+// bf.positions section, which must point at the start of an instruction.
+func decodeWasm(data []byte) (wat string, positions []string, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	r := &wasmReader{data: data}
+	for _, b := range []byte("\x00asm\x01\x00\x00\x00") {
+		r.expect(b)
+	}
+
+	sections := map[byte]*wasmReader{}
+	custom := map[string]*wasmReader{}
+	var codeStart int
+	last := byte(0)
+	for r.pos < len(data) {
+		id := r.byte()
+		contents := r.bytes()
+		if id == 0 {
+			section := &wasmReader{data: contents}
+			custom[string(section.bytes())] = section
+			continue
+		}
+		if id <= last {
+			return "", nil, fmt.Errorf("section %d after section %d", id, last)
+		}
+		last = id
+		sections[id] = &wasmReader{data: contents}
+		if id == 10 {
+			codeStart = r.pos - len(contents)
+		}
+	}
+
+	// Names from the name section, of functions, locals and globals
+	funcNames := map[uint32]string{}
+	localNames := map[uint32]map[uint32]string{}
+	globalNames := map[uint32]string{}
+	if names := custom["name"]; names != nil {
+		for names.pos < len(names.data) {
+			id := names.byte()
+			sub := &wasmReader{data: names.bytes()}
+			switch id {
+			case 1, 7:
+				for n := sub.u32(); n > 0; n-- {
+					index := sub.u32()
+					if id == 1 {
+						funcNames[index] = string(sub.bytes())
+					} else {
+						globalNames[index] = string(sub.bytes())
+					}
+				}
+			case 2:
+				for n := sub.u32(); n > 0; n-- {
+					fn := sub.u32()
+					localNames[fn] = map[uint32]string{}
+					for m := sub.u32(); m > 0; m-- {
+						local := sub.u32()
+						localNames[fn][local] = string(sub.bytes())
+					}
+				}
+			}
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("(module\n")
+	types := []wasmFuncType{}
+	section := sections[1]
+	for n := section.u32(); n > 0; n-- {
+		section.expect(0x60)
+		t := wasmFuncType{params: int(section.u32())}
+		for i := 0; i < t.params; i++ {
+			section.expect(0x7f)
+		}
+		t.results = int(section.u32())
+		for i := 0; i < t.results; i++ {
+			section.expect(0x7f)
+		}
+		types = append(types, t)
+	}
+	funcTypes := []wasmFuncType{}
+	section = sections[2]
+	for n := section.u32(); n > 0; n-- {
+		module, name := section.bytes(), section.bytes()
+		section.expect(0x00)
+		t := types[section.u32()]
+		index := uint32(len(funcTypes))
+		funcTypes = append(funcTypes, t)
+		fmt.Fprintf(&b, "  (import %q %q (func $%s%s))\n", module, name, funcNames[index], wasmSignature(t, nil))
+	}
+	imported := len(funcTypes)
+	section = sections[3]
+	for n := section.u32(); n > 0; n-- {
+		funcTypes = append(funcTypes, types[section.u32()])
+	}
+
+	section = sections[5]
+	section.expect(1)
+	section.expect(0)
+	fmt.Fprintf(&b, "  (memory (export \"memory\") %d)\n", section.u32())
+	if section = sections[6]; section != nil {
+		for n, i := section.u32(), uint32(0); i < n; i++ {
+			section.expect(0x7f)
+			section.expect(0x01)
+			section.expect(0x41)
+			fmt.Fprintf(&b, "  (global $%s (mut i32) (i32.const %d))\n", globalNames[i], section.i32())
+			section.expect(0x0b)
+		}
+	}
+	exports := map[uint32]string{}
+	section = sections[7]
+	for n := section.u32(); n > 0; n-- {
+		name := string(section.bytes())
+		if kind := section.byte(); kind == 0 {
+			exports[section.u32()] = name
+		} else if index := section.u32(); kind != 2 || index != 0 || name != "memory" {
+			return "", nil, fmt.Errorf("unexpected export %s", name)
+		}
+	}
+	section = sections[11]
+	for n := section.u32(); n > 0; n-- {
+		section.expect(0)
+		section.expect(0x41)
+		offset := section.i32()
+		section.expect(0x0b)
+		escaped := ""
+		for _, c := range section.bytes() {
+			if c >= 0x20 && c < 0x7f && c != '"' && c != '\\' {
+				escaped += string(rune(c))
+			} else {
+				escaped += fmt.Sprintf("\\%02x", c)
+			}
+		}
+		fmt.Fprintf(&b, "  (data (i32.const %d) \"%s\")\n", offset, escaped)
+	}
+
+	starts := map[int]bool{}
+	section = sections[10]
+	if int(section.u32()) != len(funcTypes)-imported {
+		return "", nil, fmt.Errorf("the number of function bodies does not match the function section")
+	}
+	for index := uint32(imported); int(index) < len(funcTypes); index++ {
+		body := &wasmReader{data: section.bytes()}
+		bodyStart := codeStart + section.pos - len(body.data)
+		t := funcTypes[index]
+		locals := localNames[index]
+		fmt.Fprintf(&b, "\n  (func $%s", funcNames[index])
+		if export, ok := exports[index]; ok {
+			fmt.Fprintf(&b, " (export %q)", export)
+		}
+		fmt.Fprintf(&b, "%s\n", wasmSignature(t, locals))
+		count := t.params
+		for n := body.u32(); n > 0; n-- {
+			m := int(body.u32())
+			body.expect(0x7f)
+			for i := 0; i < m; i++ {
+				fmt.Fprintf(&b, "    (local $%s i32)\n", locals[uint32(count+i)])
+			}
+			count += m
+		}
+
+		depth := 2
+		for {
+			starts[bodyStart+body.pos] = true
+			code := body.byte()
+			op, ok := wasmOpcodes[code]
+			if !ok {
+				return "", nil, fmt.Errorf("unknown opcode 0x%02x", code)
+			}
+			if code == 0x0b {
+				depth--
+				if depth == 1 {
+					break
+				}
+			}
+			text := op.name
+			switch op.imm {
+			case "block":
+				body.expect(0x40)
+			case "label":
+				text += fmt.Sprintf(" %d", body.u32())
+			case "func":
+				text += " $" + funcNames[body.u32()]
+			case "local":
+				text += " $" + locals[body.u32()]
+			case "global":
+				text += " $" + globalNames[body.u32()]
+			case "memory":
+				if align := body.u32(); align > op.align {
+					return "", nil, fmt.Errorf("%s with alignment %d", op.name, align)
+				}
+				if offset := body.u32(); offset != 0 {
+					text += fmt.Sprintf(" offset=%d", offset)
+				}
+			case "i32":
+				text += fmt.Sprintf(" %d", body.i32())
+			}
+			fmt.Fprintf(&b, "%s%s\n", strings.Repeat("  ", depth), text)
+			if op.imm == "block" {
+				depth++
+			}
+		}
+		if body.pos != len(body.data) {
+			return "", nil, fmt.Errorf("function %d has %d bytes after its end", index, len(body.data)-body.pos)
+		}
+		b.WriteString("  )\n")
+	}
+	b.WriteString(")\n")
+
+	if section = custom["bf.positions"]; section != nil {
+		for n := section.u32(); n > 0; n-- {
+			offset := int(section.u32())
+			if !starts[offset] {
+				return "", nil, fmt.Errorf("position at 0x%x is not the start of an instruction", offset)
+			}
+			positions = append(positions, fmt.Sprintf("%d:%d", section.u32(), section.u32()))
+		}
+	}
+	return b.String(), positions, nil
+}
+
+func wasmSignature(t wasmFuncType, locals map[uint32]string) string {
+	signature := ""
+	for i := 0; i < t.params; i++ {
+		if name, ok := locals[uint32(i)]; ok {
+			signature += fmt.Sprintf(" (param $%s i32)", name)
+		} else {
+			signature += " (param i32)"
+		}
+	}
+	if t.results > 0 {
+		signature += " (result" + strings.Repeat(" i32", t.results) + ")"
+	}
+	return signature
+}
+
+func TestWASMGenerator(t *testing.T) {
+	runner := filepath.Join(t.TempDir(), "run.js")
+	err := os.WriteFile(runner, []byte(`const { WASI } = require("wasi");
+const wasi = new WASI({ version: "preview1" });
+const wasm = new WebAssembly.Module(require("fs").readFileSync(process.argv[2]));
+wasi.start(new WebAssembly.Instance(wasm, wasi.getImportObject()));
+`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(input []byte) func(file string) *exec.Cmd {
+		return func(file string) *exec.Cmd {
+			cmd := exec.Command("node", "--no-warnings", runner, file)
+			cmd.Stdin = bytes.NewReader(input)
+			return cmd
+		}
+	}
+
+	programs := []struct {
+		file  string
+		input []byte
+	}{
+		{"testdata/test14.bf", nil},
+		{"brainfuck/tictactoe.bf", []byte("5\n8\n3\n4\n")},
+	}
+	for _, program := range programs {
+		tokens := p.Optimize2(p.Optimize(p.ParseFile(program.file)), "wasm")
+		for _, wordSize := range []int{8, 16, 32} {
+			f := g.NewGeneratorOutputString()
+			g.PrintWASM(f, tokens, true, 30000, wordSize)
+			wasm := f.GetOutput()
+
+			// The decoded module is the same as the text format, and has the same source positions
+			f = g.NewGeneratorOutputString()
+			g.PrintWAT(f, tokens, true, 30000, wordSize)
+			commented := string(f.GetOutput())
+			f = g.NewGeneratorOutputString()
+			g.PrintWAT(f, tokens, false, 30000, wordSize)
+			decoded, positions, err := decodeWasm(wasm)
+			if err != nil {
+				t.Fatalf("%s -w %d: %v", program.file, wordSize, err)
+			}
+			if decoded != string(f.GetOutput()) {
+				t.Errorf("%s -w %d: the decoded module differs from the text format:\n%s", program.file, wordSize, decoded)
+			}
+			wantPositions := []string{}
+			for _, line := range strings.Split(commented, "\n") {
+				if fields := strings.Fields(line); len(fields) > 2 && fields[0] == ";;" {
+					wantPositions = append(wantPositions, fields[2])
+				}
+			}
+			if strings.Join(positions, " ") != strings.Join(wantPositions, " ") {
+				t.Errorf("%s -w %d: got positions %v, wanted %v", program.file, wordSize, positions, wantPositions)
+			}
+
+			out := bytes.NewBuffer([]byte{})
+			i.InterpretTokensWithOptions(tokens, 30000, bytes.NewReader(program.input), bfutils.WrapBuffer(out), wordSize, i.Options{})
+			t.Run(fmt.Sprintf("%s -w %d", filepath.Base(program.file), wordSize), func(t *testing.T) {
+				if got := runGenerated(t, wasm, ".wasm", run(program.input)); !bytes.Equal(got, out.Bytes()) {
+					t.Errorf("got %q, wanted %q", got, out.Bytes())
+				}
+			})
+		}
+	}
+
+	// Without comments there are no custom sections
+	tokens := p.ParseFile("testdata/test13.bf")
+	f := g.NewGeneratorOutputString()
+	g.PrintWASM(f, tokens, false, 10, 8)
+	if _, positions, err := decodeWasm(f.GetOutput()); err != nil || positions != nil {
+		t.Errorf("got positions %v (%v), wanted none", positions, err)
+	}
+
+	// The tape initialization and the input are data segments
+	g.TapeInit = []bfutils.TapeInit{{Offset: 0, Data: []byte(">Xi!")}}
+	g.EmbeddedInput = []byte("abc")
+	defer func() {
+		g.TapeInit = nil
+		g.EmbeddedInput = nil
+	}()
+	for _, wordSize := range []int{8, 16, 32} {
+		f := g.NewGeneratorOutputString()
+		g.PrintWASM(f, tokens, false, 10, wordSize)
+		t.Run(fmt.Sprintf("embedded -w %d", wordSize), func(t *testing.T) {
+			if got := runGenerated(t, f.GetOutput(), ".wasm", run(nil)); string(got) != ">Xi!abc" {
+				t.Errorf("got %q, wanted %q", got, ">Xi!abc")
+			}
+		})
+	}
+}
+
+// assemblyTarget is a Linux architecture an assembly generator writes code for
+type assemblyTarget struct {
+	generator string
+	print     func(f *g.GeneratorOutput, tokens []g.ParseToken, includeComments bool, memorySize int, wordSize int)
+	goarch    string
+	// Prefix of the cross binutils, and the qemu-user emulator
+	cross string
+	qemu  string
+	// llvm-mc options to only assemble the code, when it can not be run
+	llvmMC []string
+}
+
+// testAssemblyGenerator links the output of an assembly generator, runs it natively or under
+// qemu-user, and compares it with the interpreter. Without the tools it checks that the code
+// assembles with llvm-mc, and is skipped, as it could not be linked and run.
+func testAssemblyGenerator(t *testing.T, target assemblyTarget) {
+	as, ld, run := target.cross+"as", target.cross+"ld", []string{target.qemu}
+	if runtime.GOOS == "linux" && runtime.GOARCH == target.goarch {
+		as, ld, run = "as", "ld", nil
+	}
+	installed := func(tools ...string) bool {
+		for _, tool := range tools {
+			if _, err := exec.LookPath(tool); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+	canRun := installed(append([]string{as, ld}, run...)...)
+	if !canRun && !installed("llvm-mc") {
+		t.Skipf("no assembler for %s", target.generator)
+	}
+	command := func(args ...string) {
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			t.Fatalf("%v failed: %v\n%s", args, err, out)
+		}
+	}
+
+	programs := []struct {
+		file  string
+		input []byte
+	}{
+		{"testdata/test14.bf", nil},
+		{"brainfuck/tictactoe.bf", []byte("5\n8\n3\n4\n")},
+	}
+	for _, program := range programs {
+		for _, tokens := range [][]g.ParseToken{p.ParseFile(program.file), p.Optimize2(p.Optimize(p.ParseFile(program.file)), target.generator)} {
+			for _, wordSize := range []int{8, 16, 32} {
+				f := g.NewGeneratorOutputString()
+				target.print(f, tokens, true, 30000, wordSize)
+				dir := t.TempDir()
+				file, obj, exe := filepath.Join(dir, "main.s"), filepath.Join(dir, "main.o"), filepath.Join(dir, "main")
+				if err := os.WriteFile(file, f.GetOutput(), 0666); err != nil {
+					t.Fatal(err)
+				}
+				if !canRun {
+					command(append(append([]string{"llvm-mc"}, target.llvmMC...), "-filetype=obj", "-o", obj, file)...)
+					continue
+				}
+				command(as, "-o", obj, file)
+				command(ld, "-o", exe, obj)
+
+				want := bytes.NewBuffer([]byte{})
+				i.InterpretTokensWithOptions(tokens, 30000, bytes.NewReader(program.input), bfutils.WrapBuffer(want), wordSize, i.Options{})
+				args := append(run, exe)
+				cmd := exec.Command(args[0], args[1:]...)
+				cmd.Stdin = bytes.NewReader(program.input)
+				if got, err := cmd.Output(); err != nil || !bytes.Equal(got, want.Bytes()) {
+					t.Errorf("%s -w %d: got %q (%v), wanted %q", program.file, wordSize, got, err, want.Bytes())
+				}
+			}
+		}
+	}
+	if !canRun {
+		t.Skipf("only assembled with llvm-mc, as %s, %s or %s is not installed", as, ld, strings.Join(run, " "))
+	}
+}
+
+func TestX86_64Generator(t *testing.T) {
+	testAssemblyGenerator(t, assemblyTarget{"x86_64", g.PrintX86_64, "amd64", "x86_64-linux-gnu-", "qemu-x86_64", []string{"-triple=x86_64-linux-gnu"}})
+}
+
+func TestARM64Generator(t *testing.T) {
+	testAssemblyGenerator(t, assemblyTarget{"arm64", g.PrintARM64, "arm64", "aarch64-linux-gnu-", "qemu-aarch64", []string{"-triple=aarch64-linux-gnu"}})
+}
+
+func TestRISCV64Generator(t *testing.T) {
+	// The linker relaxes la into an addi from gp, so gp has to be loaded first, without relaxing
+	f := g.NewGeneratorOutputString()
+	g.PrintRISCV64(f, p.ParseFile("brainfuck/hello.bf"), false, 30000, 8)
+	if code := string(f.GetOutput()); !strings.Contains(code, "_start:\n\t.option push\n\t.option norelax\n\tla gp, __global_pointer$\n\t.option pop\n") {
+		t.Errorf("gp is not loaded at _start:\n%s", code)
+	}
+
+	testAssemblyGenerator(t, assemblyTarget{"riscv64", g.PrintRISCV64, "riscv64", "riscv64-linux-gnu-", "qemu-riscv64", []string{"-triple=riscv64-linux-gnu", "-mattr=+m,+a,+f,+d,+c"}})
+}
+
+func TestELFGenerator(t *testing.T) {
+	programs := []struct {
+		file  string
+		input []byte
+	}{
+		{"testdata/test14.bf", nil},
+		{"brainfuck/tictactoe.bf", []byte("5\n8\n3\n4\n")},
+	}
+	for _, program := range programs {
+		for _, tokens := range [][]g.ParseToken{p.ParseFile(program.file), p.Optimize2(p.Optimize(p.ParseFile(program.file)), "elf")} {
+			for _, wordSize := range []int{8, 16, 32} {
+				f := g.NewGeneratorOutputString()
+				g.PrintELF(f, tokens, true, 30000, wordSize)
+				exe, err := elf.NewFile(bytes.NewReader(f.GetOutput()))
+				if err != nil {
+					t.Fatalf("%s -w %d: %v", program.file, wordSize, err)
+				}
+				if exe.Type != elf.ET_EXEC || exe.Machine != elf.EM_X86_64 || len(exe.Progs) != 3 {
+					t.Errorf("%s -w %d: got %v %v with %d program headers", program.file, wordSize, exe.Type, exe.Machine, len(exe.Progs))
+				}
+				symbols, err := exe.Symbols()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, symbol := range symbols {
+					if symbol.Name == "_start" && symbol.Value != exe.Entry {
+						t.Errorf("%s -w %d: _start is %#x, the entry is %#x", program.file, wordSize, symbol.Value, exe.Entry)
+					}
+				}
+				if bss := exe.Section(".bss"); bss == nil || bss.Size < uint64(30000*wordSize/8) {
+					t.Errorf("%s -w %d: the tape is not in .bss", program.file, wordSize)
+				}
+				if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+					continue
+				}
+
+				want := bytes.NewBuffer([]byte{})
+				i.InterpretTokensWithOptions(tokens, 30000, bytes.NewReader(program.input), bfutils.WrapBuffer(want), wordSize, i.Options{})
+				file := filepath.Join(t.TempDir(), "main")
+				if err := os.WriteFile(file, f.GetOutput(), 0755); err != nil {
+					t.Fatal(err)
+				}
+				cmd := exec.Command(file)
+				cmd.Stdin = bytes.NewReader(program.input)
+				if got, err := cmd.Output(); err != nil || !bytes.Equal(got, want.Bytes()) {
+					t.Errorf("%s -w %d: got %q (%v), wanted %q", program.file, wordSize, got, err, want.Bytes())
+				}
+			}
+		}
+	}
+}
+
+func TestGoGenerator(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not installed")
+	}
+	programs := []struct {
+		file  string
+		input []byte
+	}{
+		{"testdata/test14.bf", nil},
+		{"brainfuck/tictactoe.bf", []byte("5\n8\n3\n4\n")},
+	}
+	for _, program := range programs {
+		for _, tokens := range [][]g.ParseToken{p.ParseFile(program.file), p.Optimize2(p.Optimize(p.ParseFile(program.file)), "go")} {
+			for _, wordSize := range []int{8, 16, 32, 64} {
+				f := g.NewGeneratorOutputString()
+				g.PrintGo(f, tokens, true, 30000, wordSize)
+
+				// The interpreter has no 64 bit cells, but the programs do not go past 32 bits
+				want := bytes.NewBuffer([]byte{})
+				i.InterpretTokensWithOptions(tokens, 30000, bytes.NewReader(program.input), bfutils.WrapBuffer(want), min(wordSize, 32), i.Options{})
+				got := runGenerated(t, f.GetOutput(), ".go", func(file string) *exec.Cmd {
+					cmd := exec.Command("go", "run", file)
+					cmd.Stdin = bytes.NewReader(program.input)
+					return cmd
+				})
+				if !bytes.Equal(got, want.Bytes()) {
+					t.Errorf("%s -w %d: got %q, wanted %q", program.file, wordSize, got, want.Bytes())
+				}
+			}
+		}
+	}
+
+	// In another package the code has no main function, and Run returns moving off the tape as an error
+	g.GoPackage = "bf"
+	defer func() { g.GoPackage = "main" }()
+	f := g.NewGeneratorOutputString()
+	g.PrintGo(f, p.ParseFile("testdata/test14.bf"), false, 30000, 8)
+	code := string(f.GetOutput())
+	if !strings.Contains(code, "package bf\n") || strings.Contains(code, "func main()") {
+		t.Errorf("-go-package bf: got\n%s", code)
+	}
+	f = g.NewGeneratorOutputString()
+	g.PrintGo(f, []g.ParseToken{{Tok: l.NewToken(l.OUT), Extra: 5000}, {Tok: l.NewToken(l.DECP), Extra: 1}, {Tok: l.NewToken(l.ADD), Extra: 1}}, false, 10, 8)
+	dir := t.TempDir()
+	// The output fills the buffer before the pointer moves, and the panic of the writer
+	// is not returned as moving off the tape
+	mainGo := `package main
+
+import (
+	"example/bf"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type panicWriter struct{ panicked bool }
+
+func (w *panicWriter) Write(p []byte) (int, error) {
+	if !w.panicked {
+		w.panicked = true
+		panic("write")
+	}
+	return len(p), nil
+}
+
+func main() {
+	fmt.Print(bf.Run(strings.NewReader(""), io.Discard))
+	defer func() { fmt.Print(", panic: ", recover()) }()
+	fmt.Print(bf.Run(strings.NewReader(""), &panicWriter{}))
+}
+`
+	for name, content := range map[string]string{
+		"go.mod":   "module example\n\ngo 1.21\n",
+		"bf/bf.go": string(f.GetOutput()),
+		"main.go":  mainGo,
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0777)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command("go", "run", ".")
+	cmd.Dir = dir
+	if got, err := cmd.Output(); err != nil || string(got) != "the pointer moved off the tape to -1, panic: write" {
+		t.Errorf("got %q (%v), wanted an error for moving off the tape and the panic of the writer", got, err)
+	}
+}
+
+func TestRustGenerator(t *testing.T) {
+	if _, err := exec.LookPath("rustc"); err != nil {
+		t.Skip("rustc is not installed")
+	}
+	compile := func(code []byte, args ...string) string {
+		dir := t.TempDir()
+		file, exe := filepath.Join(dir, "main.rs"), filepath.Join(dir, "main")
+		if err := os.WriteFile(file, code, 0666); err != nil {
+			t.Fatal(err)
+		}
+		// Overflow checks are on in debug builds, so every cell must wrap around explicitly
+		args = append(args, "-o", exe, file)
+		if out, err := exec.Command("rustc", args...).CombinedOutput(); err != nil || len(out) > 0 {
+			t.Fatalf("rustc failed: %v\n%s", err, out)
+		}
+		return exe
+	}
+
+	programs := []struct {
+		file  string
+		input []byte
+	}{
+		{"testdata/test14.bf", nil},
+		{"brainfuck/tictactoe.bf", []byte("5\n8\n3\n4\n")},
+	}
+	for _, program := range programs {
+		for _, tokens := range [][]g.ParseToken{p.ParseFile(program.file), p.Optimize2(p.Optimize(p.ParseFile(program.file)), "rust")} {
+			for _, wordSize := range []int{8, 16, 32, 64} {
+				f := g.NewGeneratorOutputString()
+				g.PrintRust(f, tokens, true, 30000, wordSize)
+
+				// The interpreter has no 64 bit cells, but the programs do not go past 32 bits
+				want := bytes.NewBuffer([]byte{})
+				i.InterpretTokensWithOptions(tokens, 30000, bytes.NewReader(program.input), bfutils.WrapBuffer(want), min(wordSize, 32), i.Options{})
+				cmd := exec.Command(compile(f.GetOutput()))
+				cmd.Stdin = bytes.NewReader(program.input)
+				if got, err := cmd.Output(); err != nil || !bytes.Equal(got, want.Bytes()) {
+					t.Errorf("%s -w %d: got %q (%v), wanted %q", program.file, wordSize, got, err, want.Bytes())
+				}
+			}
+		}
+	}
+
+	// The bounds_checks feature reports moving off the tape with the position of the move
+	f := g.NewGeneratorOutputString()
+	g.PrintRust(f, p.ParseFile("testdata/test08.bf"), false, 30000, 8)
+	cmd := exec.Command(compile(f.GetOutput(), "--cfg", `feature="bounds_checks"`))
+	stderr := bytes.NewBuffer([]byte{})
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err == nil || !strings.HasPrefix(stderr.String(), "Error: the pointer moved off the tape at line ") {
+		t.Errorf("got %q (%v), wanted an error for moving off the tape", stderr.String(), err)
+	}
+
+	// The cells at an offset are checked too, here the one before the tape
+	for _, id := range []l.TokenId{l.MUL, l.DIV, l.MOV} {
+		f = g.NewGeneratorOutputString()
+		g.PrintRust(f, []g.ParseToken{
+			{Tok: l.NewToken(l.ADD), Extra: 1},
+			{Tok: l.NewToken(id), Extra: 1, Extra2: -1},
+		}, false, 30000, 8)
+		cmd = exec.Command(compile(f.GetOutput(), "--cfg", `feature="bounds_checks"`))
+		stderr.Reset()
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err == nil || !strings.HasPrefix(stderr.String(), "Error: the pointer moved off the tape at line ") {
+			t.Errorf("%v: got %q (%v), wanted an error for moving off the tape", id, stderr.String(), err)
+		}
+	}
+}
+
+func TestPythonGenerator(t *testing.T) {
+	programs := []struct {
+		file  string
+		input []byte
+	}{
+		{"testdata/test14.bf", nil},
+		{"brainfuck/tictactoe.bf", []byte("5\n8\n3\n4\n")},
+	}
+	for _, program := range programs {
+		for _, tokens := range [][]g.ParseToken{p.ParseFile(program.file), p.Optimize2(p.Optimize(p.ParseFile(program.file)), "python")} {
+			for _, wordSize := range []int{8, 16, 32} {
+				f := g.NewGeneratorOutputString()
+				g.PrintPython(f, tokens, true, 30000, wordSize)
+				if first := tokens[0].Pos; !strings.Contains(string(f.GetOutput()), fmt.Sprintf("    # Line %d, Pos %d: ", first.Line, first.Column)) {
+					t.Errorf("%s -w %d: no source positions in the comments", program.file, wordSize)
+				}
+
+				want := bytes.NewBuffer([]byte{})
+				i.InterpretTokensWithOptions(tokens, 30000, bytes.NewReader(program.input), bfutils.WrapBuffer(want), wordSize, i.Options{})
+				t.Run(fmt.Sprintf("%s -w %d", filepath.Base(program.file), wordSize), func(t *testing.T) {
+					got := runGenerated(t, f.GetOutput(), ".py", func(file string) *exec.Cmd {
+						cmd := exec.Command("python3", file)
+						cmd.Stdin = bytes.NewReader(program.input)
+						return cmd
+					})
+					if !bytes.Equal(got, want.Bytes()) {
+						t.Errorf("got %q, wanted %q", got, want.Bytes())
+					}
+				})
+			}
+		}
+	}
+
+	// Empty loops need a pass, and the if of BZ ends at its LBL
+	tokens := []g.ParseToken{
+		{Tok: l.NewToken(l.JMPF), Extra: 1},
+		{Tok: l.NewToken(l.JMPB), Extra: 1},
+		{Tok: l.NewToken(l.ADD), Extra: 65},
+		{Tok: l.NewToken(l.BZ), Extra: 1},
+		{Tok: l.NewToken(l.OUT), Extra: 1},
+		{Tok: l.NewToken(l.LBL), Extra: 1},
+		{Tok: l.NewToken(l.OUT), Extra: 2},
+	}
+	f := g.NewGeneratorOutputString()
+	g.PrintPython(f, tokens, false, 10, 8)
+	code := string(f.GetOutput())
+	if !strings.Contains(code, "    while mem[p]:\n        pass\n") || !strings.Contains(code, "    if mem[p]:\n        output(mem[p])\n    for _ in range(2):\n") {
+		t.Errorf("got\n%s", code)
+	}
+	if got := runGenerated(t, f.GetOutput(), ".py", func(file string) *exec.Cmd { return exec.Command("python3", file) }); string(got) != "AAA" {
+		t.Errorf("got %q, wanted %q", got, "AAA")
+	}
+
+	// Python would use the end of the tape below zero, so the pointer is checked when it moves left
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is not installed")
+	}
+	for _, program := range [][]g.ParseToken{
+		{{Tok: l.NewToken(l.DECP), Extra: 1}},
+		{{Tok: l.NewToken(l.ADD), Extra: 1}, {Tok: l.NewToken(l.SCANL), Extra: 1}},
+		{{Tok: l.NewToken(l.ADD), Extra: 1}, {Tok: l.NewToken(l.MUL), Extra: 1, Extra2: -1}},
+	} {
+		f := g.NewGeneratorOutputString()
+		g.PrintPython(f, program, false, 10, 8)
+		file := filepath.Join(t.TempDir(), "main.py")
+		if err := os.WriteFile(file, f.GetOutput(), 0666); err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command("python3", file).CombinedOutput()
+		if err == nil || !strings.Contains(string(out), "IndexError: the pointer moved off the tape to -1") {
+			t.Errorf("%v: got %q (%v), wanted an error for moving off the tape", program[len(program)-1].Tok, out, err)
+		}
+	}
+}
+
+func TestAwkGenerator(t *testing.T) {
+	programs := []struct {
+		file  string
+		input []byte
+	}{
+		{"testdata/test14.bf", nil},
+		{"brainfuck/tictactoe.bf", []byte("5\n8\n3\n4\n")},
+	}
+	for _, program := range programs {
+		for _, tokens := range [][]g.ParseToken{p.ParseFile(program.file), p.Optimize2(p.Optimize(p.ParseFile(program.file)), "awk")} {
+			for _, wordSize := range []int{8, 16, 32} {
+				f := g.NewGeneratorOutputString()
+				g.PrintAwk(f, tokens, true, 30000, wordSize)
+
+				want := bytes.NewBuffer([]byte{})
+				i.InterpretTokensWithOptions(tokens, 30000, bytes.NewReader(program.input), bfutils.WrapBuffer(want), wordSize, i.Options{})
+				t.Run(fmt.Sprintf("%s -w %d", filepath.Base(program.file), wordSize), func(t *testing.T) {
+					got := runGenerated(t, f.GetOutput(), ".awk", func(file string) *exec.Cmd {
+						cmd := exec.Command("awk", "-f", file)
+						cmd.Env = append(os.Environ(), "LC_ALL=C")
+						cmd.Stdin = bytes.NewReader(program.input)
+						return cmd
+					})
+					if !bytes.Equal(got, want.Bytes()) {
+						t.Errorf("got %q, wanted %q", got, want.Bytes())
+					}
+				})
+			}
+		}
+	}
+
+	// Bytes above 127 are read through the table made with printf "%c", and written with it
+	tokens := p.ParseFile("testdata/test11.bf")
+	input := []byte("caf\xe9 \x80\xff\n")
+	want := bytes.NewBuffer([]byte{})
+	i.InterpretTokensWithOptions(tokens, 10, bytes.NewReader(input), bfutils.WrapBuffer(want), 8, i.Options{})
+	f := g.NewGeneratorOutputString()
+	g.PrintAwk(f, tokens, false, 10, 8)
+	got := runGenerated(t, f.GetOutput(), ".awk", func(file string) *exec.Cmd {
+		cmd := exec.Command("awk", "-f", file)
+		cmd.Env = append(os.Environ(), "LC_ALL=C")
+		cmd.Stdin = bytes.NewReader(input)
+		return cmd
+	})
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("got %q, wanted %q", got, want.Bytes())
+	}
+}
+
+func TestInterpreterSnapshotResume(t *testing.T) {
+	tokens := p.ParseFile("brainfuck/tictactoe.bf")
+	input := []byte("5\n8\n3\n4\n")
+	out := bytes.NewBuffer([]byte{})
+
+	result := i.InterpretTokensWithOptions(tokens, 30000, bytes.NewReader(input), bfutils.WrapBuffer(out), 8, i.Options{MaxSteps: 50000})
+	if result.Reason != i.ExitStepLimit {
+		t.Fatalf("got %v, wanted %v", result.Reason, i.ExitStepLimit)
+	}
+
+	data, err := result.State.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	state := &i.State{}
+	if err := state.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+
+	in := bytes.NewReader(input[state.InputPos:])
+	result = i.InterpretTokensWithOptions(tokens, 30000, in, bfutils.WrapBuffer(out), 8, i.Options{Resume: state})
+	if result.Reason != i.ExitCompleted {
+		t.Fatalf("got %v, wanted %v", result.Reason, i.ExitCompleted)
+	}
+
+	got := out.Bytes()
+	want := wantOutput("tictactoe")
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+func TestInterpreterTapeLimitResume(t *testing.T) {
+	// +[>+] walks off the end of the tape
+	tokens := []g.ParseToken{
+		{Tok: l.NewToken(l.ADD), Extra: 1},
+		{Tok: l.NewToken(l.JMPF), Extra: 1},
+		{Tok: l.NewToken(l.INCP), Extra: 1},
+		{Tok: l.NewToken(l.ADD), Extra: 1},
+		{Tok: l.NewToken(l.JMPB), Extra: 1},
+	}
+
+	// Without hooks and with hooks the interpreter runs different loops
+	for _, prof := range []*i.Profile{nil, i.NewProfile(tokens)} {
+		out := bytes.NewBuffer([]byte{})
+		result := i.InterpretTokensWithOptions(tokens, 10, bytes.NewReader(nil), bfutils.WrapBuffer(out), 8, i.Options{Profile: prof})
+		if result.Reason != i.ExitTapeLimit || result.Pointer != 10 {
+			t.Fatalf("got %v at %d, wanted %v at 10", result.Reason, result.Pointer, i.ExitTapeLimit)
+		}
+
+		data, err := result.State.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary: %v", err)
+		}
+		state := &i.State{}
+		if err := state.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary: %v", err)
+		}
+
+		// With room for 5 more cells the program continues with the move that failed
+		result = i.InterpretTokensWithOptions(tokens, 10, bytes.NewReader(nil), bfutils.WrapBuffer(out), 8, i.Options{Resume: state, MaxTapeGrowth: 5, Profile: prof})
+		if result.Reason != i.ExitTapeLimit || result.Pointer != 15 {
+			t.Fatalf("got %v at %d, wanted %v at 15", result.Reason, result.Pointer, i.ExitTapeLimit)
+		}
+		if len(result.State.Tape) != 15 {
+			t.Fatalf("got %d cells, wanted 15", len(result.State.Tape))
+		}
+		for addr, v := range result.State.Tape {
+			if v != 1 {
+				t.Errorf("got p[%d]=%d, wanted 1", addr, v)
+			}
+		}
+	}
+}
+
+func TestInterpreterOutputLimitResume(t *testing.T) {
+	// +++++ +++++ [>+++++ ++<-] >+ .....
+	tokens := []g.ParseToken{
+		{Tok: l.NewToken(l.ADD), Extra: 10},
+		{Tok: l.NewToken(l.JMPF), Extra: 1},
+		{Tok: l.NewToken(l.INCP), Extra: 1},
+		{Tok: l.NewToken(l.ADD), Extra: 7},
+		{Tok: l.NewToken(l.DECP), Extra: 1},
+		{Tok: l.NewToken(l.SUB), Extra: 1},
+		{Tok: l.NewToken(l.JMPB), Extra: 1},
+		{Tok: l.NewToken(l.INCP), Extra: 1},
+		{Tok: l.NewToken(l.ADD), Extra: 1},
+		{Tok: l.NewToken(l.OUT), Extra: 5},
+	}
+
+	// Without hooks and with hooks the interpreter runs different loops
+	for _, prof := range []*i.Profile{nil, i.NewProfile(tokens)} {
+		out := bytes.NewBuffer([]byte{})
+		result := i.InterpretTokensWithOptions(tokens, 10, bytes.NewReader(nil), bfutils.WrapBuffer(out), 16, i.Options{MaxOutputBytes: 2, Profile: prof})
+		if result.Reason != i.ExitOutputLimit {
+			t.Fatalf("got %v, wanted %v", result.Reason, i.ExitOutputLimit)
+		}
+
+		data, err := result.State.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary: %v", err)
+		}
+		state := &i.State{}
+		if err := state.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary: %v", err)
+		}
+
+		// The resumed program only writes the rest of the output
+		result = i.InterpretTokensWithOptions(tokens, 10, bytes.NewReader(nil), bfutils.WrapBuffer(out), 16, i.Options{Resume: state, Profile: prof})
+		if result.Reason != i.ExitCompleted {
+			t.Fatalf("got %v, wanted %v", result.Reason, i.ExitCompleted)
+		}
+		if got := out.String(); got != "GGGGG" {
+			t.Errorf("got %q, wanted %q", got, "GGGGG")
+		}
+	}
+}
+
+func TestSnapshotTapeLength(t *testing.T) {
+	tokens := p.ParseFile("brainfuck/hello.bf")
+	out := bytes.NewBuffer([]byte{})
+	result := i.InterpretTokensWithOptions(tokens, 10, bytes.NewReader(nil), bfutils.WrapBuffer(out), 16, i.Options{MaxSteps: 10})
+	data, err := result.State.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+
+	// A tape length that only matches the rest of the data when it is multiplied with overflow
+	tapeLen := len(data) - 8 - 2*len(result.State.Tape)
+	binary.LittleEndian.PutUint64(data[tapeLen:], 1<<63|uint64(len(result.State.Tape)))
+	state := &i.State{}
+	if err := state.UnmarshalBinary(data); err == nil {
+		t.Errorf("corrupt tape length was read")
+	}
+}
+
+func TestInterpreterNewlineResume(t *testing.T) {
+	// Read and output 9 bytes
+	tokens := p.ParseFile("testdata/test12.bf")
+	input := []byte("a\r\nb")
+
+	for _, newlines := range []bfutils.Newlines{bfutils.NewlinesLF, bfutils.NewlinesCRLFIn} {
+		opts := i.Options{IO: bfutils.IOMode{Newlines: newlines}}
+		want := bytes.NewBuffer([]byte{})
+		i.InterpretTokensWithOptions(tokens, 10, bytes.NewReader(input), bfutils.WrapBuffer(want), 8, opts)
+
+		// Stop in every place, also between the CR and the LF of the line ending
+		for steps := uint64(1); steps < uint64(len(tokens)); steps++ {
+			out := bytes.NewBuffer([]byte{})
+			stopOpts := opts
+			stopOpts.MaxSteps = steps
+			result := i.InterpretTokensWithOptions(tokens, 10, bytes.NewReader(input), bfutils.WrapBuffer(out), 8, stopOpts)
+			if result.Reason != i.ExitStepLimit {
+				t.Fatalf("%s after %d steps: got %v, wanted %v", newlines, steps, result.Reason, i.ExitStepLimit)
+			}
+
+			data, err := result.State.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+			state := &i.State{}
+			if err := state.UnmarshalBinary(data); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+
+			resumeOpts := opts
+			resumeOpts.Resume = state
+			i.InterpretTokensWithOptions(tokens, 10, bytes.NewReader(input[state.InputPos:]), bfutils.WrapBuffer(out), 8, resumeOpts)
+			if !bytes.Equal(out.Bytes(), want.Bytes()) {
+				t.Errorf("%s after %d steps: got %q, wanted %q", newlines, steps, out.Bytes(), want.Bytes())
+			}
+		}
+	}
+}
+
+func TestInterpreterBigSnapshotResume(t *testing.T) {
+	tokens := p.ParseFile("brainfuck/hello.bf")
+	out := bytes.NewBuffer([]byte{})
+
+	result := i.InterpretTokensWithOptions(tokens, 100, bytes.NewReader(nil), bfutils.WrapBuffer(out), i.WordSizeBig, i.Options{MaxSteps: 300})
+	if result.Reason != i.ExitStepLimit {
+		t.Fatalf("got %v, wanted %v", result.Reason, i.ExitStepLimit)
+	}
+	// A negative cell has to survive the snapshot file as well
+	result.State.BigTape[99].Lsh(big.NewInt(-1), 70)
+
+	data, err := result.State.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	state := &i.State{}
+	if err := state.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if state.BigTape[99].Cmp(result.State.BigTape[99]) != 0 {
+		t.Errorf("got p[99]=%v, wanted %v", state.BigTape[99], result.State.BigTape[99])
+	}
+
+	result = i.InterpretTokensWithOptions(tokens, 100, bytes.NewReader(nil), bfutils.WrapBuffer(out), i.WordSizeBig, i.Options{Resume: state, Signed: true})
+	if result.Reason != i.ExitCompleted {
+		t.Fatalf("got %v, wanted %v", result.Reason, i.ExitCompleted)
+	}
+	if got := out.String(); got != "Hello World!\n" {
+		t.Errorf("got %q, wanted %q", got, "Hello World!\n")
+	}
+}
+
+type countingObserver struct {
+	i.NopObserver
+	steps      int
+	output     []byte
+	loopDepth  int
+	tapeWrites map[int]uint64
+}
+
+func (o *countingObserver) OnStep(pc int, t g.ParseToken, pointer int) { o.steps++ }
+func (o *countingObserver) OnOutput(value byte)                        { o.output = append(o.output, value) }
+func (o *countingObserver) OnLoopEnter(pc int)                         { o.loopDepth++ }
+func (o *countingObserver) OnLoopExit(pc int)                          { o.loopDepth-- }
+func (o *countingObserver) OnTapeWrite(addr int, value uint64)         { o.tapeWrites[addr] = value }
+
+func TestInterpreterObserver(t *testing.T) {
+	tokens := p.ParseFile("brainfuck/hello.bf")
+	tokens = p.Optimize(tokens)
+	tokens = p.Optimize2(tokens, "")
+
+	out := bytes.NewBuffer([]byte{})
+	obs := &countingObserver{tapeWrites: make(map[int]uint64)}
+	result := i.InterpretTokensWithOptions(tokens, 30000, bytes.NewReader(nil), bfutils.WrapBuffer(out), 8, i.Options{Observer: obs})
+
+	if uint64(obs.steps) != result.Steps {
+		t.Errorf("got %d steps, wanted %d", obs.steps, result.Steps)
+	}
+	if !bytes.Equal(obs.output, out.Bytes()) {
+		t.Errorf("got output %q, wanted %q", obs.output, out.Bytes())
+	}
+	if obs.loopDepth != 0 {
+		t.Errorf("got loop depth %d after running, wanted 0", obs.loopDepth)
+	}
+	if obs.tapeWrites[result.State.Pointer] != result.State.Tape[result.State.Pointer] {
+		t.Errorf("got last write %d to p[%d], wanted %d", obs.tapeWrites[result.State.Pointer], result.State.Pointer, result.State.Tape[result.State.Pointer])
+	}
+}
+
+// Every token the lexer knows about must be supported by the interpreter,
+// so that optimized token streams can always be validated with -i
+func TestInterpreterSupportsAllTokens(t *testing.T) {
+	for _, id := range l.TokenIds() {
+		tokens := []g.ParseToken{
+			{Tok: l.NewToken(l.ADD), Extra: 1},
+			{Tok: l.NewToken(id), Extra: 1, Extra2: 1},
+		}
+		out := bytes.NewBuffer([]byte{})
+
+		result := i.InterpretTokensWithOptions(tokens, 30000, bytes.NewReader([]byte("x")), bfutils.WrapBuffer(out), 8, i.Options{MaxSteps: 1000})
+		if result.Reason == i.ExitError {
+			t.Errorf("token %s: %v", l.NewToken(id).TokenName, result.Err)
+		}
+	}
+}
+
+func TestInterpreterScanAndPrint(t *testing.T) {
+	tokens := []g.ParseToken{
+		{Tok: l.NewToken(l.MOV), Extra: 'h', Extra2: 1},
+		{Tok: l.NewToken(l.MOV), Extra: 'i', Extra2: 2},
+		{Tok: l.NewToken(l.INCP), Extra: 1},
+		{Tok: l.NewToken(l.PRNT)},
+		{Tok: l.NewToken(l.ADD), Extra: 1},
+		{Tok: l.NewToken(l.SCANL)},
+		{Tok: l.NewToken(l.INCP), Extra: 1},
+		{Tok: l.NewToken(l.SCANR)},
+		{Tok: l.NewToken(l.NOP)},
+	}
+	out := bytes.NewBuffer([]byte{})
+
+	result := i.InterpretTokensWithOptions(tokens, 30000, bytes.NewReader(nil), bfutils.WrapBuffer(out), 8, i.Options{})
+	if got := out.String(); got != "hi" {
+		t.Errorf("got output %q, wanted %q", got, "hi")
+	}
+	if result.Reason != i.ExitCompleted || result.Pointer != 4 {
+		t.Errorf("got %v at p=%d, wanted %v at p=4", result.Reason, result.Pointer, i.ExitCompleted)
+	}
+}
+
+// Buffered writer that keeps track of what has been flushed
+type flushRecorder struct {
+	pending bytes.Buffer
+	flushed bytes.Buffer
+}
+
+func (w *flushRecorder) Write(p []byte) (int, error) {
+	return w.pending.Write(p)
+}
+
+func (w *flushRecorder) Flush() error {
+	_, err := w.pending.WriteTo(&w.flushed)
+	return err
+}
+
+type promptChecker struct {
+	in  *bytes.Reader
+	out *flushRecorder
+	t   *testing.T
+}
+
+func (r promptChecker) Read(p []byte) (int, error) {
+	if r.out.pending.Len() > 0 {
+		r.t.Errorf("reading input while %q is not flushed", r.out.pending.String())
+	}
+	return r.in.Read(p)
+}
+
+func TestInterpreterFlushOnRead(t *testing.T) {
+	tokens := p.ParseFile("brainfuck/tictactoe.bf")
+
+	for _, policy := range []bfutils.BufferPolicy{bfutils.Unbuffered, bfutils.LineBuffered, bfutils.FullyBuffered} {
+		out := &flushRecorder{}
+		in := bfutils.WrapStdin(promptChecker{bytes.NewReader([]byte("5\n8\n3\n4\n")), out, t}, out, policy)
+		i.InterpretTokens(tokens, 30000, in, out, 8)
+
+		got := out.flushed.Bytes()
+		want := wantOutput("tictactoe")
+
+		if !bytes.Equal(got, want) {
+			t.Errorf("%v: got %q, wanted %q", policy, got, want)
+		}
+	}
+
+	// What each policy has written to stdout after a write without a newline, after one with
+	// a newline, and after reading input
+	wants := map[bfutils.BufferPolicy][3]string{
+		bfutils.Unbuffered:    {"ab", "abc\nd", "abc\nd"},
+		bfutils.LineBuffered:  {"", "abc\nd", "abc\nd"},
+		bfutils.FullyBuffered: {"", "", "abc\nd"},
+	}
+	for policy, want := range wants {
+		file := tempFile()
+		defer file.Remove()
+		stdout, err := os.Create(string(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stdout.Close()
+
+		out := bfutils.WrapStdout(stdout, policy)
+		in := bfutils.WrapStdin(bytes.NewReader([]byte("x")), out, policy)
+		var got [3]string
+		out.Write([]byte("ab"))
+		got[0] = string(file.ReadFile())
+		out.Write([]byte("c\nd"))
+		got[1] = string(file.ReadFile())
+		in.Read(make([]byte, 1))
+		got[2] = string(file.ReadFile())
+
+		if got != want {
+			t.Errorf("%v: got %q, wanted %q", policy, got, want)
+		}
+	}
+}
+
+func TestPortabilityCellSize(t *testing.T) {
+	tokens := p.ParseFile("brainfuck/cellsize.bf")
+
+	for _, pr := range i.CheckPortability(tokens, 30000, []byte{}, i.Options{MaxSteps: 1000000}) {
+		want := fmt.Sprintf("%d bit cells\n", pr.Config.WordSize)
+		if string(pr.Output) != want {
+			t.Errorf("%v: got %q, wanted %q", pr.Config, pr.Output, want)
+		}
+		if pr.Diverges != (pr.Config.WordSize != 8) {
+			t.Errorf("%v: got diverges %v, wanted %v", pr.Config, pr.Diverges, pr.Config.WordSize != 8)
+		}
+		// The first cell that will differ is when 256 is calculated
+		if pr.Config.WordSize != 8 && (!pr.CellsDiffer || pr.FirstDifference != (l.Position{Line: 4, Column: 28})) {
+			t.Errorf("%v: got first difference at %v, wanted 4:28", pr.Config, pr.FirstDifference)
+		}
+	}
+}
@@ -10,6 +10,15 @@ import (
 
 var Debug = false
 
+// Set when the cells are signed. A loop like [-->+<] then is not replaced with
+// a DIV, as signed division does not give the number of times a negative value
+// can be decremented by 2 until it wraps around to 0.
+var SignedCells = false
+
+// Set when the tape is loaded with data before the program starts, so the
+// first cell is not known to be 0 and a loop at the start can not be removed.
+var TapeInitialized = false
+
 // Check if all code inside a loop is inc/dec/incp/decp
 func isSimpleLoop(tokens []g.ParseToken) (bool, int) {
 	pointer := 0
@@ -117,6 +126,20 @@ func Peek(tokens *[]g.ParseToken, idx int) *g.ParseToken {
 	return &(*tokens)[idx]
 }
 
+// scanGenerators are the generators that implement SCANL, SCANR and PRNT
+var scanGenerators = map[string]bool{
+	"wat":     true,
+	"wasm":    true,
+	"x86_64":  true,
+	"arm64":   true,
+	"riscv64": true,
+	"elf":     true,
+	"go":      true,
+	"rust":    true,
+	"python":  true,
+	"awk":     true,
+}
+
 func findLoopEnd(tokens []g.ParseToken) int {
 	depth := 1
 	for i, t := range tokens {
@@ -143,7 +166,8 @@ func setValueAfterLoop(t g.ParseToken, tokens []g.ParseToken) (newToken *g.Parse
 		D(t, "SLO: Pushing a MOV with %d, 0 to set final value of mem[p]", value)
 		insts++
 	} else if Peek(&tokens, 1).Tok.Tok == l.SUB {
-		value = (0 - Peek(&tokens, 1).Extra) % 256
+		// The generators wrap the value around to the cell size, so it is kept as it is here
+		value = 0 - Peek(&tokens, 1).Extra
 		D(t, "SLO: Pushing a MOV with %d, 0 to set final value of mem[p]", value)
 		insts++
 	} else {
@@ -172,8 +196,8 @@ func setValueAfterLoop(t g.ParseToken, tokens []g.ParseToken) (newToken *g.Parse
 // so this optimizer will generate new tokens not supported by the Brainfuck generator
 func Optimize2(tokens []g.ParseToken, generator string) []g.ParseToken {
 	newTokens := make([]g.ParseToken, 0, len(tokens))
-	// We know that the first byte is 0
-	currentPointerIsZero := true
+	// We know that the first byte is 0, unless the tape is initialized
+	currentPointerIsZero := !TapeInitialized
 mainloop:
 	for i := 0; i < len(tokens); i++ {
 		t := tokens[i]
@@ -205,20 +229,24 @@ mainloop:
 
 			// Found this idea here: http://calmerthanyouare.org/2015/01/07/optimizing-brainfuck.html
 			// C stdlib has memchr() to go through data fast, (but seems like memrchr() is only in gnu stdlib)
-			if generator == "dc" {
+			// The generators in scanGenerators have scan loops in both directions
+			if generator == "dc" || scanGenerators[generator] {
 				if Peek(&tokens, i+2).Tok.Tok == l.JMPB && (Peek(&tokens, i+1).Tok.Tok == l.INCP || Peek(&tokens, i+1).Tok.Tok == l.DECP) && Peek(&tokens, i+1).Extra == 1 {
-					D(t, "C optimization, found a simple scanloop")
 					if Peek(&tokens, i+1).Tok.Tok == l.INCP {
+						D(t, "C optimization, found a simple scanloop")
 						newTokens = append(newTokens, g.ParseToken{
 							Pos: t.Pos,
 							Tok: l.Token{Tok: l.SCANR, TokenName: "SCANR", Character: ""},
 						})
-						/*} else {
-							newTokens = append(newTokens, g.ParseToken{
-								Pos: t.Pos,
-								Tok: l.Token{Tok: l.SCANL, TokenName: "SCANL", Character: ""},
-							})
-						}*/
+						i += 2
+						currentPointerIsZero = true
+						continue
+					} else if scanGenerators[generator] {
+						D(t, "Found a simple scanloop to the left")
+						newTokens = append(newTokens, g.ParseToken{
+							Pos: t.Pos,
+							Tok: l.Token{Tok: l.SCANL, TokenName: "SCANL", Character: ""},
+						})
 						i += 2
 						currentPointerIsZero = true
 						continue
@@ -226,7 +254,7 @@ mainloop:
 				}
 
 				// Find [.>], it's a simple puts
-				if Peek(&tokens, i+1).Tok.Tok == l.OUT && Peek(&tokens, i+2).Tok.Tok == l.INCP && Peek(&tokens, i+3).Tok.Tok == l.JMPB {
+				if Peek(&tokens, i+1).Tok.Tok == l.OUT && Peek(&tokens, i+1).Extra == 1 && Peek(&tokens, i+2).Tok.Tok == l.INCP && Peek(&tokens, i+2).Extra == 1 && Peek(&tokens, i+3).Tok.Tok == l.JMPB {
 					newTokens = append(newTokens, g.ParseToken{
 						Pos: t.Pos,
 						Tok: l.Token{Tok: l.PRNT, TokenName: "PRNT", Character: ""},
@@ -288,6 +316,13 @@ mainloop:
 					}
 				}
 
+				if SignedCells && decrementer > 1 {
+					D(t, "SLO: Loop with decrementer %d can not be divided with signed cells, keeping the loop", decrementer)
+					newTokens = append(newTokens, t)
+					currentPointerIsZero = false
+					continue mainloop
+				}
+
 				pointer = 0
 				// If the decrementer is not 1, we need to divide p[0] with the decrementer to get the correct multiplier
 				if decrementer != 1 && decrementer != 0 {
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	g "bcomp/generators"
+	i "bcomp/interpreter"
+)
+
+// Default step limit for each configuration, as programs often loop forever
+// when reading past the end of the input with another EOF policy
+const portabilityMaxSteps = 100000000
+
+func checkPortability(tokens []g.ParseToken, inputFiles []string) {
+	ctx := context.Background()
+	if optTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, optTimeout)
+		defer cancel()
+	}
+
+	opts := i.Options{
+		Context:        ctx,
+		MaxSteps:       optMaxSteps,
+		MaxOutputBytes: optMaxOutput,
+		MaxTapeGrowth:  optMaxTapeGrowth,
+		Signed:         optSigned,
+		IO:             ioMode,
+		TapeInit:       optTapeInit,
+	}
+	if opts.MaxSteps == 0 {
+		opts.MaxSteps = portabilityMaxSteps
+	}
+
+	// Without input files, run once with empty input
+	inputs := map[string][]byte{"(no input)": {}}
+	names := []string{"(no input)"}
+	if len(inputFiles) > 0 {
+		inputs = make(map[string][]byte)
+		names = inputFiles
+		for _, name := range inputFiles {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error opening file:", err)
+				os.Exit(1)
+			}
+			inputs[name] = data
+		}
+	}
+
+	diverges := false
+	for _, name := range names {
+		fmt.Printf("Input %s:\n", name)
+
+		for n, pr := range i.CheckPortability(tokens, optMemorySize, inputs[name], opts) {
+			status := "baseline"
+			if n > 0 {
+				status = "same"
+				if pr.Diverges {
+					status = "DIVERGES"
+					diverges = true
+				}
+				if pr.CellsDiffer {
+					status += fmt.Sprintf(", cells first differ at %d:%d (step %d)", pr.FirstDifference.Line, pr.FirstDifference.Column, pr.Step)
+				}
+			}
+			if pr.Result.Reason != i.ExitCompleted {
+				status += fmt.Sprintf(", %v at %d:%d", pr.Result.Reason, pr.Result.Pos.Line, pr.Result.Pos.Column)
+			}
+			fmt.Printf("  %-36s %s\n", pr.Config, status)
+		}
+	}
+
+	if diverges {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,42 @@
+Double a cell 40 times
++
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>
+[>++<-]>